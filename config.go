@@ -0,0 +1,794 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/md-irohas/tcppc-go/tcppc"
+	"github.com/pelletier/go-toml"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// Table of tcppc parameters in the configuration file.
+	cnfTable = "tcppc"
+	// Prefix of environment variables of tcppc parameters.
+	envPrefix = "TCPPC_"
+
+	// Origins of parameters.
+	originDefault = "default"
+	originFile    = "file"
+	originEnv     = "env"
+	originFlag    = "flag"
+
+	// Modes of tcppc.
+	modeSensor    = "sensor"
+	modeCollector = "collector"
+)
+
+// Config holds parameters of tcppc.
+// Parameters are determined in the order of precedence: defaults <
+// configuration file < environment variables < command-line flags.
+type Config struct {
+	Host             string
+	Port             int
+	Timeout          int
+	Mode             string
+	FileNameFmt      string
+	Output           string
+	Format           string
+	ZeekFileFmt      string
+	SQLiteFileFmt    string
+	ESURL            string
+	ESIndex          string
+	ESFormat         string
+	ESUsername       string
+	ESPassword       string
+	ESAPIKey         string
+	ESBatchSize      int
+	ESFlushInterval  int
+	ESQueueSize      int
+	ESMaxRetries     int
+	ESDeadLetterFile string
+	S3Endpoint       string
+	S3Region         string
+	S3Bucket         string
+	S3AccessKey      string
+	S3SecretKey      string
+	S3SessionToken   string
+	S3KeyPrefix      string
+	S3PathStyle      bool
+	S3PartSize       uint64
+	S3DeleteUploaded bool
+	S3StateFile      string
+	ForwardAddr      string
+	ForwardBufferDir string
+	ForwardBufferMax uint64
+	ForwardBatch     int
+	ForwardInterval  int
+	ForwardQueueSize int
+	DedupWindow      int
+	MTLSCert         string
+	MTLSKey          string
+	MTLSCA           string
+	SyslogURL        string
+	SyslogFacility   string
+	SyslogMaxSize    int
+	SyslogMaxPayload int
+	SyslogCA         string
+	RotInt           int
+	RotOffset        int
+	RotSchedule      string
+	MaxFileSize      uint64
+	WriteQueueSize   int
+	WriteQueueFull   string
+	Fsync            string
+	FsyncInterval    int
+	SpoolDir         string
+	PartialFiles     bool
+	RotateHook       string
+	Sensor           string
+	SensorTags       string
+	CommunityIDSeed  int
+	MaxOpenFiles     int
+	IdleFileTimeout  int
+	LogFile          string
+	Timezone         string
+	MaxFdNum         uint64
+	X509Cert         string
+	X509Key          string
+	DisableTCPServer bool
+	DisableUDPServer bool
+	MaxConns         int
+	MaxConnsPerSrc   int
+	RatePerSrc       float64
+	BurstPerSrc      int
+	Overflow         string
+	MaxSessionBytes  int
+	MaxPayloads      int
+	MaxDuration      int
+	User             string
+	Group            string
+	KeepCapNetAdmin  bool
+	Sandbox          bool
+	TCPListenerName  string
+	UDPListenerName  string
+}
+
+// defaultSensor returns the hostname as the default name of the sensor.
+func defaultSensor() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	return hostname
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Host:        "0.0.0.0",
+		Port:        12345,
+		Timeout:     60,
+		Mode:        modeSensor,
+		Timezone:    "Local",
+		BurstPerSrc: 1,
+		Overflow:    tcppc.OverflowClose,
+
+		Output:         tcppc.OutputSessions,
+		Format:         tcppc.FormatNative,
+		WriteQueueSize: tcppc.DefaultQueueSize,
+		WriteQueueFull: tcppc.QueueBlock,
+		Fsync:          tcppc.SyncNever,
+		FsyncInterval:  1,
+
+		ESIndex:         tcppc.DefaultESIndex,
+		ESFormat:        tcppc.FormatECS,
+		ESBatchSize:     tcppc.DefaultESBatchSize,
+		ESFlushInterval: int(tcppc.DefaultESFlushInterval / time.Second),
+		ESQueueSize:     tcppc.DefaultESQueueSize,
+		ESMaxRetries:    tcppc.DefaultESMaxRetries,
+
+		S3Region:    tcppc.DefaultS3Region,
+		S3KeyPrefix: tcppc.DefaultS3KeyPrefix,
+		S3PathStyle: true,
+		S3PartSize:  tcppc.DefaultS3PartSize,
+
+		ForwardBufferMax: 1 << 30,
+		ForwardBatch:     tcppc.DefaultForwardBatchSize,
+		ForwardInterval:  int(tcppc.DefaultForwardFlushInterval / time.Second),
+		ForwardQueueSize: tcppc.DefaultForwardQueueSize,
+		DedupWindow:      int(tcppc.DefaultCollectorDedupWindow / time.Second),
+
+		SyslogFacility:   "local0",
+		SyslogMaxSize:    tcppc.DefaultSyslogMaxSize,
+		SyslogMaxPayload: tcppc.DefaultSyslogMaxPayload,
+
+		Sensor:          defaultSensor(),
+		MaxOpenFiles:    tcppc.DefaultMaxOpenFiles,
+		IdleFileTimeout: 300,
+
+		TCPListenerName: "tcp",
+		UDPListenerName: "udp",
+	}
+}
+
+// Keys of parameters whose values are not printed.
+var secretKeys = map[string]bool{
+	"esPassword":     true,
+	"esApiKey":       true,
+	"s3SecretKey":    true,
+	"s3SessionToken": true,
+}
+
+type param struct {
+	// Key in the [tcppc] table of the configuration file.
+	key string
+	// Name of the command-line flag.
+	flag string
+	// Usage of the command-line flag.
+	usage string
+	// Pointer to the field of Config (*string, *int, *uint64, *float64 or
+	// *bool).
+	value interface{}
+}
+
+// params returns parameters bound to the fields of c.
+func (c *Config) params() []param {
+	return []param{
+		{"host", "H", "hostname to listen on.", &c.Host},
+		{"port", "p", "port number to listen on.", &c.Port},
+		{"timeout", "t", "timeout for TCP/TLS connection.", &c.Timeout},
+		{"mode", "mode", "mode of tcppc (sensor: capture sessions, collector: receive sessions from sensors on host:port).", &c.Mode},
+		{"tcpFileFmt", "w", "session file (JSON lines format).", &c.FileNameFmt},
+		{"output", "output", "output mode of session file (sessions: a record per session when it ends, events: records as events happen).", &c.Output},
+		{"format", "format", "format of records in session file (native, ecs or eve).", &c.Format},
+		{"zeekFileFmt", "zeek-file-fmt", "Zeek-style logs (conn.log and tcppc_payload.log) written in addition to session file (must contain {log}).", &c.ZeekFileFmt},
+		{"sqliteFileFmt", "sqlite-file-fmt", "SQLite database where sessions are written in addition to session file (rotated like session files).", &c.SQLiteFileFmt},
+		{"esUrl", "es-url", "URL of Elasticsearch/OpenSearch where records are indexed with the _bulk API (e.g. \"http://localhost:9200\").", &c.ESURL},
+		{"esIndex", "es-index", "index name format of Elasticsearch (strftime and tokens).", &c.ESIndex},
+		{"esFormat", "es-format", "format of documents indexed into Elasticsearch (native, ecs or eve).", &c.ESFormat},
+		{"esUsername", "es-username", "username of basic authentication of Elasticsearch.", &c.ESUsername},
+		{"esPassword", "es-password", "password of basic authentication of Elasticsearch.", &c.ESPassword},
+		{"esApiKey", "es-api-key", "API key of Elasticsearch (base64 of \"id:key\"; overrides username/password).", &c.ESAPIKey},
+		{"esBatchSize", "es-batch-size", "maximum number of documents in a bulk request of Elasticsearch.", &c.ESBatchSize},
+		{"esFlushInterval", "es-flush-interval", "interval of bulk requests of Elasticsearch [sec].", &c.ESFlushInterval},
+		{"esQueueSize", "es-queue-size", "maximum number of documents waiting to be indexed into Elasticsearch (dropped when full).", &c.ESQueueSize},
+		{"esMaxRetries", "es-max-retries", "maximum number of retries of documents which failed to be indexed into Elasticsearch.", &c.ESMaxRetries},
+		{"esDeadLetterFile", "es-dead-letter-file", "file where documents which failed to be indexed into Elasticsearch are appended.", &c.ESDeadLetterFile},
+		{"s3Endpoint", "s3-endpoint", "endpoint of S3-compatible storage where rotated files are uploaded (e.g. \"https://s3.ap-northeast-1.amazonaws.com\", \"http://127.0.0.1:9000\").", &c.S3Endpoint},
+		{"s3Region", "s3-region", "region of S3.", &c.S3Region},
+		{"s3Bucket", "s3-bucket", "bucket of S3.", &c.S3Bucket},
+		{"s3AccessKey", "s3-access-key", "access key ID of S3.", &c.S3AccessKey},
+		{"s3SecretKey", "s3-secret-key", "secret access key of S3.", &c.S3SecretKey},
+		{"s3SessionToken", "s3-session-token", "session token of temporary credentials of S3.", &c.S3SessionToken},
+		{"s3KeyPrefix", "s3-key-prefix", "prefix of object keys of S3 (strftime and {sensor}).", &c.S3KeyPrefix},
+		{"s3PathStyle", "s3-path-style", "put the bucket in the path of URLs of S3 instead of the hostname (needed by MinIO).", &c.S3PathStyle},
+		{"s3PartSize", "s3-part-size", "size of parts of multipart uploads of S3 [bytes].", &c.S3PartSize},
+		{"s3DeleteUploaded", "s3-delete-uploaded", "delete files after they are uploaded to S3.", &c.S3DeleteUploaded},
+		{"s3StateFile", "s3-state-file", "file where uploads to S3 which have not succeeded are kept across restarts.", &c.S3StateFile},
+		{"forwardAddr", "forward-addr", "address of the collector where sessions are forwarded (\"host:port\").", &c.ForwardAddr},
+		{"forwardBufferDir", "forward-buffer-dir", "directory where batches are kept until the collector acknowledges them.", &c.ForwardBufferDir},
+		{"forwardBufferMax", "forward-buffer-max", "maximum total size of batches in the buffer directory [bytes] (0: unlimited).", &c.ForwardBufferMax},
+		{"forwardBatchSize", "forward-batch-size", "maximum number of records in a batch forwarded to the collector.", &c.ForwardBatch},
+		{"forwardFlushInterval", "forward-flush-interval", "interval of batches forwarded to the collector [sec].", &c.ForwardInterval},
+		{"forwardQueueSize", "forward-queue-size", "maximum number of records waiting to be forwarded (dropped when full).", &c.ForwardQueueSize},
+		{"dedupWindow", "dedup-window", "duration for which the collector drops duplicates of records [sec].", &c.DedupWindow},
+		{"mtlsCert", "mtls-cert", "certificate file of mutual TLS between sensors and the collector.", &c.MTLSCert},
+		{"mtlsKey", "mtls-key", "key file of mutual TLS between sensors and the collector.", &c.MTLSKey},
+		{"mtlsCa", "mtls-ca", "CA certificate file which verifies peers of mutual TLS between sensors and the collector.", &c.MTLSCA},
+		{"syslogUrl", "syslog-url", "syslog server where sessions are written as RFC 5424 messages or journald (e.g. \"unix:///dev/log\", \"udp://host:514\", \"tls://host:6514\", \"journald://\").", &c.SyslogURL},
+		{"syslogFacility", "syslog-facility", "facility of syslog messages (e.g. local0).", &c.SyslogFacility},
+		{"syslogMaxSize", "syslog-max-size", "maximum size of a syslog message [bytes] (payload data are truncated, and then fields are dropped, to fit).", &c.SyslogMaxSize},
+		{"syslogMaxPayload", "syslog-max-payload", "maximum number of bytes of payload data in a syslog message (0: none).", &c.SyslogMaxPayload},
+		{"syslogCa", "syslog-ca", "CA certificate file which verifies the syslog server over TLS (default: system roots).", &c.SyslogCA},
+		{"rotInt", "T", "rotation interval [sec].", &c.RotInt},
+		{"rotOffset", "offset", "rotation interval offset [sec].", &c.RotOffset},
+		{"rotSchedule", "rot-schedule", "cron-style rotation schedule in the timezone (e.g. \"0 0 * * *\", \"@hourly\"; overrides -T and -offset).", &c.RotSchedule},
+		{"maxFileSize", "max-file-size", "maximum size of session file [bytes] (0: unlimited).", &c.MaxFileSize},
+		{"writeQueueSize", "write-queue-size", "maximum number of sessions waiting to be written to session file.", &c.WriteQueueSize},
+		{"writeQueueFull", "write-queue-full", "behaviour when the write queue is full (block or drop).", &c.WriteQueueFull},
+		{"fsync", "fsync", "policy to sync session file to disk (never, interval or always).", &c.Fsync},
+		{"fsyncInterval", "fsync-interval", "interval of syncs of session file [sec] (fsync = interval).", &c.FsyncInterval},
+		{"spoolDir", "spool-dir", "directory where session data are written while session file can not be written (e.g. disk full).", &c.SpoolDir},
+		{"partialFiles", "partial-files", "write session file as <name>.partial and rename it to <name> on rotation.", &c.PartialFiles},
+		{"rotateHook", "rotate-hook", "command invoked with the path, the number of sessions and the size of each rotated session file.", &c.RotateHook},
+		{"sensor", "sensor", "name of this sensor written in each record and {sensor} in session file (default: hostname).", &c.Sensor},
+		{"sensorTags", "sensor-tags", "comma-separated tags of this sensor written in each record (e.g. \"tokyo,cloud\").", &c.SensorTags},
+		{"communityIdSeed", "community-id-seed", "seed of Community ID of sessions (must be the same as in Zeek/Suricata to join them).", &c.CommunityIDSeed},
+		{"maxOpenFiles", "max-open-files", "maximum number of session files open at once.", &c.MaxOpenFiles},
+		{"idleFileTimeout", "idle-file-timeout", "close session files of a templated name after they are idle for this time [sec] (0: never).", &c.IdleFileTimeout},
+		{"logFile", "L", "[deprecated] log file.", &c.LogFile},
+		{"timezone", "z", "timezone used for session file.", &c.Timezone},
+		{"maxFdNum", "R", "maximum number of file descriptors (need root priviledge).", &c.MaxFdNum},
+		{"x509Cert", "C", "TLS certificate file.", &c.X509Cert},
+		{"x509Key", "K", "TLS key file.", &c.X509Key},
+		{"disableTcpServer", "disable-tcp-server", "disable TCP/TLS server.", &c.DisableTCPServer},
+		{"disableUdpServer", "disable-udp-server", "disable UDP server.", &c.DisableUDPServer},
+		{"maxConns", "max-conns", "maximum number of concurrent TCP/TLS connections (0: unlimited).", &c.MaxConns},
+		{"maxConnsPerSrc", "max-conns-per-src", "maximum number of concurrent TCP/TLS connections per source IP (0: unlimited).", &c.MaxConnsPerSrc},
+		{"ratePerSrc", "rate-per-src", "maximum number of new TCP/TLS connections per second per source IP (0: unlimited).", &c.RatePerSrc},
+		{"burstPerSrc", "burst-per-src", "burst size of new TCP/TLS connections per source IP.", &c.BurstPerSrc},
+		{"overflow", "overflow", "behaviour when connections exceed the limits (close or record).", &c.Overflow},
+		{"maxSessionBytes", "max-session-bytes", "maximum number of bytes received per TCP/TLS session (0: unlimited).", &c.MaxSessionBytes},
+		{"maxPayloads", "max-payloads", "maximum number of payloads per TCP/TLS session (0: unlimited).", &c.MaxPayloads},
+		{"maxDuration", "max-duration", "maximum duration of TCP/TLS session [sec] (0: unlimited).", &c.MaxDuration},
+		{"user", "user", "user to switch to after listeners are bound (need root priviledge).", &c.User},
+		{"group", "group", "group to switch to after listeners are bound (default: primary group of the user).", &c.Group},
+		{"keepCapNetAdmin", "keep-cap-net-admin", "retain CAP_NET_ADMIN after switching to the user.", &c.KeepCapNetAdmin},
+		{"tcpListenerName", "tcp-listener-name", "name of the TCP/TLS listener written in each record and of the socket passed by systemd socket activation.", &c.TCPListenerName},
+		{"udpListenerName", "udp-listener-name", "name of the UDP listener written in each record and of the socket passed by systemd socket activation.", &c.UDPListenerName},
+		{"sandbox", "sandbox", "restrict syscalls (seccomp) and filesystem access (Landlock) after startup.", &c.Sandbox},
+	}
+}
+
+// sensorTags returns the tags of the sensor split by commas.
+func (c *Config) sensorTags() []string {
+	var tags []string
+	for _, tag := range strings.Split(c.SensorTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// envName returns the name of the environment variable of the given key
+// (e.g. tcpFileFmt -> TCPPC_TCP_FILE_FMT).
+func envName(key string) string {
+	var b strings.Builder
+
+	b.WriteString(envPrefix)
+	for i, r := range key {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := rune(key[i-1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) {
+				b.WriteRune('_')
+			}
+		}
+		if r == '.' {
+			r = '_'
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+// registerFlags defines command-line flags of parameters on fs.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	for _, p := range c.params() {
+		switch v := p.value.(type) {
+		case *string:
+			fs.StringVar(v, p.flag, *v, p.usage)
+		case *int:
+			fs.IntVar(v, p.flag, *v, p.usage)
+		case *uint64:
+			fs.Uint64Var(v, p.flag, *v, p.usage)
+		case *float64:
+			fs.Float64Var(v, p.flag, *v, p.usage)
+		case *bool:
+			fs.BoolVar(v, p.flag, *v, p.usage)
+		}
+	}
+}
+
+// setString parses s and sets it to the parameter.
+func (p param) setString(s string) error {
+	var err error
+
+	switch v := p.value.(type) {
+	case *string:
+		*v = s
+	case *int:
+		*v, err = strconv.Atoi(s)
+	case *uint64:
+		*v, err = strconv.ParseUint(s, 10, 64)
+	case *float64:
+		*v, err = strconv.ParseFloat(s, 64)
+	case *bool:
+		*v, err = strconv.ParseBool(s)
+	}
+
+	return err
+}
+
+// setTOML sets a value in the configuration file to the parameter.
+func (p param) setTOML(value interface{}) error {
+	switch v := p.value.(type) {
+	case *string:
+		if s, ok := value.(string); ok {
+			*v = s
+			return nil
+		}
+		return fmt.Errorf("expected string, got %T", value)
+	case *int:
+		if i, ok := value.(int64); ok {
+			*v = int(i)
+			return nil
+		}
+		return fmt.Errorf("expected integer, got %T", value)
+	case *uint64:
+		if i, ok := value.(int64); ok && i >= 0 {
+			*v = uint64(i)
+			return nil
+		}
+		return fmt.Errorf("expected non-negative integer, got %v", value)
+	case *float64:
+		if f, ok := value.(float64); ok {
+			*v = f
+			return nil
+		}
+		if i, ok := value.(int64); ok {
+			*v = float64(i)
+			return nil
+		}
+		return fmt.Errorf("expected number, got %T", value)
+	case *bool:
+		if b, ok := value.(bool); ok {
+			*v = b
+			return nil
+		}
+		return fmt.Errorf("expected boolean, got %T", value)
+	}
+
+	return fmt.Errorf("unsupported type %T", p.value)
+}
+
+// format returns the value of the parameter in TOML format.
+func (p param) format() string {
+	switch v := p.value.(type) {
+	case *string:
+		return strconv.Quote(*v)
+	case *int:
+		return strconv.Itoa(*v)
+	case *uint64:
+		return strconv.FormatUint(*v, 10)
+	case *float64:
+		f := strconv.FormatFloat(*v, 'f', -1, 64)
+		if !strings.ContainsAny(f, ".eE") {
+			f += ".0"
+		}
+		return f
+	case *bool:
+		return strconv.FormatBool(*v)
+	}
+
+	return ""
+}
+
+// tomlKeys returns the keys of all values in the tree (dotted for nested
+// tables).
+func tomlKeys(tree *toml.Tree, prefix string) []string {
+	var keys []string
+
+	for _, key := range tree.Keys() {
+		if sub, ok := tree.Get(key).(*toml.Tree); ok {
+			keys = append(keys, tomlKeys(sub, prefix+key+".")...)
+		} else {
+			keys = append(keys, prefix+key)
+		}
+	}
+
+	return keys
+}
+
+// loadFile sets parameters in the configuration file to c.
+func (c *Config) loadFile(fileName string, origins map[string]string) error {
+	cnf, err := toml.LoadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	table, ok := cnf.Get(cnfTable).(*toml.Tree)
+	if !ok {
+		return fmt.Errorf("%s: table not found", cnfTable)
+	}
+
+	params := make(map[string]param)
+	for _, p := range c.params() {
+		params[p.key] = p
+	}
+
+	keys := tomlKeys(table, "")
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		p, ok := params[key]
+		if !ok {
+			return fmt.Errorf("%s.%s: unknown key", cnfTable, key)
+		}
+
+		if err := p.setTOML(table.Get(key)); err != nil {
+			return fmt.Errorf("%s.%s: %s", cnfTable, key, err)
+		}
+		origins[key] = originFile
+	}
+
+	return nil
+}
+
+// loadEnv sets parameters in the environment variables to c.
+func (c *Config) loadEnv(origins map[string]string) error {
+	for _, p := range c.params() {
+		name := envName(p.key)
+
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := p.setString(s); err != nil {
+			return fmt.Errorf("%s (%s.%s): invalid value %q: %s", name, cnfTable, p.key, s, err)
+		}
+		origins[p.key] = originEnv
+	}
+
+	return nil
+}
+
+// Validate checks parameters. Errors name the offending key.
+func (c *Config) Validate() error {
+	var errs []string
+
+	invalid := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s.%s: ", cnfTable, key)+fmt.Sprintf(format, args...))
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		invalid("port", "must be between 0 and 65535 (got %d)", c.Port)
+	}
+	if c.Timeout <= 0 {
+		invalid("timeout", "must be positive (got %d)", c.Timeout)
+	}
+	if c.Mode != modeSensor && c.Mode != modeCollector {
+		invalid("mode", "must be %q or %q (got %q)", modeSensor, modeCollector, c.Mode)
+	}
+	if c.Mode == modeCollector || c.ForwardAddr != "" {
+		if c.MTLSCert == "" || c.MTLSKey == "" || c.MTLSCA == "" {
+			invalid("mtlsCert", "mtlsCert, mtlsKey and mtlsCa must be given in collector mode or with forwardAddr")
+		}
+	}
+	if c.Mode == modeCollector && c.DedupWindow < 1 {
+		invalid("dedupWindow", "must be positive (got %d)", c.DedupWindow)
+	}
+	if c.SyslogURL != "" {
+		network, _, err := tcppc.ParseSyslogURL(c.SyslogURL)
+		if err != nil {
+			invalid("syslogUrl", "%s", err)
+		}
+		if _, err := tcppc.ParseSyslogFacility(c.SyslogFacility); err != nil {
+			invalid("syslogFacility", "%s", err)
+		}
+		if c.SyslogMaxSize < 480 {
+			invalid("syslogMaxSize", "must be at least 480 (got %d)", c.SyslogMaxSize)
+		}
+		if network != tcppc.SyslogTCP && network != tcppc.SyslogTLS && c.SyslogMaxSize > tcppc.SyslogMaxDatagramSize {
+			invalid("syslogMaxSize", "must be at most %d over %s (got %d)", tcppc.SyslogMaxDatagramSize, network, c.SyslogMaxSize)
+		}
+		if c.SyslogMaxPayload < 0 {
+			invalid("syslogMaxPayload", "must not be negative (got %d)", c.SyslogMaxPayload)
+		}
+		if c.SyslogCA != "" && network != tcppc.SyslogTLS {
+			invalid("syslogCa", "can be given only with tls:// of syslogUrl")
+		}
+	}
+	if c.ForwardAddr != "" {
+		if _, _, err := net.SplitHostPort(c.ForwardAddr); err != nil {
+			invalid("forwardAddr", "must be \"host:port\" (got %q)", c.ForwardAddr)
+		}
+		if c.ForwardBufferDir == "" {
+			invalid("forwardBufferDir", "must be given with forwardAddr")
+		}
+		if c.ForwardBatch < 1 {
+			invalid("forwardBatchSize", "must be positive (got %d)", c.ForwardBatch)
+		}
+		if c.ForwardInterval < 1 {
+			invalid("forwardFlushInterval", "must be positive (got %d)", c.ForwardInterval)
+		}
+		if c.ForwardQueueSize < 1 {
+			invalid("forwardQueueSize", "must be positive (got %d)", c.ForwardQueueSize)
+		}
+	}
+	if c.Output != tcppc.OutputSessions && c.Output != tcppc.OutputEvents {
+		invalid("output", "must be %q or %q (got %q)", tcppc.OutputSessions, tcppc.OutputEvents, c.Output)
+	}
+	if _, err := tcppc.NewFormatter(c.Format); err != nil {
+		invalid("format", "must be %q, %q or %q (got %q)", tcppc.FormatNative, tcppc.FormatECS, tcppc.FormatEVE, c.Format)
+	}
+	if c.ZeekFileFmt != "" && !strings.Contains(c.ZeekFileFmt, tcppc.TokenLog) {
+		invalid("zeekFileFmt", "must contain %s (got %q)", tcppc.TokenLog, c.ZeekFileFmt)
+	}
+	if c.ESURL != "" {
+		if u, err := url.Parse(c.ESURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("esUrl", "must be an http or https URL (got %q)", c.ESURL)
+		}
+		if c.ESIndex == "" {
+			invalid("esIndex", "must not be empty")
+		}
+		if _, err := tcppc.NewFormatter(c.ESFormat); err != nil {
+			invalid("esFormat", "must be %q, %q or %q (got %q)", tcppc.FormatNative, tcppc.FormatECS, tcppc.FormatEVE, c.ESFormat)
+		}
+		if c.ESBatchSize < 1 {
+			invalid("esBatchSize", "must be positive (got %d)", c.ESBatchSize)
+		}
+		if c.ESFlushInterval < 1 {
+			invalid("esFlushInterval", "must be positive (got %d)", c.ESFlushInterval)
+		}
+		if c.ESQueueSize < 1 {
+			invalid("esQueueSize", "must be positive (got %d)", c.ESQueueSize)
+		}
+		if c.ESMaxRetries < 1 {
+			invalid("esMaxRetries", "must be positive (got %d)", c.ESMaxRetries)
+		}
+	}
+	if c.S3Endpoint != "" {
+		if u, err := url.Parse(c.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("s3Endpoint", "must be an http or https URL (got %q)", c.S3Endpoint)
+		}
+		if c.FileNameFmt == "" && c.ZeekFileFmt == "" && c.SQLiteFileFmt == "" {
+			invalid("s3Endpoint", "tcpFileFmt, zeekFileFmt or sqliteFileFmt must be given to upload files")
+		}
+		// Without partial files, a file may be appended to (and uploaded
+		// again) after it is uploaded, e.g. after restarts.
+		if (c.FileNameFmt != "" || c.ZeekFileFmt != "") && !c.PartialFiles {
+			invalid("s3Endpoint", "partialFiles must be enabled to upload files")
+		}
+		if c.S3Bucket == "" {
+			invalid("s3Bucket", "must be given with s3Endpoint")
+		}
+		if c.S3AccessKey == "" || c.S3SecretKey == "" {
+			invalid("s3AccessKey", "both s3AccessKey and s3SecretKey must be given with s3Endpoint")
+		}
+		if c.S3PartSize < 5*1024*1024 {
+			invalid("s3PartSize", "must be at least 5 MiB (got %d)", c.S3PartSize)
+		}
+	}
+	if c.RotInt < 0 {
+		invalid("rotInt", "must not be negative (got %d)", c.RotInt)
+	}
+	if c.RotOffset < 0 || (c.RotInt > 0 && c.RotOffset >= c.RotInt) {
+		invalid("rotOffset", "must be between 0 and rotInt - 1 (got %d)", c.RotOffset)
+	}
+	if c.RotSchedule != "" {
+		if _, err := tcppc.ParseCron(c.RotSchedule); err != nil {
+			invalid("rotSchedule", "%s", err)
+		}
+	}
+	if c.WriteQueueSize < 1 {
+		invalid("writeQueueSize", "must be positive (got %d)", c.WriteQueueSize)
+	}
+	if c.WriteQueueFull != tcppc.QueueBlock && c.WriteQueueFull != tcppc.QueueDrop {
+		invalid("writeQueueFull", "must be %q or %q (got %q)", tcppc.QueueBlock, tcppc.QueueDrop, c.WriteQueueFull)
+	}
+	if c.Fsync != tcppc.SyncNever && c.Fsync != tcppc.SyncInterval && c.Fsync != tcppc.SyncAlways {
+		invalid("fsync", "must be %q, %q or %q (got %q)", tcppc.SyncNever, tcppc.SyncInterval, tcppc.SyncAlways, c.Fsync)
+	}
+	if c.Fsync == tcppc.SyncInterval && c.FsyncInterval < 1 {
+		invalid("fsyncInterval", "must be positive (got %d)", c.FsyncInterval)
+	}
+	if c.CommunityIDSeed < 0 || c.CommunityIDSeed > 65535 {
+		invalid("communityIdSeed", "must be between 0 and 65535 (got %d)", c.CommunityIDSeed)
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		invalid("timezone", "%s", err)
+	}
+	if (c.X509Cert == "") != (c.X509Key == "") && !c.DisableTCPServer {
+		invalid("x509Cert", "both or none of x509Cert and x509Key must be given")
+	}
+	if c.DisableTCPServer && c.DisableUDPServer && c.Mode == modeSensor {
+		invalid("disableUdpServer", "both TCP/TLS and UDP servers are disabled")
+	}
+	if c.MaxConns < 0 {
+		invalid("maxConns", "must not be negative (got %d)", c.MaxConns)
+	}
+	if c.MaxConnsPerSrc < 0 {
+		invalid("maxConnsPerSrc", "must not be negative (got %d)", c.MaxConnsPerSrc)
+	}
+	if c.RatePerSrc < 0 {
+		invalid("ratePerSrc", "must not be negative (got %g)", c.RatePerSrc)
+	}
+	if c.BurstPerSrc < 1 {
+		invalid("burstPerSrc", "must be positive (got %d)", c.BurstPerSrc)
+	}
+	if c.Overflow != tcppc.OverflowClose && c.Overflow != tcppc.OverflowRecord {
+		invalid("overflow", "must be %q or %q (got %q)", tcppc.OverflowClose, tcppc.OverflowRecord, c.Overflow)
+	}
+	if c.MaxSessionBytes < 0 {
+		invalid("maxSessionBytes", "must not be negative (got %d)", c.MaxSessionBytes)
+	}
+	if c.MaxPayloads < 0 {
+		invalid("maxPayloads", "must not be negative (got %d)", c.MaxPayloads)
+	}
+	if c.MaxDuration < 0 {
+		invalid("maxDuration", "must not be negative (got %d)", c.MaxDuration)
+	}
+
+	if c.MaxOpenFiles < 1 {
+		invalid("maxOpenFiles", "must be positive (got %d)", c.MaxOpenFiles)
+	}
+	if c.IdleFileTimeout < 0 {
+		invalid("idleFileTimeout", "must not be negative (got %d)", c.IdleFileTimeout)
+	}
+	if c.RotateHook != "" && len(strings.Fields(c.RotateHook)) == 0 {
+		invalid("rotateHook", "must contain a command (got %q)", c.RotateHook)
+	}
+	if c.RotateHook != "" && c.Sandbox {
+		invalid("rotateHook", "can not be used with sandbox (commands can not be executed in the sandbox)")
+	}
+
+	if c.User == "" && (c.Group != "" || c.KeepCapNetAdmin) {
+		invalid("user", "must be given when group or keepCapNetAdmin is given")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+// ConfigLoader loads Config from defaults, a configuration file,
+// environment variables and command-line flags.
+type ConfigLoader struct {
+	// Parameters given by command-line flags.
+	flags *Config
+	// Configuration file given by the command-line flag.
+	fileName string
+	// Flag set where flags are defined.
+	fs *flag.FlagSet
+}
+
+// NewConfigLoader defines command-line flags of parameters (and '-c') on fs.
+func NewConfigLoader(fs *flag.FlagSet) *ConfigLoader {
+	l := &ConfigLoader{flags: NewConfig(), fs: fs}
+
+	fs.StringVar(&l.fileName, "c", "", "configuration file.")
+	l.flags.registerFlags(fs)
+
+	return l
+}
+
+// Load returns the effective configuration and the origin of each
+// parameter. It must be called after fs is parsed.
+func (l *ConfigLoader) Load() (*Config, map[string]string, error) {
+	c := NewConfig()
+
+	origins := make(map[string]string)
+	for _, p := range c.params() {
+		origins[p.key] = originDefault
+	}
+
+	if l.fileName != "" {
+		if err := c.loadFile(l.fileName, origins); err != nil {
+			return nil, nil, fmt.Errorf("Failed to load configuration file: %s: %s", l.fileName, err)
+		}
+	}
+
+	if err := c.loadEnv(origins); err != nil {
+		return nil, nil, err
+	}
+
+	// Overwrite parameters by flags which are explicitly given.
+	setFlags := make(map[string]bool)
+	l.fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	for _, p := range c.params() {
+		if setFlags[p.flag] {
+			if err := p.setString(l.fs.Lookup(p.flag).Value.String()); err != nil {
+				return nil, nil, fmt.Errorf("-%s: %s", p.flag, err)
+			}
+			origins[p.key] = originFlag
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	return c, origins, nil
+}
+
+// Print writes the configuration in TOML format with the origin of each
+// parameter. Secrets (e.g. passwords) are masked.
+func (c *Config) Print(origins map[string]string) {
+	fmt.Printf("[%s]\n", cnfTable)
+	for _, p := range c.params() {
+		value := p.format()
+		if secretKeys[p.key] && value != `""` {
+			value = strconv.Quote("********")
+		}
+		fmt.Printf("%s = %s  # %s\n", p.key, value, origins[p.key])
+	}
+}
+
+// runConfigCommand runs 'tcppc config <subcommand>'.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: %s config check [options]\n", os.Args[0])
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	loader := NewConfigLoader(fs)
+	fs.Parse(args[1:])
+
+	cnf, origins, err := loader.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%s\n", err)
+		return 1
+	}
+
+	cnf.Print(origins)
+
+	return 0
+}
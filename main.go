@@ -1,45 +1,38 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"github.com/md-irohas/tcppc-go/tcppc"
-	"github.com/pelletier/go-toml"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 )
 
-const (
-	Version = "0.4.0"
-)
-
 var (
-	host             = flag.String("H", "0.0.0.0", "hostname to listen on.")
-	port             = flag.Int("p", 12345, "port number to listen on.")
-	timeout          = flag.Int("t", 60, "timeout for TCP/TLS connection.")
-	fileNameFmt      = flag.String("w", "", "session file (JSON lines format).")
-	rotInt           = flag.Int("T", 0, "rotation interval [sec].")
-	rotOffset        = flag.Int("offset", 0, "rotation interval offset [sec].")
-	logFileName      = flag.String("L", "", "[deprecated] log file.")
-	timezone         = flag.String("z", "Local", "timezone used for session file.")
-	maxFdNum         = flag.Uint64("R", 0, "maximum number of file descriptors (need root priviledge).")
-	x509Cert         = flag.String("C", "", "TLS certificate file.")
-	x509Key          = flag.String("K", "", "TLS key file.")
-	cnfFileName      = flag.String("c", "", "configuration file.")
-	disableTcpServer = flag.Bool("disable-tcp-server", false, "disable TCP/TLS server.")
-	disableUdpServer = flag.Bool("disable-udp-server", false, "disable UDP server.")
-	showVersion      = flag.Bool("v", false, "show version and exit.")
+	showVersion = flag.Bool("v", false, "show version and exit.")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reassemble" {
+		os.Exit(runReassembleCommand(os.Args[2:]))
+	}
+
+	loader := NewConfigLoader(flag.CommandLine)
 	flag.Parse()
 	if *showVersion {
-		fmt.Println(Version)
+		fmt.Println(tcppc.Version)
 		return
 	}
 
@@ -50,25 +43,11 @@ func main() {
 		log.Fatalf("This program runs only in Linux.")
 	}
 
-	// Parse params from config file.
-	// Params in the command-line arguments are ignored.
-	if *cnfFileName != "" {
-		cnf, err := toml.LoadFile(*cnfFileName)
-		if err != nil {
-			log.Fatalf("Failed to load configuration file: %s", err)
-		}
-
-		*host = cnf.Get("tcppc.host").(string)
-		*port = int(cnf.Get("tcppc.port").(int64))
-		*timeout = int(cnf.Get("tcppc.timeout").(int64))
-		*fileNameFmt = cnf.Get("tcppc.tcpFileFmt").(string)
-		*rotInt = int(cnf.Get("tcppc.rotInt").(int64))
-		*rotOffset = int(cnf.Get("tcppc.rotOffset").(int64))
-		*logFileName = cnf.Get("tcppc.logFile").(string)
-		*timezone = cnf.Get("tcppc.timezone").(string)
-		*maxFdNum = uint64(cnf.Get("tcppc.maxFdNum").(int64))
-		*x509Cert = cnf.Get("tcppc.x509Cert").(string)
-		*x509Key = cnf.Get("tcppc.x509Key").(string)
+	// Load parameters from defaults, the configuration file, environment
+	// variables and command-line flags (in the order of precedence).
+	cnf, _, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s\n", err)
 	}
 
 	// This log file is deprecated.
@@ -76,22 +55,22 @@ func main() {
 	// rotate log files. Therefore, the log file of this process will consume
 	// huge diskspace. If your OS uses systemd-journald, it manages the
 	// stdout/stderr of this process, so you should use it instead.
-	if *logFileName != "" {
-		f, err := os.OpenFile(*logFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if cnf.LogFile != "" {
+		f, err := os.OpenFile(cnf.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
 		if err != nil {
 			log.Fatalf("Failed to open log file: %s\n", err)
 		}
 
 		log.SetOutput(f)
-		log.Printf("Open log file: %s\n", logFileName)
+		log.Printf("Open log file: %s\n", cnf.LogFile)
 	}
 
 	// Raise the upper limit of the number of file descriptors to handle many
 	// requests such as port scannings by attackers.
 	var rLimit syscall.Rlimit
-	if *maxFdNum > 0 {
-		rLimit.Max = *maxFdNum
-		rLimit.Cur = *maxFdNum
+	if cnf.MaxFdNum > 0 {
+		rLimit.Max = cnf.MaxFdNum
+		rLimit.Cur = cnf.MaxFdNum
 
 		err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit)
 		if err != nil {
@@ -99,7 +78,7 @@ func main() {
 		}
 	}
 
-	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
+	err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
 	if err != nil {
 		log.Fatalf("Failed to get maximum number of file descriptos.\n")
 	}
@@ -109,81 +88,624 @@ func main() {
 	// Load location from timezone.
 	// This location object is used to determine the filename of tcp session
 	// files by RotWriter.
-	loc, err := time.LoadLocation(*timezone)
+	loc, err := time.LoadLocation(cnf.Timezone)
 	if err != nil {
-		log.Fatalf("Failed to load timezone: %s %s\n", *timezone, err)
+		log.Fatalf("Failed to load timezone: %s %s\n", cnf.Timezone, err)
 	}
 
-	log.Printf("Timezone: %s\n", *timezone)
-	log.Printf("Timeout: %d\n", *timeout)
+	log.Printf("Timezone: %s\n", cnf.Timezone)
+	log.Printf("Timeout: %d\n", cnf.Timeout)
 
 	// Select mode of tcppc.
 	// When both TLS certificate file and TLS key file are given, this program
 	// starts listening as TLS handshaker. When none of them are given, this
-	// program starts listening as TCP handshaker. Otherwise, this program
-	// fails to start listening.
+	// program starts listening as TCP handshaker. Otherwise, the
+	// configuration is rejected by Validate.
 	var tcppcMode string
-	if !*disableTcpServer {
-		if *x509Cert != "" && *x509Key != "" {
+	if !cnf.DisableTCPServer {
+		if cnf.X509Cert != "" && cnf.X509Key != "" {
 			tcppcMode = "tls"
-		} else if *x509Cert == "" && *x509Key == "" {
+		} else {
 			tcppcMode = "tcp"
+		}
+	}
+
+	// Limit connections from aggressive sources (e.g. port scanners) not to
+	// exhaust file descriptors.
+	var limiter *tcppc.Limiter
+	if cnf.MaxConns > 0 || cnf.MaxConnsPerSrc > 0 || cnf.RatePerSrc > 0 {
+		log.Printf("Connection limits: total: %d, per source: %d, rate per source: %.2f/s (burst: %d), overflow: %s\n", cnf.MaxConns, cnf.MaxConnsPerSrc, cnf.RatePerSrc, cnf.BurstPerSrc, cnf.Overflow)
+
+		limiter = tcppc.NewLimiter(cnf.MaxConns, cnf.MaxConnsPerSrc, cnf.RatePerSrc, cnf.BurstPerSrc, cnf.Overflow)
+	}
+
+	// Bound the size and the duration of each session not to keep sessions
+	// open indefinitely and grow memory without bound.
+	log.Printf("Session limits: bytes: %d, payloads: %d, duration: %d [sec] (0: unlimited)\n", cnf.MaxSessionBytes, cnf.MaxPayloads, cnf.MaxDuration)
+	limits := tcppc.NewSessionLimits(cnf.MaxSessionBytes, cnf.MaxPayloads, cnf.MaxDuration)
+
+	// Resolve the user to switch to after listeners are bound, and make sure
+	// that the user can write session files.
+	var cred *Credential
+	if cnf.User != "" {
+		cred, err = lookupCredential(cnf.User, cnf.Group)
+		if err != nil {
+			log.Fatalf("Failed to look up user/group: %s\n", err)
+		}
+
+		if cnf.FileNameFmt != "" {
+			if err := prepareOutputDir(tcppc.BaseDir(cnf.FileNameFmt), cred); err != nil {
+				log.Fatalf("Invalid output directory: %s\n", err)
+			}
+		}
+		if cnf.ZeekFileFmt != "" {
+			if err := prepareOutputDir(tcppc.BaseDir(cnf.ZeekFileFmt), cred); err != nil {
+				log.Fatalf("Invalid output directory of Zeek logs: %s\n", err)
+			}
+		}
+		if cnf.SQLiteFileFmt != "" {
+			if err := prepareOutputDir(tcppc.BaseDir(cnf.SQLiteFileFmt), cred); err != nil {
+				log.Fatalf("Invalid output directory of SQLite databases: %s\n", err)
+			}
+		}
+		if cnf.ESURL != "" && cnf.ESDeadLetterFile != "" {
+			if err := prepareOutputDir(filepath.Dir(cnf.ESDeadLetterFile), cred); err != nil {
+				log.Fatalf("Invalid directory of dead-letter file: %s\n", err)
+			}
+		}
+		if cnf.S3Endpoint != "" && cnf.S3StateFile != "" {
+			if err := prepareOutputDir(filepath.Dir(cnf.S3StateFile), cred); err != nil {
+				log.Fatalf("Invalid directory of state file of S3: %s\n", err)
+			}
+		}
+		if cnf.ForwardAddr != "" {
+			if err := prepareOutputDir(cnf.ForwardBufferDir, cred); err != nil {
+				log.Fatalf("Invalid buffer directory of forwarding: %s\n", err)
+			}
+		}
+		if cnf.SpoolDir != "" {
+			if err := prepareOutputDir(cnf.SpoolDir, cred); err != nil {
+				log.Fatalf("Invalid spool directory: %s\n", err)
+			}
+		}
+	}
+
+	// Options of writers of session files, Zeek logs and SQLite databases.
+	var writerOpts tcppc.WriterOptions
+	if cnf.FileNameFmt != "" || cnf.ZeekFileFmt != "" || cnf.SQLiteFileFmt != "" {
+		// Rotate files by the cron-style schedule if given, or every RotInt
+		// seconds otherwise.
+		var sched tcppc.Schedule
+		if cnf.RotSchedule != "" {
+			log.Printf("Rotation: at \"%s\", or every %d bytes\n", cnf.RotSchedule, cnf.MaxFileSize)
+
+			sched, err = tcppc.ParseCron(cnf.RotSchedule)
+			if err != nil {
+				log.Fatalf("Invalid rotation schedule: %s\n", err)
+			}
 		} else {
-			log.Println("Either TLS cerfiticate or key file is given.")
-			log.Println("TCP handshaker: neither TLS certificate nor TLS key files are required.")
-			log.Println("TLS handshaker: both TLS certificate and TLS key files are required.")
-			log.Fatalln("Abort.")
+			log.Printf("Rotation: every %d seconds w/ %d seconds offset, or every %d bytes\n", cnf.RotInt, cnf.RotOffset, cnf.MaxFileSize)
+
+			if cnf.RotInt > 0 {
+				sched = tcppc.NewIntervalSchedule(cnf.RotInt, cnf.RotOffset)
+			}
+		}
+
+		// Sessions are written asynchronously through the write queue not to
+		// make session handlers wait for the disk.
+		log.Printf("Write queue: size: %d, when full: %s, fsync: %s (interval: %d [sec])\n", cnf.WriteQueueSize, cnf.WriteQueueFull, cnf.Fsync, cnf.FsyncInterval)
+		queue := tcppc.NewWriterQueue(cnf.WriteQueueSize, cnf.WriteQueueFull, cnf.Fsync, cnf.FsyncInterval)
+
+		if cnf.SpoolDir != "" {
+			log.Printf("Spool directory: %s\n", cnf.SpoolDir)
+
+			// The spool directory must exist to be allowed by the sandbox.
+			if err := os.MkdirAll(cnf.SpoolDir, 0755); err != nil {
+				log.Fatalf("Failed to create spool directory: %s\n", err)
+			}
+		}
+
+		if cnf.Output == tcppc.OutputEvents {
+			log.Printf("Session data are written as events (session_start, payload and session_end).\n")
 		}
+		if cnf.PartialFiles {
+			log.Printf("Session data files are written as *.partial until they are rotated.\n")
+		}
+		if cnf.RotateHook != "" {
+			log.Printf("Rotation hook: %s\n", cnf.RotateHook)
+		}
+
+		writerOpts = tcppc.WriterOptions{
+			Schedule:    sched,
+			MaxFileSize: int64(cnf.MaxFileSize),
+			Location:    loc,
+			Queue:       queue,
+			SpoolDir:    cnf.SpoolDir,
+			Partial:     cnf.PartialFiles,
+			HookCmd:     cnf.RotateHook,
+			Sensor:      cnf.Sensor,
+
+			MaxOpenFiles: cnf.MaxOpenFiles,
+			IdleTimeout:  time.Duration(cnf.IdleFileTimeout) * time.Second,
+		}
+	}
+
+	// Rotated files are uploaded to S3-compatible storage.
+	var uploader *tcppc.S3Uploader
+	if cnf.S3Endpoint != "" {
+		log.Printf("S3: %s (bucket: %s, region: %s, key prefix: %s, part size: %d, delete uploaded files: %t)\n", cnf.S3Endpoint, cnf.S3Bucket, cnf.S3Region, cnf.S3KeyPrefix, cnf.S3PartSize, cnf.S3DeleteUploaded)
+
+		if cnf.S3StateFile != "" {
+			log.Printf("S3 state file: %s\n", cnf.S3StateFile)
+
+			// The directory must exist to be allowed by the sandbox.
+			if err := os.MkdirAll(filepath.Dir(cnf.S3StateFile), 0755); err != nil {
+				log.Fatalf("Failed to create directory of state file of S3: %s\n", err)
+			}
+		}
+
+		uploader, err = tcppc.NewS3Uploader(tcppc.S3Options{
+			Endpoint:          cnf.S3Endpoint,
+			Region:            cnf.S3Region,
+			Bucket:            cnf.S3Bucket,
+			AccessKey:         cnf.S3AccessKey,
+			SecretKey:         cnf.S3SecretKey,
+			SessionToken:      cnf.S3SessionToken,
+			KeyPrefix:         cnf.S3KeyPrefix,
+			PathStyle:         cnf.S3PathStyle,
+			PartSize:          int64(cnf.S3PartSize),
+			DeleteAfterUpload: cnf.S3DeleteUploaded,
+			StateFile:         cnf.S3StateFile,
+			Location:          loc,
+			Sensor:            cnf.Sensor,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start S3 uploader: %s\n", err)
+		}
+		defer uploader.Close()
+
+		writerOpts.OnFinal = uploader.Enqueue
 	}
 
 	var writer *tcppc.RotWriter
-	if *fileNameFmt != "" {
-		log.Printf("Session data file: %s (Rotate every %d seconds w/ %d seconds offset)\n", *fileNameFmt, *rotInt, *rotOffset)
+	if cnf.FileNameFmt != "" {
+		log.Printf("Session data file: %s (format: %s)\n", cnf.FileNameFmt, cnf.Format)
 
-		writer = tcppc.NewWriter(*fileNameFmt, *rotInt, *rotOffset, loc)
+		writer, err = tcppc.NewWriter(cnf.FileNameFmt, writerOpts)
+		if err != nil {
+			log.Fatalf("Failed to open session file: %s\n", err)
+		}
 		defer writer.Close()
+
+		if cred != nil {
+			if err := writer.SetOwner(cred.Uid, cred.Gid); err != nil {
+				log.Fatalf("Failed to change owner of session files: %s\n", err)
+			}
+		}
 	} else {
 		log.Printf("Session data file: none.\n")
-		log.Printf("!!!CAUTION!!! Session data will not be written to files.\n")
+	}
+
+	// Zeek-style logs are written in addition to session files.
+	var zeek *tcppc.ZeekSink
+	if cnf.ZeekFileFmt != "" {
+		log.Printf("Zeek logs: %s\n", cnf.ZeekFileFmt)
+
+		zeek, err = tcppc.NewZeekSink(cnf.ZeekFileFmt, writerOpts)
+		if err != nil {
+			log.Fatalf("Failed to open Zeek logs: %s\n", err)
+		}
+		defer zeek.Close()
+
+		if cred != nil {
+			if err := zeek.SetOwner(cred.Uid, cred.Gid); err != nil {
+				log.Fatalf("Failed to change owner of Zeek logs: %s\n", err)
+			}
+		}
+	}
+
+	// Sessions are written into SQLite databases rotated with session files.
+	var db *tcppc.SQLiteSink
+	if cnf.SQLiteFileFmt != "" {
+		log.Printf("SQLite database: %s\n", cnf.SQLiteFileFmt)
+
+		db, err = tcppc.NewSQLiteSink(cnf.SQLiteFileFmt, tcppc.SQLiteOptions{
+			Schedule: writerOpts.Schedule,
+			Location: loc,
+			Queue:    writerOpts.Queue,
+			Sensor:   cnf.Sensor,
+			OnFinal:  writerOpts.OnFinal,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open SQLite database: %s\n", err)
+		}
+		defer db.Close()
+
+		if cred != nil {
+			if err := db.SetOwner(cred.Uid, cred.Gid); err != nil {
+				log.Fatalf("Failed to change owner of SQLite databases: %s\n", err)
+			}
+		}
+	}
+
+	// Records are indexed into Elasticsearch/OpenSearch directly.
+	var es *tcppc.ESSink
+	if cnf.ESURL != "" {
+		log.Printf("Elasticsearch: %s (index: %s, format: %s, batch size: %d, flush interval: %d [sec], queue size: %d, max retries: %d)\n", cnf.ESURL, cnf.ESIndex, cnf.ESFormat, cnf.ESBatchSize, cnf.ESFlushInterval, cnf.ESQueueSize, cnf.ESMaxRetries)
+
+		formatter, err := tcppc.NewFormatter(cnf.ESFormat)
+		if err != nil {
+			log.Fatalf("Invalid format of Elasticsearch: %s\n", err)
+		}
+
+		if cnf.ESDeadLetterFile != "" {
+			log.Printf("Elasticsearch dead-letter file: %s\n", cnf.ESDeadLetterFile)
+
+			// The directory must exist to be allowed by the sandbox.
+			if err := os.MkdirAll(filepath.Dir(cnf.ESDeadLetterFile), 0755); err != nil {
+				log.Fatalf("Failed to create directory of dead-letter file: %s\n", err)
+			}
+		}
+
+		es, err = tcppc.NewESSink(tcppc.ESOptions{
+			URL:            cnf.ESURL,
+			Index:          cnf.ESIndex,
+			Format:         formatter,
+			Username:       cnf.ESUsername,
+			Password:       cnf.ESPassword,
+			APIKey:         cnf.ESAPIKey,
+			BatchSize:      cnf.ESBatchSize,
+			FlushInterval:  time.Duration(cnf.ESFlushInterval) * time.Second,
+			QueueSize:      cnf.ESQueueSize,
+			MaxRetries:     cnf.ESMaxRetries,
+			DeadLetterFile: cnf.ESDeadLetterFile,
+			Location:       loc,
+			Sensor:         cnf.Sensor,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start Elasticsearch sink: %s\n", err)
+		}
+		defer es.Close()
+	}
+
+	// Sensors and the collector authenticate each other by certificates
+	// issued by the CA.
+	var mtlsConfig *tls.Config
+	if cnf.Mode == modeCollector || cnf.ForwardAddr != "" {
+		log.Printf("Mutual TLS: certificate: %s, key: %s, CA: %s\n", cnf.MTLSCert, cnf.MTLSKey, cnf.MTLSCA)
+
+		mtlsConfig, err = tcppc.NewMTLSConfig(cnf.MTLSCert, cnf.MTLSKey, cnf.MTLSCA)
+		if err != nil {
+			log.Fatalf("Invalid mutual TLS configuration: %s\n", err)
+		}
+	}
+
+	// Sessions are forwarded to the collector.
+	var forward *tcppc.ForwardSink
+	if cnf.ForwardAddr != "" {
+		log.Printf("Forward: %s (buffer: %s, max: %d bytes, batch size: %d, flush interval: %d [sec], queue size: %d)\n", cnf.ForwardAddr, cnf.ForwardBufferDir, cnf.ForwardBufferMax, cnf.ForwardBatch, cnf.ForwardInterval, cnf.ForwardQueueSize)
 
-		writer = nil
+		forward, err = tcppc.NewForwardSink(tcppc.ForwardOptions{
+			Addr:          cnf.ForwardAddr,
+			TLSConfig:     mtlsConfig,
+			BufferDir:     cnf.ForwardBufferDir,
+			BufferMax:     int64(cnf.ForwardBufferMax),
+			BatchSize:     cnf.ForwardBatch,
+			FlushInterval: time.Duration(cnf.ForwardInterval) * time.Second,
+			QueueSize:     cnf.ForwardQueueSize,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start forwarding: %s\n", err)
+		}
+		defer forward.Close()
 	}
 
-	if !*disableTcpServer {
-		switch tcppcMode {
-		case "tcp":
-			go tcppc.StartTCPServer(*host, *port, writer, *timeout)
+	// Sessions are written to syslog or journald.
+	var syslog *tcppc.SyslogSink
+	var syslogNetwork string
+	if cnf.SyslogURL != "" {
+		network, addr, err := tcppc.ParseSyslogURL(cnf.SyslogURL)
+		if err != nil {
+			log.Fatalf("Invalid syslog URL: %s\n", err)
+		}
+		facility, err := tcppc.ParseSyslogFacility(cnf.SyslogFacility)
+		if err != nil {
+			log.Fatalf("Invalid syslog facility: %s\n", err)
+		}
 
-		case "tls":
-			log.Printf("Certificate: %s, Key: %s\n", *x509Cert, *x509Key)
+		log.Printf("Syslog: %s (facility: %s, max size: %d, max payload: %d)\n", cnf.SyslogURL, cnf.SyslogFacility, cnf.SyslogMaxSize, cnf.SyslogMaxPayload)
 
-			cer, err := tls.LoadX509KeyPair(*x509Cert, *x509Key)
+		var tlsConfig *tls.Config
+		if cnf.SyslogCA != "" {
+			data, err := os.ReadFile(cnf.SyslogCA)
 			if err != nil {
-				log.Fatalf("Failed to load X509 key pair: %s\n", err)
+				log.Fatalf("Failed to read CA file of syslog: %s\n", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				log.Fatalf("No certificate found in CA file of syslog: %s\n", cnf.SyslogCA)
 			}
+			tlsConfig = &tls.Config{RootCAs: pool}
+		}
+
+		// Payload data are not written if syslogMaxPayload is 0.
+		maxPayload := cnf.SyslogMaxPayload
+		if maxPayload == 0 {
+			maxPayload = -1
+		}
+
+		syslog, err = tcppc.NewSyslogSink(tcppc.SyslogOptions{
+			Network:    network,
+			Addr:       addr,
+			TLSConfig:  tlsConfig,
+			Facility:   facility,
+			Hostname:   cnf.Sensor,
+			MaxSize:    cnf.SyslogMaxSize,
+			MaxPayload: maxPayload,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start syslog sink: %s\n", err)
+		}
+		defer syslog.Close()
+		syslogNetwork = network
+	}
+
+	// Destinations of session data.
+	var sinks []tcppc.Sink
+	if writer != nil {
+		formatter, err := tcppc.NewFormatter(cnf.Format)
+		if err != nil {
+			log.Fatalf("Invalid format of session data: %s\n", err)
+		}
+
+		sinks = append(sinks, tcppc.NewFileSink(writer, formatter))
+	}
+	if zeek != nil {
+		sinks = append(sinks, zeek)
+	}
+	if db != nil {
+		sinks = append(sinks, db)
+	}
+	if es != nil {
+		sinks = append(sinks, es)
+	}
+	if forward != nil {
+		sinks = append(sinks, forward)
+	}
+	if syslog != nil {
+		sinks = append(sinks, syslog)
+	}
+
+	if len(sinks) == 0 {
+		log.Printf("!!!CAUTION!!! Session data will not be written anywhere.\n")
+	}
+
+	// Use listeners passed by systemd (socket activation) if any.
+	activated, err := activatedListeners(cnf.TCPListenerName, cnf.UDPListenerName)
+	if err != nil {
+		log.Fatalf("Failed to use sockets passed by systemd: %s\n", err)
+	}
+
+	// Connect to systemd to notify the service state (Type=notify).
+	notifier, err := newNotifier()
+	if err != nil {
+		log.Fatalf("Failed to connect to systemd: %s\n", err)
+	}
+	defer notifier.Close()
+
+	// Serve as the honeypot server (sensor mode) or the collector of sessions
+	// forwarded by sensors (collector mode).
+	var service interface {
+		Listen() error
+		Serve(ctx context.Context) error
+		Ready() <-chan struct{}
+		Healthy() bool
+	}
+	var server *tcppc.Server
+	var collector *tcppc.Collector
+
+	if cnf.Mode == modeCollector {
+		log.Printf("Server Mode: COLLECTOR (dedup window: %d [sec])\n", cnf.DedupWindow)
+
+		copts := tcppc.CollectorOptions{
+			Host:        cnf.Host,
+			Port:        cnf.Port,
+			TLSConfig:   mtlsConfig,
+			Sinks:       sinks,
+			DedupWindow: time.Duration(cnf.DedupWindow) * time.Second,
+		}
+		if activated.TCP != nil {
+			copts.Listener = activated.TCP
+		}
+
+		collector = tcppc.NewCollector(copts)
+		service = collector
+	} else {
+		opts := tcppc.Options{
+			Host:       cnf.Host,
+			Port:       cnf.Port,
+			DisableTCP: cnf.DisableTCPServer,
+			DisableUDP: cnf.DisableUDPServer,
+			Timeout:    time.Duration(cnf.Timeout) * time.Second,
+			Sinks:      sinks,
+			Output:     cnf.Output,
+			Limiter:    limiter,
+			Limits:     limits,
 
-			config := &tls.Config{
-				Certificates: []tls.Certificate{cer},
+			TCPListener: activated.TCP,
+			UDPConn:     activated.UDP,
+
+			CommunityIDSeed: uint16(cnf.CommunityIDSeed),
+			Sensor:          &tcppc.SensorInfo{Name: cnf.Sensor, Tags: cnf.sensorTags()},
+			TCPListenerName: cnf.TCPListenerName,
+			UDPListenerName: cnf.UDPListenerName,
+		}
+
+		if !cnf.DisableTCPServer {
+			log.Printf("Server Mode: %s\n", strings.ToUpper(tcppcMode))
+
+			switch tcppcMode {
+			case "tcp":
+				// Nothing to do.
+
+			case "tls":
+				log.Printf("Certificate: %s, Key: %s\n", cnf.X509Cert, cnf.X509Key)
+
+				cer, err := tls.LoadX509KeyPair(cnf.X509Cert, cnf.X509Key)
+				if err != nil {
+					log.Fatalf("Failed to load X509 key pair: %s\n", err)
+				}
+
+				opts.TLSConfig = &tls.Config{
+					Certificates: []tls.Certificate{cer},
+				}
+			default:
+				log.Fatalf("Unknown mode of tcppc: %s\n", tcppcMode)
 			}
+		}
+
+		server = tcppc.NewServer(opts)
+		service = server
+	}
+
+	// Bind listeners first, and serve only after privileges are dropped and
+	// the sandbox is entered, so that no connection (i.e. hostile input) is
+	// handled as root or out of the sandbox.
+	if err := service.Listen(); err != nil {
+		log.Fatalf("Failed to start server: %s\n", err)
+	}
 
-			go tcppc.StartTLSServer(*host, *port, config, writer, *timeout)
-		default:
-			log.Fatalf("Unknown mode of tcppc: %s\n", tcppcMode)
+	// Drop root privileges after listeners are bound and the rlimit is
+	// raised.
+	if cred != nil {
+		if err := dropPrivileges(cred, cnf.KeepCapNetAdmin); err != nil {
+			log.Fatalf("Failed to drop privileges: %s\n", err)
 		}
+
+		log.Printf("Dropped privileges: user: %s (%d), group: %s (%d), CAP_NET_ADMIN: %t\n", cred.UserName, cred.Uid, cred.GroupName, cred.Gid, cnf.KeepCapNetAdmin)
 	}
 
-	// Wait for TCP/TLS server to start, then start UDP server.
-	if !*disableUdpServer {
-		time.Sleep(100 * time.Millisecond)
-		go tcppc.StartUDPServer(*host, *port, writer)
+	// Sandbox the process once startup is finished (before serving). Only
+	// the output directory of session files, the spool directory and the
+	// configuration file can be accessed.
+	if cnf.Sandbox {
+		paths := &SandboxPaths{}
+		if cnf.FileNameFmt != "" {
+			paths.WritableDirs = append(paths.WritableDirs, tcppc.BaseDir(cnf.FileNameFmt))
+		}
+		if cnf.ZeekFileFmt != "" {
+			paths.WritableDirs = append(paths.WritableDirs, tcppc.BaseDir(cnf.ZeekFileFmt))
+		}
+		if cnf.SQLiteFileFmt != "" {
+			paths.WritableDirs = append(paths.WritableDirs, tcppc.BaseDir(cnf.SQLiteFileFmt))
+		}
+		if cnf.ESURL != "" && cnf.ESDeadLetterFile != "" {
+			paths.WritableDirs = append(paths.WritableDirs, filepath.Dir(cnf.ESDeadLetterFile))
+		}
+		if cnf.SpoolDir != "" {
+			paths.WritableDirs = append(paths.WritableDirs, cnf.SpoolDir)
+		}
+		if cnf.ForwardAddr != "" {
+			paths.WritableDirs = append(paths.WritableDirs, cnf.ForwardBufferDir)
+		}
+		if cnf.S3Endpoint != "" && cnf.S3StateFile != "" {
+			paths.WritableDirs = append(paths.WritableDirs, filepath.Dir(cnf.S3StateFile))
+		}
+		// Local sockets of syslog (unix and journald) are not restricted by
+		// Landlock, and socket(2) and connect(2) are always allowed.
+		if cnf.ESURL != "" || cnf.S3Endpoint != "" || cnf.ForwardAddr != "" || syslogNetwork == tcppc.SyslogUDP || syslogNetwork == tcppc.SyslogTCP || syslogNetwork == tcppc.SyslogTLS {
+			paths.allowNetworkClient()
+		}
+		if loader.fileName != "" {
+			paths.ReadableFiles = append(paths.ReadableFiles, loader.fileName)
+		}
+
+		if err := enterSandbox(paths); err != nil {
+			log.Fatalf("Failed to enter sandbox: %s\n", err)
+		}
+
+		log.Printf("Entered sandbox: writable directories: %v, readable files: %v\n", paths.WritableDirs, paths.ReadableFiles)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- service.Serve(ctx)
+	}()
+
+	// Wait for all servers to start.
+	select {
+	case <-service.Ready():
+	case err := <-errc:
+		log.Fatalf("Failed to start server: %s\n", err)
 	}
 
+	// All servers are accepting connections.
+	notifier.Notify("READY=1")
+
+	go notifier.Watchdog(func() bool {
+		return service.Healthy() && (writer == nil || writer.Healthy()) && (zeek == nil || zeek.Healthy()) && (db == nil || db.Healthy())
+	}, ctx.Done())
+
 	// Wait for SIGNAL.
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 	select {
 	case <-sigc:
-		log.Printf("Exit.")
+		notifier.Notify("STOPPING=1")
+		cancel()
+		if err := <-errc; err != nil {
+			log.Printf("Server stopped: %s\n", err)
+		}
+	case err := <-errc:
+		log.Fatalf("Server stopped: %s\n", err)
+	}
+
+	if server != nil {
+		stats := server.Stats()
+		log.Printf("Sessions: %d, Datagrams: %d, Rejected: %d (not recorded: %d), Accept errors: %d\n", stats.Sessions, stats.Datagrams, stats.Rejected, stats.RejectedDropped, stats.AcceptErrors)
+	}
+	if collector != nil {
+		cstats := collector.Stats()
+		log.Printf("Collector: Connections: %d, Batches: %d, Records: %d, Duplicates: %d, Errors: %d\n", cstats.Connections, cstats.Batches, cstats.Records, cstats.Duplicates, cstats.Errors)
+	}
+
+	// Write all queued sessions before exit.
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Failed to close sink: %s: %s\n", sink.Name(), err)
+		}
+	}
+
+	if writer != nil {
+		wstats := writer.Stats()
+		log.Printf("Written: %d, Dropped: %d, Spooled: %d, Lost: %d, Write errors: %d, Hook errors: %d\n", wstats.Written, wstats.Dropped, wstats.Spooled, wstats.Lost, wstats.Errors, wstats.HookErrors)
+	}
+	if db != nil {
+		dstats := db.Stats()
+		log.Printf("SQLite: Written: %d, Dropped: %d, Lost: %d, Errors: %d\n", dstats.Written, dstats.Dropped, dstats.Lost, dstats.Errors)
+	}
+	// Upload files finalised on exit after all writers are closed.
+	if uploader != nil {
+		uploader.Close()
+
+		ustats := uploader.Stats()
+		log.Printf("S3: Uploaded: %d (%d bytes), Upload errors: %d, Skipped: %d, Pending: %d\n", ustats.Uploaded, ustats.Bytes, ustats.Errors, ustats.Skipped, ustats.Pending)
+	}
+	if es != nil {
+		estats := es.Stats()
+		log.Printf("Elasticsearch: Indexed: %d, Dropped: %d, Retried: %d, Failed: %d, Lost: %d\n", estats.Indexed, estats.Dropped, estats.Retried, estats.Failed, estats.Lost)
+	}
+	if syslog != nil {
+		sstats := syslog.Stats()
+		log.Printf("Syslog: Sent: %d, Dropped: %d, Lost: %d, Truncated: %d\n", sstats.Sent, sstats.Dropped, sstats.Lost, sstats.Truncated)
+	}
+	if forward != nil {
+		fstats := forward.Stats()
+		log.Printf("Forward: Forwarded: %d, Dropped: %d, Buffered: %d, Lost: %d, Errors: %d\n", fstats.Forwarded, fstats.Dropped, fstats.Buffered, fstats.Lost, fstats.Errors)
 	}
+	log.Printf("Exit.")
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Capability number of CAP_NET_ADMIN (see linux/capability.h).
+	capNetAdmin = 12
+	// Version 3 of capabilities (64-bit).
+	linuxCapabilityVersion3 = 0x20080522
+	// See linux/prctl.h.
+	prSetKeepCaps = 8
+)
+
+// Credential holds the user and groups which the process switches to.
+type Credential struct {
+	Uid    int
+	Gid    int
+	Groups []int
+	// Name of the user and the group (used in logs).
+	UserName  string
+	GroupName string
+}
+
+// lookupCredential resolves the user and the group by names or IDs.
+// If groupName is empty, the primary group of the user is used.
+func lookupCredential(userName, groupName string) (*Credential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if _, numErr := strconv.Atoi(userName); numErr != nil {
+			return nil, err
+		}
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Credential{UserName: u.Username}
+
+	if c.Uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, fmt.Errorf("Invalid uid: %s", u.Uid)
+	}
+
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if _, numErr := strconv.Atoi(groupName); numErr != nil {
+				return nil, err
+			}
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, err
+			}
+		}
+		gid = g.Gid
+		c.GroupName = g.Name
+	} else if g, err := user.LookupGroupId(gid); err == nil {
+		c.GroupName = g.Name
+	} else {
+		c.GroupName = gid
+	}
+
+	if c.Gid, err = strconv.Atoi(gid); err != nil {
+		return nil, fmt.Errorf("Invalid gid: %s", gid)
+	}
+
+	// Supplementary groups are kept only if the group is not overridden.
+	c.Groups = []int{c.Gid}
+	if groupName == "" {
+		if gids, err := u.GroupIds(); err == nil {
+			for _, s := range gids {
+				if id, err := strconv.Atoi(s); err == nil && id != c.Gid {
+					c.Groups = append(c.Groups, id)
+				}
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// isWritableBy returns true if the directory is writable by the credential
+// according to its owner and permission bits.
+func isWritableBy(info os.FileInfo, c *Credential) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	mode := info.Mode().Perm()
+
+	if int(st.Uid) == c.Uid {
+		return mode&0300 == 0300
+	}
+	for _, gid := range c.Groups {
+		if int(st.Gid) == gid {
+			return mode&0030 == 0030
+		}
+	}
+
+	return mode&0003 == 0003
+}
+
+// prepareOutputDir creates the output directory of the session files owned
+// by the credential if it does not exist, and checks that the credential
+// can create files in it.
+func prepareOutputDir(dirName string, c *Credential) error {
+	dirName, err := filepath.Abs(dirName)
+	if err != nil {
+		return err
+	}
+
+	// Find the nearest existing directory.
+	var missing []string
+	existing := dirName
+	for {
+		if _, err := os.Stat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append([]string{existing}, missing...)
+		existing = filepath.Dir(existing)
+	}
+
+	for _, d := range missing {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return err
+		}
+		if err := os.Chown(d, c.Uid, c.Gid); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(dirName)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dirName)
+	}
+	if !isWritableBy(info, c) {
+		return fmt.Errorf("%s is not writable by %s:%s (change its owner or permissions)", dirName, c.UserName, c.GroupName)
+	}
+
+	return nil
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// dropPrivileges switches the process to the credential. If keepNetAdmin
+// is true, CAP_NET_ADMIN is retained and all other capabilities are dropped.
+func dropPrivileges(c *Credential, keepNetAdmin bool) error {
+	if os.Getuid() != 0 {
+		return errors.New("Privileges can be dropped only by root.")
+	}
+
+	// Capabilities are cleared by setuid unless PR_SET_KEEPCAPS is set on
+	// all threads of the process.
+	if keepNetAdmin {
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0); errno != 0 {
+			return fmt.Errorf("Failed to set PR_SET_KEEPCAPS (a binary built with CGO_ENABLED=0 is required): %s", errno)
+		}
+	}
+
+	if err := syscall.Setgroups(c.Groups); err != nil {
+		return fmt.Errorf("Failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(c.Gid); err != nil {
+		return fmt.Errorf("Failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(c.Uid); err != nil {
+		return fmt.Errorf("Failed to set uid: %w", err)
+	}
+
+	if keepNetAdmin {
+		hdr := capHeader{version: linuxCapabilityVersion3}
+		data := [2]capData{}
+		data[0].effective = 1 << capNetAdmin
+		data[0].permitted = 1 << capNetAdmin
+
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("Failed to set capabilities: %s", errno)
+		}
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetKeepCaps, 0, 0); errno != 0 {
+			return fmt.Errorf("Failed to clear PR_SET_KEEPCAPS: %s", errno)
+		}
+	}
+
+	// Make sure that root privileges can not be regained.
+	if err := syscall.Setuid(0); err == nil {
+		return errors.New("Privileges could be regained after dropping them.")
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/md-irohas/tcppc-go/tcppc"
+	"io"
+	"os"
+)
+
+// runReassembleCommand runs 'tcppc reassemble [options] [file ...]', which
+// reads session files written in the event-stream output mode and writes
+// sessions in the classic format (JSON lines) to stdout.
+func runReassembleCommand(args []string) int {
+	fs := flag.NewFlagSet("reassemble", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s reassemble [options] [file ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Read events from the files (or stdin) in order and write sessions to stdout.\n")
+		fs.PrintDefaults()
+	}
+	incomplete := fs.Bool("incomplete", true, "write sessions which have not ended at the end of input (marked as incomplete).")
+	fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	encoder := json.NewEncoder(out)
+	reassembler := tcppc.NewReassembler()
+
+	for _, file := range files {
+		if err := reassembleFile(file, reassembler, encoder); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to reassemble sessions: %s: %s\n", file, err)
+			return 1
+		}
+	}
+
+	if *incomplete {
+		for _, session := range reassembler.Pending() {
+			if err := encoder.Encode(session); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write session: %s\n", err)
+				return 1
+			}
+		}
+	}
+
+	return 0
+}
+
+// reassembleFile adds events in the file ("-": stdin) to the reassembler and
+// writes ended sessions.
+func reassembleFile(file string, reassembler *tcppc.Reassembler, encoder *json.Encoder) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	reader := tcppc.NewEventReader(r)
+
+	for {
+		event, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		session, err := reassembler.Add(event)
+		if err != nil {
+			return err
+		}
+		if session == nil {
+			continue
+		}
+
+		if err := encoder.Encode(session); err != nil {
+			return err
+		}
+	}
+}
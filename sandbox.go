@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// System calls of Landlock (same numbers in all architectures).
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	// Access rights of Landlock (see linux/landlock.h).
+	landlockAccessFsExecute    = 1 << 0
+	landlockAccessFsWriteFile  = 1 << 1
+	landlockAccessFsReadFile   = 1 << 2
+	landlockAccessFsReadDir    = 1 << 3
+	landlockAccessFsRemoveDir  = 1 << 4
+	landlockAccessFsRemoveFile = 1 << 5
+	landlockAccessFsMakeDir    = 1 << 7
+	landlockAccessFsMakeReg    = 1 << 8
+	landlockAccessFsRefer      = 1 << 13
+	landlockAccessFsTruncate   = 1 << 14
+
+	// O_PATH (missing in the syscall package).
+	oPath = 0x200000
+
+	// See linux/prctl.h.
+	prSetNoNewPrivs = 38
+
+	// See linux/seccomp.h and linux/filter.h.
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1 << 0
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+
+	bpfLd  = 0x00
+	bpfW   = 0x00
+	bpfAbs = 0x20
+	bpfJmp = 0x05
+	bpfJeq = 0x10
+	bpfK   = 0x00
+	bpfRet = 0x06
+
+	// Offsets in struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// SandboxPaths lists the paths which the sandboxed process can access.
+type SandboxPaths struct {
+	// Directories where files can be created, written and renamed.
+	WritableDirs []string
+	// Files which can be read.
+	ReadableFiles []string
+}
+
+type landlockRulesetAttr struct {
+	handledAccessFs uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// landlockAccessFs returns the access rights supported by the ABI version.
+func landlockAccessFs(abi int) uint64 {
+	// ABI v1 handles all rights up to LANDLOCK_ACCESS_FS_MAKE_SYM.
+	access := uint64(landlockAccessFsRefer - 1)
+	if abi >= 2 {
+		access |= landlockAccessFsRefer
+	}
+	if abi >= 3 {
+		access |= landlockAccessFsTruncate
+	}
+
+	return access
+}
+
+// restrictFilesystem restricts filesystem access of all threads to paths
+// with Landlock.
+func restrictFilesystem(paths *SandboxPaths) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("Landlock is not supported by the kernel: %s", errno)
+	}
+
+	handled := landlockAccessFs(int(abi))
+	attr := landlockRulesetAttr{handledAccessFs: handled}
+
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to create Landlock ruleset: %s", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	addRule := func(path string, access uint64) error {
+		f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		rule := landlockPathBeneathAttr{allowedAccess: access & handled, parentFd: int32(f.Fd())}
+		if _, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("Failed to add Landlock rule: %s: %s", path, errno)
+		}
+
+		return nil
+	}
+
+	dirAccess := uint64(landlockAccessFsWriteFile | landlockAccessFsReadFile | landlockAccessFsReadDir |
+		landlockAccessFsRemoveDir | landlockAccessFsRemoveFile | landlockAccessFsMakeDir |
+		landlockAccessFsMakeReg | landlockAccessFsRefer | landlockAccessFsTruncate)
+
+	for _, dir := range paths.WritableDirs {
+		if err := addRule(dir, dirAccess); err != nil {
+			return err
+		}
+	}
+	for _, file := range paths.ReadableFiles {
+		if err := addRule(file, landlockAccessFsReadFile); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("Failed to restrict the process with Landlock: %s", errno)
+	}
+
+	return nil
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// buildSeccompFilter returns a BPF program which allows only syscalls.
+// Other syscalls fail with EPERM, and syscalls of other architectures kill
+// the process.
+func buildSeccompFilter(syscalls []uintptr) []sockFilter {
+	prog := []sockFilter{
+		{bpfLd | bpfW | bpfAbs, 0, 0, seccompDataArch},
+		{bpfJmp | bpfJeq | bpfK, 1, 0, auditArch},
+		{bpfRet | bpfK, 0, 0, seccompRetKillProcess},
+		{bpfLd | bpfW | bpfAbs, 0, 0, seccompDataNr},
+	}
+
+	for i, nr := range syscalls {
+		// Jump to the final ALLOW if matched.
+		prog = append(prog, sockFilter{bpfJmp | bpfJeq | bpfK, uint8(len(syscalls) - i), 0, uint32(nr)})
+	}
+
+	prog = append(prog,
+		sockFilter{bpfRet | bpfK, 0, 0, seccompRetErrno | uint32(syscall.EPERM)},
+		sockFilter{bpfRet | bpfK, 0, 0, seccompRetAllow},
+	)
+
+	return prog
+}
+
+// restrictSyscalls installs a seccomp filter of the syscall allow-list to
+// all threads.
+func restrictSyscalls() error {
+	if len(sandboxSyscalls) == 0 {
+		return errors.New("seccomp filter is not supported in this architecture.")
+	}
+	if len(sandboxSyscalls) > 255 {
+		return errors.New("Too many syscalls in the allow-list.")
+	}
+
+	filter := buildSeccompFilter(sandboxSyscalls)
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+
+	if _, _, errno := syscall.Syscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("Failed to install seccomp filter: %s", errno)
+	}
+
+	return nil
+}
+
+// Files read by the resolver of Go to connect to servers by name.
+var resolverFiles = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf"}
+
+// allowNetworkClient allows the sandboxed process to connect to servers
+// (e.g. Elasticsearch): files of the resolver which exist become readable,
+// and system root certificates are loaded in advance because they can not
+// be read in the sandbox.
+func (paths *SandboxPaths) allowNetworkClient() {
+	for _, file := range resolverFiles {
+		if _, err := os.Stat(file); err == nil {
+			paths.ReadableFiles = append(paths.ReadableFiles, file)
+		}
+	}
+
+	if _, err := x509.SystemCertPool(); err != nil {
+		log.Printf("Failed to load system root certificates: %s\n", err)
+	}
+}
+
+// enterSandbox restricts filesystem access and syscalls of the process.
+// It fails if the kernel lacks support of Landlock or seccomp, so that the
+// process does not run without the sandbox which is requested.
+func enterSandbox(paths *SandboxPaths) error {
+	for i, dir := range paths.WritableDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		paths.WritableDirs[i] = abs
+	}
+
+	// Required to install seccomp filters and Landlock rulesets without
+	// CAP_SYS_ADMIN.
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("Failed to set PR_SET_NO_NEW_PRIVS (a binary built with CGO_ENABLED=0 is required): %s", errno)
+	}
+
+	if err := restrictFilesystem(paths); err != nil {
+		return err
+	}
+
+	return restrictSyscalls()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"syscall"
+)
+
+const (
+	// AUDIT_ARCH_X86_64 (see linux/audit.h).
+	auditArch = 0xc000003e
+
+	// System calls missing in the syscall package.
+	sysSeccomp   = 317
+	sysGetrandom = 318
+	sysRenameat2 = 316
+	sysStatx     = 332
+	sysRseq      = 334
+)
+
+// System calls allowed in the sandbox.
+var sandboxSyscalls = append(commonSandboxSyscalls,
+	syscall.SYS_OPEN,
+	syscall.SYS_STAT,
+	syscall.SYS_LSTAT,
+	syscall.SYS_MKDIR,
+	syscall.SYS_RENAME,
+	syscall.SYS_UNLINK,
+	syscall.SYS_LCHOWN,
+	syscall.SYS_EPOLL_WAIT,
+	syscall.SYS_EPOLL_CREATE,
+	syscall.SYS_POLL,
+	syscall.SYS_PIPE,
+	syscall.SYS_ARCH_PRCTL,
+	syscall.SYS_TIME,
+	syscall.SYS_GETRLIMIT,
+	syscall.SYS_NEWFSTATAT,
+	syscall.SYS_ACCESS,
+	syscall.SYS_READLINK,
+	sysSeccomp,
+	sysGetrandom,
+	sysRenameat2,
+	sysStatx,
+	sysRseq,
+)
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"syscall"
+)
+
+const (
+	// AUDIT_ARCH_AARCH64 (see linux/audit.h).
+	auditArch = 0xc00000b7
+
+	sysSeccomp = syscall.SYS_SECCOMP
+
+	// System calls missing in the syscall package.
+	sysStatx = 291
+	sysRseq  = 293
+)
+
+// System calls allowed in the sandbox.
+var sandboxSyscalls = append(commonSandboxSyscalls,
+	syscall.SYS_FSTATAT,
+	syscall.SYS_GETRANDOM,
+	syscall.SYS_RENAMEAT2,
+	sysStatx,
+	sysRseq,
+)
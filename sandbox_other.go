@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+
+package main
+
+const (
+	auditArch  = 0
+	sysSeccomp = 0
+)
+
+// seccomp filter is not supported in other architectures.
+var sandboxSyscalls []uintptr
@@ -0,0 +1,91 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"syscall"
+)
+
+// System calls allowed in the sandbox in all architectures.
+// These are used by the Go runtime, the network poller and session writers.
+var commonSandboxSyscalls = []uintptr{
+	// Memory and threads.
+	syscall.SYS_MMAP,
+	syscall.SYS_MUNMAP,
+	syscall.SYS_MPROTECT,
+	syscall.SYS_MADVISE,
+	syscall.SYS_MREMAP,
+	syscall.SYS_BRK,
+	syscall.SYS_CLONE,
+	syscall.SYS_FUTEX,
+	syscall.SYS_SET_ROBUST_LIST,
+	syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY,
+	syscall.SYS_EXIT,
+	syscall.SYS_EXIT_GROUP,
+	syscall.SYS_GETPID,
+	syscall.SYS_GETTID,
+	syscall.SYS_TGKILL,
+	syscall.SYS_TKILL,
+	syscall.SYS_RT_SIGACTION,
+	syscall.SYS_RT_SIGPROCMASK,
+	syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK,
+	syscall.SYS_NANOSLEEP,
+	syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_NANOSLEEP,
+	syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_RESTART_SYSCALL,
+	syscall.SYS_UNAME,
+	syscall.SYS_PRLIMIT64,
+	syscall.SYS_GETUID,
+	syscall.SYS_GETEUID,
+	syscall.SYS_GETGID,
+	syscall.SYS_GETEGID,
+
+	// Files.
+	syscall.SYS_READ,
+	syscall.SYS_WRITE,
+	syscall.SYS_READV,
+	syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64,
+	syscall.SYS_PWRITE64,
+	syscall.SYS_CLOSE,
+	syscall.SYS_OPENAT,
+	syscall.SYS_FSTAT,
+	syscall.SYS_LSEEK,
+	syscall.SYS_FCNTL,
+	syscall.SYS_FSYNC,
+	syscall.SYS_FDATASYNC,
+	syscall.SYS_FTRUNCATE,
+	syscall.SYS_GETDENTS64,
+	syscall.SYS_MKDIRAT,
+	syscall.SYS_RENAMEAT,
+	syscall.SYS_UNLINKAT,
+	syscall.SYS_FCHOWNAT,
+	syscall.SYS_FCHOWN,
+	syscall.SYS_FCHMOD,
+	syscall.SYS_FACCESSAT,
+	syscall.SYS_READLINKAT,
+	syscall.SYS_PIPE2,
+	syscall.SYS_DUP3,
+
+	// Network.
+	syscall.SYS_EPOLL_CREATE1,
+	syscall.SYS_EPOLL_CTL,
+	syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_EVENTFD2,
+	syscall.SYS_PPOLL,
+	syscall.SYS_ACCEPT4,
+	syscall.SYS_SOCKET,
+	syscall.SYS_CONNECT,
+	syscall.SYS_SHUTDOWN,
+	syscall.SYS_RECVFROM,
+	syscall.SYS_RECVMSG,
+	syscall.SYS_SENDTO,
+	syscall.SYS_SENDMSG,
+	syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SETSOCKOPT,
+	syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME,
+}
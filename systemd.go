@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// First file descriptor passed by systemd socket activation.
+	listenFdsStart = 3
+)
+
+// ActivatedListeners holds listeners passed by systemd socket activation.
+type ActivatedListeners struct {
+	TCP *net.TCPListener
+	UDP *net.UDPConn
+}
+
+// activatedListeners returns listeners passed by systemd (LISTEN_FDS) whose
+// names (FileDescriptorName=) match tcpName and udpName. It returns empty
+// listeners if the process is not socket-activated.
+func activatedListeners(tcpName, udpName string) (*ActivatedListeners, error) {
+	ls := &ActivatedListeners{}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return ls, nil
+	}
+
+	numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFds == 0 {
+		return ls, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Listeners must not be inherited by child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < numFds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+
+		switch name {
+		case tcpName:
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid socket %s (fd: %d): %w", name, fd, err)
+			}
+			tcpLn, ok := ln.(*net.TCPListener)
+			if !ok {
+				ln.Close()
+				return nil, fmt.Errorf("Socket %s (fd: %d) is not a TCP listener.", name, fd)
+			}
+			ls.TCP = tcpLn
+
+		case udpName:
+			conn, err := net.FilePacketConn(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid socket %s (fd: %d): %w", name, fd, err)
+			}
+			udpConn, ok := conn.(*net.UDPConn)
+			if !ok {
+				conn.Close()
+				return nil, fmt.Errorf("Socket %s (fd: %d) is not a UDP socket.", name, fd)
+			}
+			ls.UDP = udpConn
+
+		default:
+			log.Printf("Ignore unknown socket passed by systemd: %s (fd: %d)\n", name, fd)
+			f.Close()
+		}
+	}
+
+	return ls, nil
+}
+
+// Notifier sends notifications of the service state to systemd
+// (sd_notify). All methods of a nil Notifier do nothing.
+type Notifier struct {
+	conn *net.UnixConn
+}
+
+// newNotifier connects to NOTIFY_SOCKET. It returns nil if the process is
+// not run by systemd with Type=notify.
+func newNotifier() (*Notifier, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil, nil
+	}
+
+	// Abstract socket.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to NOTIFY_SOCKET: %w", err)
+	}
+
+	return &Notifier{conn: conn}, nil
+}
+
+// Notify sends the state (e.g. "READY=1") to systemd.
+func (n *Notifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+
+	_, err := n.conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval to send WATCHDOG=1 (half of
+// WatchdogSec=), or 0 if the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if s := os.Getenv("WATCHDOG_PID"); s != "" {
+		if pid, err := strconv.Atoi(s); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// Watchdog sends WATCHDOG=1 periodically while healthy returns true, until
+// done is closed. When healthy returns false, the notification is skipped
+// so that systemd restarts the service after WatchdogSec=.
+func (n *Notifier) Watchdog(healthy func() bool, done <-chan struct{}) {
+	if n == nil {
+		return
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	log.Printf("Watchdog: every %s\n", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !healthy() {
+				log.Printf("Watchdog: unhealthy; skip notification.\n")
+				continue
+			}
+			if err := n.Notify("WATCHDOG=1"); err != nil {
+				log.Printf("Watchdog: failed to notify: %s\n", err)
+			}
+		}
+	}
+}
+
+// Close closes the connection to systemd.
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+
+	return n.conn.Close()
+}
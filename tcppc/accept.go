@@ -0,0 +1,104 @@
+package tcppc
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Initial and maximum delay to retry accepting connections.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+
+	// Accept loops are unhealthy if accepting connections keeps failing for
+	// this duration.
+	unhealthyAcceptDuration = 30 * time.Second
+)
+
+// isTemporaryAcceptError returns true if accepting connections may succeed
+// later, e.g. when file descriptors are exhausted during a scan burst.
+func isTemporaryAcceptError(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+			syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR,
+			syscall.EAGAIN, syscall.EPROTO, syscall.EPERM:
+			return true
+		}
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+// acceptBackoff retries accepting connections with exponential backoff.
+type acceptBackoff struct {
+	// Server name used in logs (e.g. TCP).
+	name string
+	// Current delay (0 if the last accept succeeded).
+	delay time.Duration
+	// Counter of accept errors.
+	errors *SessionCounter
+	// Time when accepting connections started failing (zero if the last
+	// accept succeeded).
+	failingSince time.Time
+	// Mutex object for exclusive control of failingSince.
+	mutex sync.Mutex
+}
+
+// retry counts err and sleeps if err is temporary.
+// It returns err if the accept loop should stop.
+func (b *acceptBackoff) retry(err error) error {
+	b.errors.inc()
+
+	if !isTemporaryAcceptError(err) {
+		log.Printf("%s: Failed to accept a new connection: %s (#Errors: %d)\n", b.name, err, b.errors.count())
+		return err
+	}
+
+	b.mutex.Lock()
+	if b.failingSince.IsZero() {
+		b.failingSince = time.Now()
+	}
+	b.mutex.Unlock()
+
+	if b.delay == 0 {
+		b.delay = minAcceptDelay
+	} else if b.delay *= 2; b.delay > maxAcceptDelay {
+		b.delay = maxAcceptDelay
+	}
+
+	log.Printf("%s: Failed to accept a new connection: %s; retrying in %s (#Errors: %d)\n", b.name, err, b.delay, b.errors.count())
+	time.Sleep(b.delay)
+
+	return nil
+}
+
+// reset resets the delay after a successful accept.
+func (b *acceptBackoff) reset() {
+	if b.delay == 0 {
+		return
+	}
+
+	b.delay = 0
+
+	b.mutex.Lock()
+	b.failingSince = time.Time{}
+	b.mutex.Unlock()
+}
+
+// healthy returns false if accepting connections keeps failing.
+func (b *acceptBackoff) healthy() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.failingSince.IsZero() || time.Since(b.failingSince) < unhealthyAcceptDuration
+}
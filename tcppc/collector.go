@@ -0,0 +1,506 @@
+package tcppc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Default duration for which IDs of records are remembered to drop
+	// duplicates.
+	DefaultCollectorDedupWindow = time.Hour
+
+	// Connections from sensors are closed if no batch is received for this
+	// duration.
+	collectorIdleTimeout = 10 * time.Minute
+	// Timeout of TLS handshakes.
+	collectorHandshakeTimeout = 30 * time.Second
+	// Maximum size of a batch (a line of JSON).
+	collectorMaxBatchSize = 64 * 1024 * 1024
+)
+
+// NewMTLSConfig returns a TLS configuration of mutual authentication between
+// sensors and the collector. Both of them present the certificate and verify
+// the peer's certificate with the CA.
+func NewMTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load X509 key pair: %w", err)
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificate found in CA file: %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// CollectorOptions configures Collector.
+type CollectorOptions struct {
+	// Address to listen on.
+	Host string
+	Port int
+	// Pre-opened listener (e.g. passed by systemd). If set, Host and Port
+	// are ignored.
+	Listener net.Listener
+	// TLS configuration with the certificate of the collector and the CA of
+	// sensors (see NewMTLSConfig).
+	TLSConfig *tls.Config
+	// Destinations of received records.
+	Sinks []Sink
+	// Duration for which IDs of records are remembered to drop duplicates
+	// (0: DefaultCollectorDedupWindow).
+	DedupWindow time.Duration
+}
+
+// CollectorStats holds statistics of Collector.
+type CollectorStats struct {
+	// Number of connections from sensors.
+	Connections uint
+	// Number of batches and records received.
+	Batches uint
+	Records uint
+	// Number of records dropped as duplicates.
+	Duplicates uint
+	// Number of errors of connections, batches and records.
+	Errors uint
+}
+
+// dedupCache remembers keys for at least window (and at most twice the
+// window) with two generations of sets.
+type dedupCache struct {
+	window    time.Duration
+	current   map[string]struct{}
+	previous  map[string]struct{}
+	rotatedAt time.Time
+	mutex     sync.Mutex
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window:    window,
+		current:   make(map[string]struct{}),
+		previous:  make(map[string]struct{}),
+		rotatedAt: time.Now(),
+	}
+}
+
+func (c *dedupCache) rotate() {
+	if time.Since(c.rotatedAt) < c.window {
+		return
+	}
+
+	c.previous = c.current
+	c.current = make(map[string]struct{})
+	c.rotatedAt = time.Now()
+}
+
+// add adds the key, and returns false if it has been added.
+func (c *dedupCache) add(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.rotate()
+
+	if _, ok := c.current[key]; ok {
+		return false
+	}
+	if _, ok := c.previous[key]; ok {
+		return false
+	}
+	c.current[key] = struct{}{}
+
+	return true
+}
+
+func (c *dedupCache) remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.current, key)
+	delete(c.previous, key)
+}
+
+// Collector receives sessions and events from sensors (see ForwardSink)
+// over mutually-authenticated TLS and writes them to sinks.
+//
+// Sensors send batches of records as lines of JSON, and the collector
+// acknowledges each batch after its records are accepted by all sinks. Sinks
+// with queues (e.g. RotWriter and SQLiteSink) accept records when they are
+// queued, so acknowledged records may be lost if the collector crashes
+// before the sinks flush them. Records are identified by session IDs (and the types and indices of
+// events), and those received within DedupWindow are dropped as duplicates,
+// because sensors send batches again when acknowledgements are lost.
+type Collector struct {
+	opts CollectorOptions
+	ln   net.Listener
+	// IDs of records written to each sink (in the order of Sinks), so that
+	// records sent again are written only to sinks which failed.
+	dedup []*dedupCache
+	// Closed when Serve starts accepting connections.
+	ready chan struct{}
+	// Active connections and their handlers.
+	conns    map[net.Conn]struct{}
+	handlers sync.WaitGroup
+	closing  bool
+	backoff  *acceptBackoff
+	mutex    sync.Mutex
+	// Statistics.
+	connections *SessionCounter
+	batches     *SessionCounter
+	records     *SessionCounter
+	duplicates  *SessionCounter
+	errors      *SessionCounter
+}
+
+func NewCollector(opts CollectorOptions) *Collector {
+	if opts.DedupWindow <= 0 {
+		opts.DedupWindow = DefaultCollectorDedupWindow
+	}
+
+	dedup := make([]*dedupCache, len(opts.Sinks))
+	for i := range dedup {
+		dedup[i] = newDedupCache(opts.DedupWindow)
+	}
+
+	c := &Collector{
+		opts:        opts,
+		dedup:       dedup,
+		ready:       make(chan struct{}),
+		conns:       make(map[net.Conn]struct{}),
+		connections: NewSessionCounter(),
+		batches:     NewSessionCounter(),
+		records:     NewSessionCounter(),
+		duplicates:  NewSessionCounter(),
+		errors:      NewSessionCounter(),
+	}
+	c.backoff = &acceptBackoff{name: "Collector", errors: c.errors}
+
+	return c
+}
+
+// Ready returns a channel which is closed when the listener is bound and
+// Serve starts accepting connections.
+func (c *Collector) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Listen binds the listener (or takes the pre-opened one) without accepting
+// connections, so that privileges can be dropped and the process can be
+// sandboxed before any connection is handled. Serve calls it if it is not
+// called beforehand. Listen must not be called concurrently with Serve.
+func (c *Collector) Listen() error {
+	if c.ln != nil {
+		return nil
+	}
+
+	if c.opts.TLSConfig == nil {
+		return errors.New("TLS configuration of the collector is not given.")
+	}
+
+	if c.opts.Listener != nil {
+		log.Printf("Listen: %s (collector, pre-opened)\n", c.opts.Listener.Addr())
+		c.ln = c.opts.Listener
+	} else {
+		addr := net.JoinHostPort(c.opts.Host, strconv.Itoa(c.opts.Port))
+		log.Printf("Listen: %s (collector)\n", addr)
+
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen TCP socket: %w", err)
+		}
+		c.ln = ln
+	}
+
+	return nil
+}
+
+// Serve binds the listener (unless Listen is called), accepts connections
+// from sensors until ctx is canceled, and waits for all handlers to finish.
+func (c *Collector) Serve(ctx context.Context) error {
+	if err := c.Listen(); err != nil {
+		return err
+	}
+
+	close(c.ready)
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.accept() }()
+
+	var err error
+
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+	}
+
+	c.shutdown()
+	if err == nil {
+		err = <-errc
+	}
+	c.handlers.Wait()
+
+	log.Printf("Collector stopped.\n")
+
+	return err
+}
+
+func (c *Collector) accept() error {
+	log.Printf("Start collector.\n")
+
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			if c.isClosing() {
+				return nil
+			}
+			if err := c.backoff.retry(err); err != nil {
+				return err
+			}
+			continue
+		}
+		c.backoff.reset()
+
+		tlsConn := tls.Server(conn, c.opts.TLSConfig)
+		if !c.trackConn(tlsConn) {
+			tlsConn.Close()
+			return nil
+		}
+
+		go func() {
+			defer c.untrackConn(tlsConn)
+			c.handle(tlsConn)
+		}()
+	}
+}
+
+func (c *Collector) isClosing() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.closing
+}
+
+func (c *Collector) shutdown() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closing = true
+	c.ln.Close()
+
+	for conn := range c.conns {
+		conn.SetDeadline(time.Now())
+	}
+}
+
+func (c *Collector) trackConn(conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return false
+	}
+
+	c.conns[conn] = struct{}{}
+	c.handlers.Add(1)
+
+	return true
+}
+
+func (c *Collector) untrackConn(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.conns, conn)
+	c.handlers.Done()
+}
+
+// handle receives batches from a sensor and acknowledges them.
+func (c *Collector) handle(conn *tls.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(collectorHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		c.errors.inc()
+		log.Printf("Collector: TLS handshake failed: %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	// Sensors are identified by the common names of their certificates.
+	peer := conn.RemoteAddr().String()
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		peer = fmt.Sprintf("%s (%s)", certs[0].Subject.CommonName, peer)
+	}
+
+	c.connections.inc()
+	log.Printf("Collector: connected: %s\n", peer)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), collectorMaxBatchSize)
+
+	for !c.isClosing() {
+		conn.SetDeadline(time.Now().Add(collectorIdleTimeout))
+
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil && !c.isClosing() {
+				c.errors.inc()
+				log.Printf("Collector: failed to receive batch: %s: %s\n", peer, err)
+			}
+			break
+		}
+
+		var batch forwardBatch
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			c.errors.inc()
+			log.Printf("Collector: invalid batch: %s: %s\n", peer, err)
+			break
+		}
+
+		ack := forwardAck{Seq: batch.Seq}
+		if err := c.write(peer, &batch); err != nil {
+			ack.Error = err.Error()
+		}
+
+		line, _ := json.Marshal(ack)
+		if _, err := conn.Write(append(line, '\n')); err != nil {
+			c.errors.inc()
+			log.Printf("Collector: failed to send acknowledgement: %s: %s\n", peer, err)
+			break
+		}
+	}
+
+	log.Printf("Collector: disconnected: %s\n", peer)
+}
+
+// write writes records of the batch which are not duplicates to the sinks.
+// It returns an error if any record is not accepted by all sinks.
+func (c *Collector) write(peer string, batch *forwardBatch) error {
+	c.batches.inc()
+
+	var numWritten, numDuplicates, numErrors int
+	var lastErr error
+
+	for _, data := range batch.Records {
+		c.records.inc()
+
+		var record forwardRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			// Invalid records are not sent again.
+			c.errors.inc()
+			log.Printf("Collector: invalid record: %s: %s\n", peer, err)
+			continue
+		}
+
+		// Records without session IDs (e.g. sent by old sensors) are not
+		// deduplicated (empty key), since they can not be told apart.
+		var key string
+		switch {
+		case record.Session != nil:
+			key = record.Session.ID
+		case record.Event != nil:
+			if record.Event.SessionID != "" {
+				key = record.Event.SessionID + "-" + record.Event.Type
+				if record.Event.Payload != nil {
+					key += "-" + strconv.FormatUint(uint64(record.Event.Payload.Index), 10)
+				}
+			}
+		default:
+			c.errors.inc()
+			log.Printf("Collector: empty record: %s\n", peer)
+			continue
+		}
+
+		ok, duplicate := true, true
+		for i, sink := range c.opts.Sinks {
+			// Records are written only to sinks which have not accepted
+			// them, so that a failure of a sink does not duplicate them in
+			// the others when they are sent again.
+			if key != "" && !c.dedup[i].add(key) {
+				continue
+			}
+			duplicate = false
+
+			var err error
+			if record.Session != nil {
+				err = sink.WriteSession(record.Session)
+			} else {
+				err = sink.WriteEvent(record.Event)
+			}
+			if err != nil {
+				// Records which failed are accepted by the sink when they
+				// are sent again.
+				if key != "" {
+					c.dedup[i].remove(key)
+				}
+				lastErr = fmt.Errorf("%s: %w", sink.Name(), err)
+				ok = false
+			}
+		}
+
+		if duplicate && len(c.opts.Sinks) > 0 {
+			c.duplicates.inc()
+			numDuplicates += 1
+			continue
+		}
+		if !ok {
+			c.errors.inc()
+			numErrors += 1
+			continue
+		}
+
+		numWritten += 1
+	}
+
+	log.Printf("Collector: received batch: %s: seq: %d, written: %d, duplicates: %d, errors: %d\n", peer, batch.Seq, numWritten, numDuplicates, numErrors)
+
+	if numErrors > 0 {
+		return fmt.Errorf("%d records failed to be written (%s)", numErrors, lastErr)
+	}
+
+	return nil
+}
+
+// Healthy returns false if the collector is not serving or accepting
+// connections keeps failing.
+func (c *Collector) Healthy() bool {
+	select {
+	case <-c.ready:
+	default:
+		return false
+	}
+
+	return !c.isClosing() && c.backoff.healthy()
+}
+
+// Stats returns the current statistics of the collector.
+func (c *Collector) Stats() CollectorStats {
+	return CollectorStats{
+		Connections: c.connections.count(),
+		Batches:     c.batches.count(),
+		Records:     c.records.count(),
+		Duplicates:  c.duplicates.count(),
+		Errors:      c.errors.count(),
+	}
+}
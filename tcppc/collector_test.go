@@ -0,0 +1,316 @@
+package tcppc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingSink is memSink which fails to write while fail is set.
+type failingSink struct {
+	memSink
+	fail bool
+}
+
+func (s *failingSink) WriteSession(session *Session) error {
+	if s.fail {
+		return errors.New("failed")
+	}
+	return s.memSink.WriteSession(session)
+}
+
+func newTestBatch(t *testing.T, seq uint64, sessions ...*Session) *forwardBatch {
+	t.Helper()
+
+	batch := &forwardBatch{Seq: seq}
+	for _, session := range sessions {
+		data, err := json.Marshal(forwardRecord{Session: session})
+		if err != nil {
+			t.Fatalf("Failed to encode the record: %s", err)
+		}
+		batch.Records = append(batch.Records, data)
+	}
+
+	return batch
+}
+
+func TestCollectorWriteDuplicates(t *testing.T) {
+	sink := &memSink{}
+	c := NewCollector(CollectorOptions{Sinks: []Sink{sink}})
+
+	session := newTestSession(23)
+	if err := c.write("test", newTestBatch(t, 1, session, session)); err != nil {
+		t.Fatalf("Failed to write the batch: %s", err)
+	}
+	if err := c.write("test", newTestBatch(t, 2, session)); err != nil {
+		t.Fatalf("Failed to write the batch: %s", err)
+	}
+
+	if got := len(sink.sessions); got != 1 {
+		t.Errorf("Sessions = %d, want 1", got)
+	}
+	if got := c.Stats().Duplicates; got != 2 {
+		t.Errorf("Duplicates = %d, want 2", got)
+	}
+
+	// Records without IDs are never dropped.
+	session = newTestSession(80)
+	session.ID = ""
+	if err := c.write("test", newTestBatch(t, 3, session, session)); err != nil {
+		t.Fatalf("Failed to write the batch: %s", err)
+	}
+	if got := len(sink.sessions); got != 3 {
+		t.Errorf("Sessions = %d, want 3", got)
+	}
+}
+
+func TestCollectorWritePartialFailure(t *testing.T) {
+	good := &memSink{}
+	bad := &failingSink{fail: true}
+	c := NewCollector(CollectorOptions{Sinks: []Sink{good, bad}})
+
+	batch := newTestBatch(t, 1, newTestSession(23))
+	if err := c.write("test", batch); err == nil {
+		t.Fatal("Writing the batch succeeded, want an error")
+	}
+
+	// The batch sent again is written only to the sink which failed.
+	bad.fail = false
+	if err := c.write("test", batch); err != nil {
+		t.Fatalf("Failed to write the batch: %s", err)
+	}
+	if got := len(good.sessions); got != 1 {
+		t.Errorf("Sessions in the good sink = %d, want 1", got)
+	}
+	if got := len(bad.sessions); got != 1 {
+		t.Errorf("Sessions in the failed sink = %d, want 1", got)
+	}
+
+	// Then it is a duplicate in all sinks.
+	if err := c.write("test", batch); err != nil {
+		t.Fatalf("Failed to write the batch: %s", err)
+	}
+	if got := len(good.sessions) + len(bad.sessions); got != 2 {
+		t.Errorf("Sessions = %d, want 2", got)
+	}
+	if got := c.Stats().Duplicates; got != 1 {
+		t.Errorf("Duplicates = %d, want 1", got)
+	}
+}
+
+// sessionIDs returns IDs of sessions written to the sink in order.
+func (s *memSink) sessionIDs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var ids []string
+	for _, session := range s.sessions {
+		ids = append(ids, session.ID)
+	}
+	return ids
+}
+
+// newTestMTLSConfigs returns TLS configurations of the collector (on
+// 127.0.0.1) and a sensor signed by a new CA.
+func newTestMTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	dir := t.TempDir()
+	writePEM := func(name, blockType string, data []byte) string {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+		return fileName
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create the CA: %s", err)
+	}
+	caFile := writePEM("ca.crt", "CERTIFICATE", caDER)
+
+	newConfig := func(name string, serial int64) *tls.Config {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create the certificate: %s", err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatalf("Failed to encode the key: %s", err)
+		}
+
+		config, err := NewMTLSConfig(writePEM(name+".crt", "CERTIFICATE", der), writePEM(name+".key", "EC PRIVATE KEY", keyDER), caFile)
+		if err != nil {
+			t.Fatalf("Failed to load the configuration: %s", err)
+		}
+		return config
+	}
+
+	return newConfig("collector", 2), newConfig("sensor", 3)
+}
+
+// startCollector starts the collector on 127.0.0.1 with a random port, and
+// stops it at the end of the test.
+func startCollector(t *testing.T, config *tls.Config, sinks ...Sink) *Collector {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+
+	c := NewCollector(CollectorOptions{Listener: ln, TLSConfig: config, Sinks: sinks})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- c.Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("Collector failed: %s", err)
+		}
+	})
+
+	<-c.Ready()
+
+	return c
+}
+
+func TestForwardSinkCollector(t *testing.T) {
+	collectorConfig, sensorConfig := newTestMTLSConfigs(t)
+	sink := &memSink{}
+	c := startCollector(t, collectorConfig, sink)
+
+	f, err := NewForwardSink(ForwardOptions{
+		Addr:      c.ln.Addr().String(),
+		TLSConfig: sensorConfig,
+		BufferDir: t.TempDir(),
+		BatchSize: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the sink: %s", err)
+	}
+
+	var want []string
+	for i := 0; i < 3; i++ {
+		session := newTestSession(23 + i)
+		want = append(want, session.ID)
+		if err := f.WriteSession(session); err != nil {
+			t.Fatalf("Failed to write the session: %s", err)
+		}
+	}
+	if err := f.WriteEvent(NewSessionStartEvent(newTestSession(80))); err != nil {
+		t.Fatalf("Failed to write the event: %s", err)
+	}
+	// The rest of the batch is sent on Close.
+	f.Close()
+
+	if got := sink.sessionIDs(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Sessions = %v, want %v", got, want)
+	}
+	sink.mutex.Lock()
+	numEvents := len(sink.events)
+	sink.mutex.Unlock()
+	if numEvents != 1 {
+		t.Errorf("Events = %d, want 1", numEvents)
+	}
+
+	if stats := f.Stats(); stats.Forwarded != 4 || stats.Buffered != 0 || stats.Errors != 0 {
+		t.Errorf("Stats of the sensor = %+v, want 4 forwarded", stats)
+	}
+	if stats := c.Stats(); stats.Connections != 1 || stats.Batches != 2 || stats.Records != 4 {
+		t.Errorf("Stats of the collector = %+v, want 1 connection, 2 batches and 4 records", stats)
+	}
+}
+
+func TestForwardSinkBuffer(t *testing.T) {
+	collectorConfig, sensorConfig := newTestMTLSConfigs(t)
+	bufferDir := t.TempDir()
+
+	// Nothing listens on the address.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	f, err := NewForwardSink(ForwardOptions{Addr: addr, TLSConfig: sensorConfig, BufferDir: bufferDir, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("Failed to create the sink: %s", err)
+	}
+
+	var want []string
+	for i := 0; i < 12; i++ {
+		session := newTestSession(23 + i)
+		want = append(want, session.ID)
+		if err := f.WriteSession(session); err != nil {
+			t.Fatalf("Failed to write the session: %s", err)
+		}
+	}
+	f.Close()
+
+	if stats := f.Stats(); stats.Buffered != 12 || stats.Forwarded != 0 || stats.Errors == 0 {
+		t.Errorf("Stats = %+v, want 12 buffered", stats)
+	}
+
+	// Batches survive restarts and are sent in the order they are buffered
+	// (e.g. batch 10 after batch 9).
+	sink := &memSink{}
+	c := startCollector(t, collectorConfig, sink)
+
+	f, err = NewForwardSink(ForwardOptions{
+		Addr:          c.ln.Addr().String(),
+		TLSConfig:     sensorConfig,
+		BufferDir:     bufferDir,
+		FlushInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the sink: %s", err)
+	}
+
+	waitFor(t, 2*time.Second, "buffered batches are not sent", func() bool { return len(sink.sessionIDs()) == len(want) })
+	f.Close()
+
+	if got := sink.sessionIDs(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Sessions = %v, want %v", got, want)
+	}
+	if files, err := f.bufferedFiles(); err != nil || len(files) != 0 {
+		t.Errorf("Buffered files = %v (%v), want none", files, err)
+	}
+}
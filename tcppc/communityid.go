@@ -0,0 +1,59 @@
+package tcppc
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+)
+
+// IP protocol numbers used by Community ID.
+var communityIDProtos = map[string]uint8{
+	"tcp": 6,
+	"tls": 6,
+	"udp": 17,
+}
+
+// CommunityID returns the Community ID v1 hash of the flow
+// (https://github.com/corelight/community-id-spec), which is the same as the
+// one computed by Zeek and Suricata with the same seed. It returns an empty
+// string if the flow can not be hashed.
+func (f *Flow) CommunityID(seed uint16) string {
+	proto, ok := communityIDProtos[f.Proto]
+	if !ok {
+		return ""
+	}
+
+	src, dst := packIP(f.Src), packIP(f.Dst)
+	if src == nil || dst == nil || len(src) != len(dst) {
+		return ""
+	}
+
+	sport, dport := uint16(f.Sport), uint16(f.Dport)
+
+	// The hash is independent of the direction of the flow: the smaller
+	// endpoint comes first.
+	if c := bytes.Compare(src, dst); c > 0 || (c == 0 && sport > dport) {
+		src, dst = dst, src
+		sport, dport = dport, sport
+	}
+
+	h := sha1.New()
+	binary.Write(h, binary.BigEndian, seed)
+	h.Write(src)
+	h.Write(dst)
+	h.Write([]byte{proto, 0})
+	binary.Write(h, binary.BigEndian, sport)
+	binary.Write(h, binary.BigEndian, dport)
+
+	return "1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// packIP returns the address in 4 bytes for IPv4 or 16 bytes for IPv6.
+func packIP(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
@@ -0,0 +1,43 @@
+package tcppc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFlowCommunityID(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto string
+		src   string
+		sport int
+		dst   string
+		dport int
+		seed  uint16
+		want  string
+	}{
+		// Examples of the specification
+		// (https://github.com/corelight/community-id-spec).
+		{"tcp", "tcp", "128.232.110.120", 34855, "66.35.250.204", 80, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{"tcp reversed", "tcp", "66.35.250.204", 80, "128.232.110.120", 34855, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{"tcp seed", "tcp", "128.232.110.120", 34855, "66.35.250.204", 80, 1, "1:3V71V58M3Ksw/yuFALMcW0LAHvc="},
+		{"udp", "udp", "192.168.1.52", 54585, "8.8.8.8", 53, 0, "1:d/FP5EW3wiY1vCndhwleRRKHowQ="},
+		// IPv6 addresses are hashed in 16 bytes.
+		{"tcp ipv6", "tcp", "fe80::200:86ff:fe05:80da", 2222, "fe80::260:97ff:fe07:69ea", 22, 0, "1:S2U5c48dDrenHC/TWPfvJSztzMM="},
+		{"udp ipv6", "udp", "2001:db8::2", 53, "2001:db8::1", 5353, 0, "1:sEzqFsMvqwEs2PgSeOAwGpzkZJo="},
+		// TLS is hashed as TCP.
+		{"tls", "tls", "128.232.110.120", 34855, "66.35.250.204", 80, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		// Flows which can not be hashed (tcppc does not receive ICMP).
+		{"icmp", "icmp", "192.168.0.89", 8, "192.168.0.1", 0, 0, ""},
+		{"mixed families", "tcp", "192.0.2.1", 34855, "2001:db8::1", 80, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flow := &Flow{tt.proto, net.ParseIP(tt.src), tt.sport, net.ParseIP(tt.dst), tt.dport}
+			if got := flow.CommunityID(tt.seed); got != tt.want {
+				t.Errorf("CommunityID(%d) = %q, want %q", tt.seed, got, tt.want)
+			}
+		})
+	}
+}
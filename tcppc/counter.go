@@ -4,10 +4,6 @@ import (
 	"sync"
 )
 
-var (
-	counter = NewSessionCounter()
-)
-
 type SessionCounter struct {
 	Count uint
 	mutex sync.RWMutex
@@ -23,6 +19,12 @@ func (c *SessionCounter) inc() {
 	c.Count += 1
 }
 
+func (c *SessionCounter) add(n uint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Count += n
+}
+
 func (c *SessionCounter) dec() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
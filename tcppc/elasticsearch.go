@@ -0,0 +1,514 @@
+package tcppc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jehiah/go-strftime"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of ESOptions.
+	DefaultESIndex         = "tcppc-%Y.%m.%d"
+	DefaultESBatchSize     = 500
+	DefaultESFlushInterval = 5 * time.Second
+	DefaultESQueueSize     = 4096
+	DefaultESMaxRetries    = 5
+
+	// Delay before the first retry of a bulk request (doubled on each
+	// retry up to esMaxRetryDelay).
+	esRetryDelay    = time.Second
+	esMaxRetryDelay = time.Minute
+	// Timeout of a bulk request.
+	esRequestTimeout = 30 * time.Second
+	// Maximum size of an error response kept in logs.
+	esMaxErrorSize = 1024
+)
+
+// ESOptions configures ESSink.
+type ESOptions struct {
+	// Base URL of Elasticsearch or OpenSearch (e.g. "http://localhost:9200").
+	URL string
+	// Index name format w/ time indicators of strftime and tokens
+	// (TokenProto, TokenDport, TokenDst and TokenSensor) replaced with values
+	// of each record ("": DefaultESIndex).
+	Index string
+	// Formatter of documents (nil: ECS).
+	Format Formatter
+	// Credentials of basic authentication, or an API key ("id:key" encoded in
+	// base64 as given by Elasticsearch) which takes precedence.
+	Username string
+	Password string
+	APIKey   string
+	// Maximum number of documents in a bulk request (0: DefaultESBatchSize).
+	BatchSize int
+	// Documents are sent at least this often (0: DefaultESFlushInterval).
+	FlushInterval time.Duration
+	// Maximum number of documents waiting to be sent (0:
+	// DefaultESQueueSize). Documents are dropped when the queue is full.
+	QueueSize int
+	// Maximum number of retries of documents which failed to be indexed (0:
+	// DefaultESMaxRetries).
+	MaxRetries int
+	// File where documents which failed after all retries are appended as
+	// JSON lines (empty: they are lost).
+	DeadLetterFile string
+	// Location used as timezone in Index.
+	Location *time.Location
+	// Value of TokenSensor in Index.
+	Sensor string
+	// HTTP client (nil: a client with esRequestTimeout).
+	Client *http.Client
+}
+
+// ESStats holds statistics of ESSink.
+type ESStats struct {
+	// Number of documents indexed.
+	Indexed uint
+	// Number of documents dropped because the queue is full.
+	Dropped uint
+	// Number of retries of documents.
+	Retried uint
+	// Number of documents which failed after all retries (written to the
+	// dead-letter file if any).
+	Failed uint
+	// Number of documents which could not be written to the dead-letter file.
+	Lost uint
+}
+
+// esDoc is a document waiting to be indexed.
+type esDoc struct {
+	index string
+	id    string
+	data  []byte
+	// Number of failed attempts to index the document.
+	attempts int
+	// Last error of the document.
+	err string
+}
+
+// esBulkResponse is the response of the _bulk API. Each item is keyed on the
+// action ("create").
+type esBulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]esBulkItemResult `json:"items"`
+}
+
+type esBulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// esDeadLetter is a line of the dead-letter file.
+type esDeadLetter struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Index     string          `json:"index"`
+	ID        string          `json:"id"`
+	Attempts  int             `json:"attempts"`
+	Error     string          `json:"error"`
+	Document  json.RawMessage `json:"document"`
+}
+
+// ESSink indexes records into Elasticsearch or OpenSearch with the _bulk
+// API.
+//
+// Records are put into a bounded queue and sent in batches of BatchSize
+// documents (or every FlushInterval) by a single goroutine, so that session
+// handlers do not wait for the server. Documents are created with IDs
+// derived from session IDs, so that retries do not duplicate them (conflicts
+// of documents created by previous attempts count as success).
+//
+// When a bulk request fails as a whole (e.g. the server is down), or
+// documents in it are rejected with a retryable status (429 or 5xx), they
+// are retried with exponential backoff. Documents which are rejected with
+// other statuses (e.g. mapping errors) or fail MaxRetries times are appended
+// to DeadLetterFile.
+type ESSink struct {
+	opts      ESOptions
+	bulkURL   string
+	hasTokens bool
+	// Documents waiting to be sent.
+	queue chan *esDoc
+	// True if this sink is closed (documents are not queued any more).
+	closed bool
+	// Mutex object for exclusive control of closed and queue.
+	queueMutex sync.RWMutex
+	// Closed when the sender goroutine exits.
+	stopped chan struct{}
+	// Dead-letter file (nil: not opened yet).
+	deadLetter *os.File
+	// Statistics.
+	indexed *SessionCounter
+	dropped *SessionCounter
+	retried *SessionCounter
+	failed  *SessionCounter
+	lost    *SessionCounter
+}
+
+// NewESSink starts the sender goroutine. The server is not connected until
+// the first batch is sent.
+func NewESSink(opts ESOptions) (*ESSink, error) {
+	if opts.URL == "" {
+		return nil, errors.New("URL of Elasticsearch is not given.")
+	}
+	if opts.Index == "" {
+		opts.Index = DefaultESIndex
+	}
+	if opts.Format == nil {
+		opts.Format = ecsFormatter{}
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultESBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultESFlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultESQueueSize
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = DefaultESMaxRetries
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: esRequestTimeout}
+	}
+
+	s := &ESSink{
+		opts:      opts,
+		bulkURL:   strings.TrimRight(opts.URL, "/") + "/_bulk",
+		hasTokens: hasTokens(opts.Index),
+		queue:     make(chan *esDoc, opts.QueueSize),
+		stopped:   make(chan struct{}),
+		indexed:   NewSessionCounter(),
+		dropped:   NewSessionCounter(),
+		retried:   NewSessionCounter(),
+		failed:    NewSessionCounter(),
+		lost:      NewSessionCounter(),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *ESSink) Name() string {
+	return fmt.Sprintf("elasticsearch (%s)", s.opts.URL)
+}
+
+// indexName returns the name of the index of a record of the flow at t.
+// Index names of Elasticsearch must be lowercase.
+func (s *ESSink) indexName(flow *Flow, t time.Time) string {
+	name := s.opts.Index
+
+	if s.hasTokens {
+		proto, dport, dst := unknownToken, unknownToken, unknownToken
+		if flow != nil {
+			proto = flow.Proto
+			dport = strconv.Itoa(flow.Dport)
+			dst = flow.Dst.String()
+		}
+
+		r := strings.NewReplacer(
+			TokenProto, sanitizeToken(proto),
+			TokenDport, sanitizeToken(dport),
+			TokenDst, sanitizeToken(dst),
+			TokenSensor, sanitizeToken(s.opts.Sensor),
+		)
+		name = r.Replace(name)
+	}
+
+	return strings.ToLower(strftime.Format(name, t.In(s.opts.Location)))
+}
+
+func (s *ESSink) WriteSession(session *Session) error {
+	data, err := s.opts.Format.FormatSession(session)
+	if err != nil {
+		return fmt.Errorf("Failed to encode session: %w", err)
+	}
+	if data == nil {
+		return nil
+	}
+
+	return s.enqueue(&esDoc{
+		index: s.indexName(session.Flow, session.Timestamp),
+		id:    session.ID,
+		data:  data,
+	})
+}
+
+func (s *ESSink) WriteEvent(event *Event) error {
+	data, err := s.opts.Format.FormatEvent(event)
+	if err != nil {
+		return fmt.Errorf("Failed to encode event: %w", err)
+	}
+	if data == nil {
+		return nil
+	}
+
+	// IDs of events are unique within the session.
+	id := event.SessionID + "-" + event.Type
+	if event.Payload != nil {
+		id += "-" + strconv.FormatUint(uint64(event.Payload.Index), 10)
+	}
+
+	return s.enqueue(&esDoc{
+		index: s.indexName(event.Flow, event.Timestamp),
+		id:    id,
+		data:  data,
+	})
+}
+
+// enqueue puts a document into the queue without blocking.
+func (s *ESSink) enqueue(doc *esDoc) error {
+	s.queueMutex.RLock()
+	defer s.queueMutex.RUnlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	select {
+	case s.queue <- doc:
+		return nil
+	default:
+		s.dropped.inc()
+		return ErrQueueFull
+	}
+}
+
+// run sends documents in the queue until the sink is closed.
+func (s *ESSink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*esDoc
+	for {
+		select {
+		case doc, ok := <-s.queue:
+			if !ok {
+				s.send(batch)
+				s.closeDeadLetter()
+				return
+			}
+
+			batch = append(batch, doc)
+			if len(batch) >= s.opts.BatchSize {
+				s.send(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			s.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send indexes the batch, retrying documents which failed with backoff.
+// Documents which can not be indexed are written to the dead-letter file.
+func (s *ESSink) send(batch []*esDoc) {
+	delay := esRetryDelay
+
+	for len(batch) > 0 {
+		retry, err := s.bulk(batch)
+		if err != nil {
+			log.Printf("Elasticsearch: %s\n", err)
+		}
+
+		// Give up documents which have been tried too many times.
+		batch = batch[:0]
+		for _, doc := range retry {
+			if doc.attempts > s.opts.MaxRetries {
+				s.writeDeadLetter(doc)
+			} else {
+				batch = append(batch, doc)
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		s.retried.add(uint(len(batch)))
+		log.Printf("Elasticsearch: %d documents failed (retry in %s)\n", len(batch), delay)
+
+		time.Sleep(delay)
+		if delay *= 2; delay > esMaxRetryDelay {
+			delay = esMaxRetryDelay
+		}
+	}
+}
+
+// bulk sends a bulk request of the documents and returns those which should
+// be retried. Documents rejected permanently are written to the dead-letter
+// file.
+func (s *ESSink) bulk(docs []*esDoc) ([]*esDoc, error) {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		action := map[string]map[string]string{
+			"create": {"_index": doc.index, "_id": doc.id},
+		}
+		line, _ := json.Marshal(action)
+
+		body.Write(line)
+		body.WriteByte('\n')
+		body.Write(doc.data)
+		body.WriteByte('\n')
+	}
+
+	failAll := func(err error) ([]*esDoc, error) {
+		for _, doc := range docs {
+			doc.attempts += 1
+			doc.err = err.Error()
+		}
+		return docs, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.bulkURL, &body)
+	if err != nil {
+		return failAll(fmt.Errorf("Failed to create bulk request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.opts.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.opts.APIKey)
+	} else if s.opts.Username != "" {
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return failAll(fmt.Errorf("Failed to send bulk request: %w", err))
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return failAll(fmt.Errorf("Failed to read bulk response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(data) > esMaxErrorSize {
+			data = data[:esMaxErrorSize]
+		}
+		return failAll(fmt.Errorf("Bulk request failed: %s: %s", resp.Status, strings.TrimSpace(string(data))))
+	}
+
+	var result esBulkResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return failAll(fmt.Errorf("Failed to parse bulk response: %w", err))
+	}
+	if len(result.Items) != len(docs) {
+		return failAll(fmt.Errorf("Bulk response has %d items for %d documents", len(result.Items), len(docs)))
+	}
+
+	var retry []*esDoc
+	for i, doc := range docs {
+		var item esBulkItemResult
+		for _, v := range result.Items[i] {
+			item = v
+		}
+
+		switch {
+		case item.Status >= 200 && item.Status < 300, item.Status == http.StatusConflict:
+			// Conflicts mean that the document was created by a previous
+			// attempt.
+			s.indexed.inc()
+		case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+			doc.attempts += 1
+			doc.err = fmt.Sprintf("%d: %s", item.Status, item.Error)
+			retry = append(retry, doc)
+		default:
+			doc.attempts += 1
+			doc.err = fmt.Sprintf("%d: %s", item.Status, item.Error)
+			s.writeDeadLetter(doc)
+		}
+	}
+
+	return retry, nil
+}
+
+// writeDeadLetter appends the document to the dead-letter file.
+func (s *ESSink) writeDeadLetter(doc *esDoc) {
+	s.failed.inc()
+
+	if s.opts.DeadLetterFile == "" {
+		s.lost.inc()
+		log.Printf("Elasticsearch: document lost: %s/%s: %s\n", doc.index, doc.id, doc.err)
+		return
+	}
+
+	if s.deadLetter == nil {
+		f, err := os.OpenFile(s.opts.DeadLetterFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			s.lost.inc()
+			log.Printf("Elasticsearch: failed to open dead-letter file: %s\n", err)
+			return
+		}
+		s.deadLetter = f
+	}
+
+	line, _ := json.Marshal(esDeadLetter{
+		Timestamp: time.Now(),
+		Index:     doc.index,
+		ID:        doc.id,
+		Attempts:  doc.attempts,
+		Error:     doc.err,
+		Document:  doc.data,
+	})
+
+	if _, err := s.deadLetter.Write(append(line, '\n')); err != nil {
+		s.lost.inc()
+		log.Printf("Elasticsearch: failed to write dead-letter file: %s\n", err)
+	}
+}
+
+func (s *ESSink) closeDeadLetter() {
+	if s.deadLetter == nil {
+		return
+	}
+
+	if err := s.deadLetter.Close(); err != nil {
+		log.Printf("Elasticsearch: failed to close dead-letter file: %s\n", err)
+	}
+	s.deadLetter = nil
+}
+
+// Stats returns the current statistics of the sink.
+func (s *ESSink) Stats() ESStats {
+	return ESStats{
+		Indexed: s.indexed.count(),
+		Dropped: s.dropped.count(),
+		Retried: s.retried.count(),
+		Failed:  s.failed.count(),
+		Lost:    s.lost.count(),
+	}
+}
+
+// Close sends all queued documents (with retries) and stops the sender
+// goroutine.
+func (s *ESSink) Close() error {
+	s.queueMutex.Lock()
+	if s.closed {
+		s.queueMutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.queueMutex.Unlock()
+
+	<-s.stopped
+
+	return nil
+}
@@ -0,0 +1,300 @@
+package tcppc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeES is a stand-in of the _bulk API of Elasticsearch. respond returns
+// the status of the response and the statuses of the items of the n-th
+// (0-origin) request given the IDs of its documents (nil items: the body is
+// not a bulk response).
+type fakeES struct {
+	respond func(n int, ids []string) (int, []int)
+	// IDs of documents and times of requests.
+	requests [][]string
+	times    []time.Time
+	// Header of the last request.
+	header http.Header
+	mutex  sync.Mutex
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for i := 0; scanner.Scan(); i++ {
+		// Lines of actions and documents alternate.
+		if i%2 != 0 {
+			continue
+		}
+
+		var action map[string]map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, action["create"]["_id"])
+	}
+
+	f.mutex.Lock()
+	n := len(f.requests)
+	f.requests = append(f.requests, ids)
+	f.times = append(f.times, time.Now())
+	f.header = r.Header.Clone()
+	f.mutex.Unlock()
+
+	status, items := f.respond(n, ids)
+	if items == nil {
+		http.Error(w, `{"error": "unavailable"}`, status)
+		return
+	}
+
+	var resp esBulkResponse
+	for _, itemStatus := range items {
+		result := esBulkItemResult{Status: itemStatus}
+		if itemStatus >= 300 {
+			resp.Errors = true
+			result.Error = json.RawMessage(fmt.Sprintf(`{"type": "error_%d"}`, itemStatus))
+		}
+		resp.Items = append(resp.Items, map[string]esBulkItemResult{"create": result})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// statuses returns the same item status for each of n documents.
+func statuses(n, status int) []int {
+	items := make([]int, n)
+	for i := range items {
+		items[i] = status
+	}
+	return items
+}
+
+// startFakeES starts the stand-in server and a sink which sends documents
+// to it.
+func startFakeES(t *testing.T, opts ESOptions, respond func(n int, ids []string) (int, []int)) (*fakeES, *ESSink) {
+	t.Helper()
+
+	fake := &fakeES{respond: respond}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	opts.URL = server.URL
+	sink, err := NewESSink(opts)
+	if err != nil {
+		t.Fatalf("Failed to create the sink: %s", err)
+	}
+
+	return fake, sink
+}
+
+func newTestSession(dport int) *Session {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: dport}
+
+	session := NewSession(NewTCPFlow(src, dst))
+	session.AddPayload([]byte("hello"))
+	end := session.Timestamp.Add(time.Second)
+	session.EndTimestamp = &end
+
+	return session
+}
+
+func writeSessions(t *testing.T, sink *ESSink, n int) []*Session {
+	t.Helper()
+
+	var sessions []*Session
+	for i := 0; i < n; i++ {
+		session := newTestSession(23 + i)
+		if err := sink.WriteSession(session); err != nil {
+			t.Fatalf("Failed to write the session: %s", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+func TestESSinkBulk(t *testing.T) {
+	t.Parallel()
+
+	fake, sink := startFakeES(t, ESOptions{Index: "tcppc-{proto}-%Y", BatchSize: 2, APIKey: "a2V5"}, func(n int, ids []string) (int, []int) {
+		return http.StatusOK, statuses(len(ids), http.StatusCreated)
+	})
+
+	sessions := writeSessions(t, sink, 3)
+	sink.Close()
+
+	// A full batch is sent at once, and the rest is sent on Close.
+	if len(fake.requests) != 2 || len(fake.requests[0]) != 2 || len(fake.requests[1]) != 1 {
+		t.Fatalf("Requests = %v, want batches of 2 and 1 documents", fake.requests)
+	}
+	for i, id := range append(fake.requests[0], fake.requests[1]...) {
+		if id != sessions[i].ID {
+			t.Errorf("ID of document %d = %q, want %q", i, id, sessions[i].ID)
+		}
+	}
+	if got := fake.header.Get("Authorization"); got != "ApiKey a2V5" {
+		t.Errorf("Authorization = %q, want %q", got, "ApiKey a2V5")
+	}
+
+	want := fmt.Sprintf("tcppc-tcp-%d", sessions[0].Timestamp.Year())
+	if got := sink.indexName(sessions[0].Flow, sessions[0].Timestamp); got != want {
+		t.Errorf("Index = %q, want %q", got, want)
+	}
+
+	if stats := sink.Stats(); stats.Indexed != 3 || stats.Retried != 0 || stats.Failed != 0 {
+		t.Errorf("Stats = %+v, want 3 documents indexed", stats)
+	}
+}
+
+func TestESSinkConflict(t *testing.T) {
+	t.Parallel()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	fake, sink := startFakeES(t, ESOptions{DeadLetterFile: deadLetter}, func(n int, ids []string) (int, []int) {
+		// The documents were created by a previous attempt.
+		return http.StatusOK, statuses(len(ids), http.StatusConflict)
+	})
+
+	writeSessions(t, sink, 2)
+	sink.Close()
+
+	if len(fake.requests) != 1 {
+		t.Errorf("%d requests are sent, want 1", len(fake.requests))
+	}
+	if stats := sink.Stats(); stats.Indexed != 2 || stats.Retried != 0 || stats.Failed != 0 {
+		t.Errorf("Stats = %+v, want 2 documents indexed", stats)
+	}
+	if _, err := os.Stat(deadLetter); !os.IsNotExist(err) {
+		t.Errorf("Dead-letter file is created: %v", err)
+	}
+}
+
+func TestESSinkPartialFailure(t *testing.T) {
+	t.Parallel()
+
+	fake, sink := startFakeES(t, ESOptions{}, func(n int, ids []string) (int, []int) {
+		if n == 0 {
+			return http.StatusOK, []int{http.StatusCreated, http.StatusServiceUnavailable, http.StatusCreated}
+		}
+		return http.StatusOK, statuses(len(ids), http.StatusCreated)
+	})
+
+	sessions := writeSessions(t, sink, 3)
+	sink.Close()
+
+	// Only the document which failed is retried.
+	if len(fake.requests) != 2 {
+		t.Fatalf("%d requests are sent, want 2", len(fake.requests))
+	}
+	if got := fake.requests[1]; len(got) != 1 || got[0] != sessions[1].ID {
+		t.Errorf("Retried documents = %v, want [%s]", got, sessions[1].ID)
+	}
+	if stats := sink.Stats(); stats.Indexed != 3 || stats.Retried != 1 || stats.Failed != 0 {
+		t.Errorf("Stats = %+v, want 3 documents indexed after a retry", stats)
+	}
+}
+
+func TestESSinkBackoff(t *testing.T) {
+	t.Parallel()
+
+	fake, sink := startFakeES(t, ESOptions{}, func(n int, ids []string) (int, []int) {
+		switch n {
+		case 0:
+			return http.StatusTooManyRequests, nil
+		case 1:
+			return http.StatusBadGateway, nil
+		}
+		return http.StatusOK, statuses(len(ids), http.StatusCreated)
+	})
+
+	writeSessions(t, sink, 1)
+	sink.Close()
+
+	if len(fake.requests) != 3 {
+		t.Fatalf("%d requests are sent, want 3", len(fake.requests))
+	}
+
+	// The delay is doubled on each retry.
+	const margin = 100 * time.Millisecond
+	for i, want := range []time.Duration{esRetryDelay, 2 * esRetryDelay} {
+		if got := fake.times[i+1].Sub(fake.times[i]); got < want-margin {
+			t.Errorf("Delay before retry %d = %s, want %s", i+1, got, want)
+		}
+	}
+
+	if stats := sink.Stats(); stats.Indexed != 1 || stats.Retried != 2 || stats.Failed != 0 {
+		t.Errorf("Stats = %+v, want a document indexed after 2 retries", stats)
+	}
+}
+
+func TestESSinkDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	fake, sink := startFakeES(t, ESOptions{MaxRetries: 1, DeadLetterFile: deadLetter}, func(n int, ids []string) (int, []int) {
+		// The first document is rejected permanently (e.g. a mapping error)
+		// and the second one keeps failing.
+		if n == 0 {
+			return http.StatusOK, []int{http.StatusBadRequest, http.StatusInternalServerError}
+		}
+		return http.StatusOK, statuses(len(ids), http.StatusInternalServerError)
+	})
+
+	sessions := writeSessions(t, sink, 2)
+	sink.Close()
+
+	if len(fake.requests) != 2 {
+		t.Errorf("%d requests are sent, want 2", len(fake.requests))
+	}
+
+	data, err := os.ReadFile(deadLetter)
+	if err != nil {
+		t.Fatalf("Failed to read the dead-letter file: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Dead-letter file has %d lines, want 2:\n%s", len(lines), data)
+	}
+
+	for i, want := range []struct {
+		id       string
+		attempts int
+	}{
+		{sessions[0].ID, 1},
+		{sessions[1].ID, 2},
+	} {
+		var letter esDeadLetter
+		if err := json.Unmarshal([]byte(lines[i]), &letter); err != nil {
+			t.Fatalf("Failed to parse the dead-letter file: %s", err)
+		}
+		if letter.ID != want.id || letter.Attempts != want.attempts || len(letter.Document) == 0 {
+			t.Errorf("Dead letter %d = %+v, want ID %s after %d attempts", i, letter, want.id, want.attempts)
+		}
+	}
+
+	if stats := sink.Stats(); stats.Indexed != 0 || stats.Retried != 1 || stats.Failed != 2 || stats.Lost != 0 {
+		t.Errorf("Stats = %+v, want 2 documents failed", stats)
+	}
+}
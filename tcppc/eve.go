@@ -0,0 +1,183 @@
+package tcppc
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"time"
+)
+
+const (
+	// Format of timestamps in EVE JSON.
+	eveTimeFmt = "2006-01-02T15:04:05.000000-0700"
+	// Flow IDs are kept within integers which are exact in JSON (53 bits).
+	eveFlowIDMask = 1<<53 - 1
+)
+
+// eveFormatter encodes sessions as "flow" events of Suricata EVE JSON
+// (https://docs.suricata.io/en/latest/output/eve/eve-json-format.html).
+// Since tcppc does not see packets, pkts_toserver is the number of payloads.
+// Fields which have no counterpart in EVE (e.g. payloads) are put under
+// "tcppc". In the event-stream output mode, a flow event is written for
+// each session_end event and other events are skipped.
+type eveFormatter struct{}
+
+type eveRecord struct {
+	Timestamp   string   `json:"timestamp"`
+	FlowID      uint64   `json:"flow_id"`
+	InIface     string   `json:"in_iface,omitempty"`
+	EventType   string   `json:"event_type"`
+	SrcIP       string   `json:"src_ip"`
+	SrcPort     int      `json:"src_port"`
+	DestIP      string   `json:"dest_ip"`
+	DestPort    int      `json:"dest_port"`
+	Proto       string   `json:"proto"`
+	AppProto    string   `json:"app_proto,omitempty"`
+	CommunityID string   `json:"community_id,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	Flow        eveFlow  `json:"flow"`
+	TLS         *eveTLS  `json:"tls,omitempty"`
+	Tcppc       eveTcppc `json:"tcppc"`
+}
+
+type eveFlow struct {
+	PktsToServer  int    `json:"pkts_toserver"`
+	PktsToClient  int    `json:"pkts_toclient"`
+	BytesToServer int    `json:"bytes_toserver"`
+	BytesToClient int    `json:"bytes_toclient"`
+	Start         string `json:"start"`
+	End           string `json:"end"`
+	Age           int64  `json:"age"`
+	State         string `json:"state"`
+	Reason        string `json:"reason"`
+	Alerted       bool   `json:"alerted"`
+}
+
+type eveTLS struct {
+	SNI     string  `json:"sni,omitempty"`
+	Version string  `json:"version,omitempty"`
+	JA3     *eveJA3 `json:"ja3,omitempty"`
+}
+
+type eveJA3 struct {
+	Hash   string `json:"hash"`
+	String string `json:"string"`
+}
+
+type eveTcppc struct {
+	SchemaVersion int         `json:"schema_version"`
+	SessionID     string      `json:"session_id"`
+	Sensor        *SensorInfo `json:"sensor,omitempty"`
+	Version       string      `json:"tcppc_version,omitempty"`
+	Payloads      []*Payload  `json:"payloads,omitempty"`
+	Rejected      string      `json:"rejected,omitempty"`
+	Truncated     bool        `json:"truncated,omitempty"`
+	MaxDuration   bool        `json:"max_duration,omitempty"`
+	Incomplete    bool        `json:"incomplete,omitempty"`
+}
+
+// eveFlowID returns the flow ID derived from the session ID.
+func eveFlowID(sessionID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(sessionID))
+	return h.Sum64() & eveFlowIDMask
+}
+
+func formatEVETime(t time.Time) string {
+	return t.Format(eveTimeFmt)
+}
+
+// newEVERecord returns a flow event of a session.
+func newEVERecord(sessionID string, start, end time.Time, flow *Flow, sensor *SensorInfo, listener *ListenerInfo, communityID string, tlsInfo *TLSInfo, numPayloads, numBytes int) *eveRecord {
+	r := &eveRecord{
+		Timestamp:   formatEVETime(start),
+		FlowID:      eveFlowID(sessionID),
+		EventType:   "flow",
+		SrcIP:       flow.Src.String(),
+		SrcPort:     flow.Sport,
+		DestIP:      flow.Dst.String(),
+		DestPort:    flow.Dport,
+		Proto:       "TCP",
+		CommunityID: communityID,
+		Flow: eveFlow{
+			PktsToServer:  numPayloads,
+			BytesToServer: numBytes,
+			Start:         formatEVETime(start),
+			End:           formatEVETime(end),
+			Age:           int64(end.Sub(start) / time.Second),
+			State:         "closed",
+			Reason:        "timeout",
+		},
+	}
+
+	if flow.Proto == "udp" {
+		r.Proto = "UDP"
+		r.Flow.State = "new"
+	}
+	if sensor != nil {
+		r.Host = sensor.Name
+	}
+	if listener != nil {
+		r.InIface = listener.Name
+	}
+
+	if tlsInfo != nil {
+		r.AppProto = "tls"
+		r.TLS = &eveTLS{SNI: tlsInfo.ServerName}
+		if tlsInfo.Version != "" {
+			r.TLS.Version = "TLS " + tlsInfo.Version
+		} else {
+			r.AppProto = "failed"
+		}
+		if tlsInfo.JA3 != "" {
+			r.TLS.JA3 = &eveJA3{Hash: tlsInfo.JA3, String: tlsInfo.JA3String}
+		}
+	}
+
+	return r
+}
+
+func (eveFormatter) FormatSession(session *Session) ([]byte, error) {
+	end := session.Timestamp
+	if session.EndTimestamp != nil {
+		end = *session.EndTimestamp
+	}
+
+	r := newEVERecord(session.ID, session.Timestamp, end, session.Flow, session.Sensor, session.Listener, session.CommunityID, session.TLS, len(session.Payloads), session.NumBytes())
+	r.Tcppc = eveTcppc{
+		SchemaVersion: session.SchemaVersion,
+		SessionID:     session.ID,
+		Sensor:        session.Sensor,
+		Version:       session.Version,
+		Payloads:      session.Payloads,
+		Rejected:      session.Rejected,
+		Truncated:     session.Truncated,
+		MaxDuration:   session.MaxDuration,
+		Incomplete:    session.Incomplete,
+	}
+
+	return json.Marshal(r)
+}
+
+func (eveFormatter) FormatEvent(event *Event) ([]byte, error) {
+	if event.Type != EventSessionEnd {
+		return nil, nil
+	}
+
+	start := event.Timestamp
+	if event.Start != nil {
+		start = *event.Start
+	}
+
+	r := newEVERecord(event.SessionID, start, event.Timestamp, event.Flow, event.Sensor, event.Listener, event.CommunityID, event.TLS, event.NumPayloads, event.NumBytes)
+	r.Tcppc = eveTcppc{
+		SchemaVersion: event.SchemaVersion,
+		SessionID:     event.SessionID,
+		Sensor:        event.Sensor,
+		Version:       event.Version,
+		Rejected:      event.Rejected,
+		Truncated:     event.Truncated,
+		MaxDuration:   event.MaxDuration,
+	}
+
+	return json.Marshal(r)
+}
@@ -0,0 +1,252 @@
+package tcppc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// Output modes of Server.
+	// Each session is written as a whole when it ends.
+	OutputSessions = "sessions"
+	// Events of each session are written as they happen.
+	OutputEvents = "events"
+
+	// Types of events.
+	EventSessionStart = "session_start"
+	EventPayload      = "payload"
+	EventSessionEnd   = "session_end"
+
+	// Maximum size of a line read by EventReader.
+	maxEventLineSize = 64 * 1024 * 1024
+)
+
+// Event is a record of the event-stream output mode. A session is written as
+// a session_start event when it is established, a payload event for each
+// payload and a session_end event when it ends. Events of a session share
+// the same session ID, and Reassembler rebuilds the Session from them.
+type Event struct {
+	// Same as the fields of Session (all events).
+	SchemaVersion int           `json:"schema_version"`
+	Type          string        `json:"type"`
+	SessionID     string        `json:"session_id"`
+	Timestamp     time.Time     `json:"timestamp"`
+	Sensor        *SensorInfo   `json:"sensor,omitempty"`
+	Listener      *ListenerInfo `json:"listener,omitempty"`
+	Version       string        `json:"tcppc_version,omitempty"`
+	// Flow of the session (all events).
+	Flow *Flow `json:"flow"`
+	// Community ID of the flow and attributes of TLS (session_start and
+	// session_end events only).
+	CommunityID string   `json:"community_id,omitempty"`
+	TLS         *TLSInfo `json:"tls,omitempty"`
+	// Payload (payload events only).
+	Payload *Payload `json:"payload,omitempty"`
+	// Time when the session started, and the number of payloads and bytes
+	// of the session (session_end events only).
+	Start       *time.Time `json:"start,omitempty"`
+	NumPayloads int        `json:"num_payloads,omitempty"`
+	NumBytes    int        `json:"num_bytes,omitempty"`
+	// Same as the fields of Session (session_end events only).
+	Rejected    string `json:"rejected,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	MaxDuration bool   `json:"max_duration,omitempty"`
+}
+
+// newEvent returns an event of the session with the common fields.
+func newEvent(eventType string, session *Session, timestamp time.Time) *Event {
+	return &Event{
+		SchemaVersion: SchemaVersion,
+		Type:          eventType,
+		SessionID:     session.ID,
+		Timestamp:     timestamp,
+		Sensor:        session.Sensor,
+		Listener:      session.Listener,
+		Version:       session.Version,
+		Flow:          session.Flow,
+	}
+}
+
+func NewSessionStartEvent(session *Session) *Event {
+	event := newEvent(EventSessionStart, session, session.Timestamp)
+	event.CommunityID = session.CommunityID
+	event.TLS = session.TLS
+
+	return event
+}
+
+func NewPayloadEvent(session *Session, payload *Payload) *Event {
+	event := newEvent(EventPayload, session, payload.Timestamp)
+	event.Payload = payload
+
+	return event
+}
+
+func NewSessionEndEvent(session *Session) *Event {
+	ts := time.Now()
+	if session.EndTimestamp != nil {
+		ts = *session.EndTimestamp
+	}
+
+	event := newEvent(EventSessionEnd, session, ts)
+	event.CommunityID = session.CommunityID
+	event.TLS = session.TLS
+	event.Start = &session.Timestamp
+	event.NumPayloads = len(session.Payloads)
+	event.NumBytes = session.NumBytes()
+	event.Rejected = session.Rejected
+	event.Truncated = session.Truncated
+	event.MaxDuration = session.MaxDuration
+
+	return event
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("Event: %s: %s: %s", e.Type, e.SessionID, e.Flow)
+}
+
+// EventReader reads events from JSON lines.
+type EventReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewEventReader(r io.Reader) *EventReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxEventLineSize)
+
+	return &EventReader{scanner: scanner}
+}
+
+// Read returns the next event. It returns io.EOF at the end of input. Empty
+// lines are skipped.
+func (r *EventReader) Read() (*Event, error) {
+	for r.scanner.Scan() {
+		r.line += 1
+
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		event := &Event{}
+		if err := json.Unmarshal(line, event); err != nil {
+			return nil, fmt.Errorf("Failed to decode event at line %d: %w", r.line, err)
+		}
+		if event.SessionID == "" {
+			return nil, fmt.Errorf("Failed to decode event at line %d: no session ID", r.line)
+		}
+
+		return event, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// Reassembler rebuilds sessions from events.
+//
+// Events of a session may be spread over several files (e.g. rotated
+// files), so all of them should be given to the same Reassembler in order.
+// A session whose session_start event is missing is rebuilt from its first
+// payload event.
+type Reassembler struct {
+	sessions map[string]*Session
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{sessions: make(map[string]*Session)}
+}
+
+// Add adds an event and returns the session if the event ends it, or nil
+// otherwise.
+func (r *Reassembler) Add(event *Event) (*Session, error) {
+	session, ok := r.sessions[event.SessionID]
+	if !ok {
+		session = &Session{
+			SchemaVersion: event.SchemaVersion,
+			ID:            event.SessionID,
+			Timestamp:     event.Timestamp,
+			Sensor:        event.Sensor,
+			Listener:      event.Listener,
+			Version:       event.Version,
+			Flow:          event.Flow,
+		}
+		r.sessions[event.SessionID] = session
+	}
+
+	if event.CommunityID != "" {
+		session.CommunityID = event.CommunityID
+	}
+	if event.TLS != nil {
+		session.TLS = event.TLS
+	}
+
+	switch event.Type {
+	case EventSessionStart:
+		session.Timestamp = event.Timestamp
+
+	case EventPayload:
+		if event.Payload == nil {
+			return nil, fmt.Errorf("Payload event without payload: %s", event)
+		}
+		session.Payloads = append(session.Payloads, event.Payload)
+
+	case EventSessionEnd:
+		delete(r.sessions, event.SessionID)
+
+		ts := event.Timestamp
+		session.EndTimestamp = &ts
+		session.Rejected = event.Rejected
+		session.Truncated = event.Truncated
+		session.MaxDuration = event.MaxDuration
+
+		// Payload events may be lost (e.g. the session file is lost).
+		if len(session.Payloads) != event.NumPayloads {
+			session.Incomplete = true
+		}
+
+		sortPayloads(session)
+
+		return session, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown type of event: %s", event)
+	}
+
+	return nil, nil
+}
+
+// Pending returns sessions which have not ended (e.g. the process crashed or
+// the session is still active) in the order of timestamps, and forgets them.
+// They are marked as incomplete.
+func (r *Reassembler) Pending() []*Session {
+	sessions := make([]*Session, 0, len(r.sessions))
+
+	for id, session := range r.sessions {
+		session.Incomplete = true
+		sortPayloads(session)
+		sessions = append(sessions, session)
+
+		delete(r.sessions, id)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Timestamp.Before(sessions[j].Timestamp)
+	})
+
+	return sessions
+}
+
+func sortPayloads(session *Session) {
+	sort.SliceStable(session.Payloads, func(i, j int) bool {
+		return session.Payloads[i].Index < session.Payloads[j].Index
+	})
+}
@@ -0,0 +1,306 @@
+package tcppc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Formats of records.
+	// Native format of tcppc (see schema/).
+	FormatNative = "native"
+	// Elastic Common Schema.
+	FormatECS = "ecs"
+	// Flow events of Suricata EVE JSON.
+	FormatEVE = "eve"
+
+	// Version of Elastic Common Schema of records.
+	ecsVersion = "8.11.0"
+)
+
+// Formatter encodes sessions and events into records (without newlines). A
+// nil record means that the session or the event is not written in the
+// format.
+type Formatter interface {
+	FormatSession(session *Session) ([]byte, error)
+	FormatEvent(event *Event) ([]byte, error)
+}
+
+// NewFormatter returns the formatter of the given format.
+func NewFormatter(format string) (Formatter, error) {
+	switch format {
+	case FormatNative, "":
+		return nativeFormatter{}, nil
+	case FormatECS:
+		return ecsFormatter{}, nil
+	case FormatEVE:
+		return eveFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown format: %q", format)
+	}
+}
+
+// nativeFormatter encodes sessions and events as they are.
+type nativeFormatter struct{}
+
+func (nativeFormatter) FormatSession(session *Session) ([]byte, error) {
+	return json.Marshal(session)
+}
+
+func (nativeFormatter) FormatEvent(event *Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+// ecsFormatter encodes sessions and events as documents of Elastic Common
+// Schema (https://www.elastic.co/guide/en/ecs/current/). Fields which have
+// no counterpart in ECS (e.g. payloads) are put under "tcppc".
+type ecsFormatter struct{}
+
+type ecsDocument struct {
+	Timestamp   time.Time       `json:"@timestamp"`
+	ECS         ecsVersionField `json:"ecs"`
+	Event       ecsEvent        `json:"event"`
+	Source      ecsEndpoint     `json:"source"`
+	Destination ecsEndpoint     `json:"destination"`
+	Network     ecsNetwork      `json:"network"`
+	Observer    *ecsObserver    `json:"observer,omitempty"`
+	TLS         *ecsTLS         `json:"tls,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Tcppc       ecsTcppc        `json:"tcppc"`
+}
+
+type ecsVersionField struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	ID       string     `json:"id,omitempty"`
+	Kind     string     `json:"kind"`
+	Category []string   `json:"category"`
+	Type     []string   `json:"type"`
+	Action   string     `json:"action"`
+	Outcome  string     `json:"outcome,omitempty"`
+	Dataset  string     `json:"dataset"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	// Duration in nanoseconds.
+	Duration *int64 `json:"duration,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type ecsEndpoint struct {
+	IP    string `json:"ip"`
+	Port  int    `json:"port"`
+	Bytes *int   `json:"bytes,omitempty"`
+}
+
+type ecsNetwork struct {
+	Transport   string `json:"transport"`
+	Protocol    string `json:"protocol,omitempty"`
+	Type        string `json:"type"`
+	Direction   string `json:"direction"`
+	CommunityID string `json:"community_id,omitempty"`
+	Bytes       *int   `json:"bytes,omitempty"`
+}
+
+type ecsObserver struct {
+	Name    string      `json:"name,omitempty"`
+	Type    string      `json:"type"`
+	Vendor  string      `json:"vendor"`
+	Product string      `json:"product"`
+	Version string      `json:"version,omitempty"`
+	Ingress *ecsIngress `json:"ingress,omitempty"`
+}
+
+type ecsIngress struct {
+	Interface ecsInterface `json:"interface"`
+}
+
+type ecsInterface struct {
+	Name string `json:"name"`
+}
+
+type ecsTLS struct {
+	Version         string       `json:"version,omitempty"`
+	VersionProtocol string       `json:"version_protocol,omitempty"`
+	Cipher          string       `json:"cipher,omitempty"`
+	Established     bool         `json:"established"`
+	Client          ecsTLSClient `json:"client"`
+}
+
+type ecsTLSClient struct {
+	JA3        string `json:"ja3,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+type ecsTcppc struct {
+	SchemaVersion int           `json:"schema_version"`
+	SessionID     string        `json:"session_id"`
+	Listener      *ListenerInfo `json:"listener,omitempty"`
+	JA3String     string        `json:"ja3_string,omitempty"`
+	Payloads      []*Payload    `json:"payloads,omitempty"`
+	Payload       *Payload      `json:"payload,omitempty"`
+	NumPayloads   *int          `json:"num_payloads,omitempty"`
+	Truncated     bool          `json:"truncated,omitempty"`
+	MaxDuration   bool          `json:"max_duration,omitempty"`
+	Incomplete    bool          `json:"incomplete,omitempty"`
+}
+
+// newECSDocument returns a document with the fields common to sessions and
+// events.
+func newECSDocument(ts time.Time, flow *Flow, sensor *SensorInfo, listener *ListenerInfo, version, communityID string, tlsInfo *TLSInfo) *ecsDocument {
+	doc := &ecsDocument{
+		Timestamp: ts,
+		ECS:       ecsVersionField{Version: ecsVersion},
+		Event: ecsEvent{
+			Kind:     "event",
+			Category: []string{"network", "intrusion_detection"},
+			Type:     []string{"connection"},
+			Dataset:  "tcppc.session",
+		},
+		Source:      ecsEndpoint{IP: flow.Src.String(), Port: flow.Sport},
+		Destination: ecsEndpoint{IP: flow.Dst.String(), Port: flow.Dport},
+		Network: ecsNetwork{
+			Transport:   "tcp",
+			Type:        "ipv4",
+			Direction:   "inbound",
+			CommunityID: communityID,
+		},
+		Observer: &ecsObserver{
+			Type:    "honeypot",
+			Vendor:  "tcppc",
+			Product: "tcppc",
+			Version: version,
+		},
+	}
+
+	switch flow.Proto {
+	case "udp":
+		doc.Network.Transport = "udp"
+	case "tls":
+		doc.Network.Protocol = "tls"
+	}
+	if flow.Src.To4() == nil {
+		doc.Network.Type = "ipv6"
+	}
+
+	if sensor != nil {
+		doc.Observer.Name = sensor.Name
+		doc.Tags = sensor.Tags
+	}
+	if listener != nil {
+		doc.Observer.Ingress = &ecsIngress{Interface: ecsInterface{Name: listener.Name}}
+	}
+
+	if tlsInfo != nil {
+		doc.TLS = &ecsTLS{
+			Cipher:      tlsInfo.Cipher,
+			Established: tlsInfo.Version != "",
+			Client: ecsTLSClient{
+				JA3:        tlsInfo.JA3,
+				ServerName: tlsInfo.ServerName,
+			},
+		}
+		if tlsInfo.Version != "" {
+			doc.TLS.Version = tlsInfo.Version
+			doc.TLS.VersionProtocol = "tls"
+		}
+	}
+
+	return doc
+}
+
+func (ecsFormatter) FormatSession(session *Session) ([]byte, error) {
+	doc := newECSDocument(session.Timestamp, session.Flow, session.Sensor, session.Listener, session.Version, session.CommunityID, session.TLS)
+
+	doc.Event.ID = session.ID
+	doc.Event.Action = "session"
+	doc.Event.Start = &session.Timestamp
+	if session.EndTimestamp != nil {
+		duration := session.EndTimestamp.Sub(session.Timestamp).Nanoseconds()
+		doc.Event.End = session.EndTimestamp
+		doc.Event.Duration = &duration
+	}
+	setECSOutcome(doc, session.Rejected)
+
+	numBytes := session.NumBytes()
+	doc.Source.Bytes = &numBytes
+	doc.Network.Bytes = &numBytes
+
+	doc.Tcppc = ecsTcppc{
+		SchemaVersion: session.SchemaVersion,
+		SessionID:     session.ID,
+		Listener:      session.Listener,
+		Payloads:      session.Payloads,
+		Truncated:     session.Truncated,
+		MaxDuration:   session.MaxDuration,
+		Incomplete:    session.Incomplete,
+	}
+	if session.TLS != nil {
+		doc.Tcppc.JA3String = session.TLS.JA3String
+	}
+
+	return json.Marshal(doc)
+}
+
+func (ecsFormatter) FormatEvent(event *Event) ([]byte, error) {
+	doc := newECSDocument(event.Timestamp, event.Flow, event.Sensor, event.Listener, event.Version, event.CommunityID, event.TLS)
+
+	doc.Event.Action = event.Type
+
+	switch event.Type {
+	case EventSessionStart:
+		doc.Event.Type = []string{"connection", "start"}
+		doc.Event.Start = &event.Timestamp
+	case EventPayload:
+		doc.Event.Type = []string{"connection", "info"}
+	case EventSessionEnd:
+		doc.Event.Type = []string{"connection", "end"}
+		doc.Event.End = &event.Timestamp
+		if event.Start != nil {
+			duration := event.Timestamp.Sub(*event.Start).Nanoseconds()
+			doc.Event.Start = event.Start
+			doc.Event.Duration = &duration
+		}
+		setECSOutcome(doc, event.Rejected)
+
+		doc.Source.Bytes = &event.NumBytes
+		doc.Network.Bytes = &event.NumBytes
+	}
+
+	doc.Tcppc = ecsTcppc{
+		SchemaVersion: event.SchemaVersion,
+		SessionID:     event.SessionID,
+		Listener:      event.Listener,
+		Payload:       event.Payload,
+		Truncated:     event.Truncated,
+		MaxDuration:   event.MaxDuration,
+	}
+	if event.Type == EventSessionEnd {
+		doc.Tcppc.NumPayloads = &event.NumPayloads
+	}
+	if event.Payload != nil {
+		numBytes := len(event.Payload.Data)
+		doc.Source.Bytes = &numBytes
+		doc.Network.Bytes = &numBytes
+	}
+	if event.TLS != nil {
+		doc.Tcppc.JA3String = event.TLS.JA3String
+	}
+
+	return json.Marshal(doc)
+}
+
+// setECSOutcome sets the outcome of the event by the reason why the
+// connection was rejected (if any).
+func setECSOutcome(doc *ecsDocument, rejected string) {
+	if rejected == "" {
+		doc.Event.Outcome = "success"
+		return
+	}
+
+	doc.Event.Type = append(doc.Event.Type, "denied")
+	doc.Event.Outcome = "failure"
+	doc.Event.Reason = rejected
+}
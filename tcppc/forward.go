@@ -0,0 +1,554 @@
+package tcppc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of ForwardOptions.
+	DefaultForwardBatchSize     = 500
+	DefaultForwardFlushInterval = 5 * time.Second
+	DefaultForwardQueueSize     = 4096
+
+	// Delay before the first retry after the collector fails (doubled on
+	// each failure up to forwardMaxRetryDelay).
+	forwardRetryDelay    = time.Second
+	forwardMaxRetryDelay = time.Minute
+	// Timeout of connecting to the collector (including the TLS handshake),
+	// and of sending a batch and receiving its acknowledgement.
+	forwardDialTimeout = 30 * time.Second
+	forwardAckTimeout  = time.Minute
+	// Connections idle for this duration are reconnected before sending a
+	// batch, because the collector closes them after collectorIdleTimeout.
+	forwardIdleTimeout = 5 * time.Minute
+	// Suffix of batch files in the buffer directory.
+	forwardBatchSuffix = ".jsonl"
+	// Format of names of batch files: zero-padded sequence numbers, which
+	// are sorted in the order that batches are buffered.
+	forwardBatchNameFmt = "%020d"
+)
+
+// forwardRecord is a session or an event in a batch. Exactly one of the
+// fields is set.
+type forwardRecord struct {
+	Session *Session `json:"session,omitempty"`
+	Event   *Event   `json:"event,omitempty"`
+}
+
+// forwardBatch is a message from a sensor to the collector (a line of JSON).
+// Records are JSON-encoded forwardRecords.
+type forwardBatch struct {
+	Seq     uint64            `json:"seq"`
+	Records []json.RawMessage `json:"records"`
+}
+
+// forwardAck is the response of the collector to a batch (a line of JSON).
+// Error is set if the batch was not (completely) accepted by the sinks of the
+// collector, in which case the sensor sends it again later.
+type forwardAck struct {
+	Seq   uint64 `json:"seq"`
+	Error string `json:"error,omitempty"`
+}
+
+// ForwardOptions configures ForwardSink.
+type ForwardOptions struct {
+	// Address of the collector ("host:port").
+	Addr string
+	// TLS configuration with the client certificate and the CA of the
+	// collector (see NewMTLSConfig).
+	TLSConfig *tls.Config
+	// Directory where batches are kept until the collector acknowledges
+	// them.
+	BufferDir string
+	// Maximum total size of batches in BufferDir in bytes (0: unlimited).
+	// Batches are lost when the buffer is full.
+	BufferMax int64
+	// Maximum number of records in a batch (0: DefaultForwardBatchSize).
+	BatchSize int
+	// Records are sent at least this often (0: DefaultForwardFlushInterval).
+	FlushInterval time.Duration
+	// Maximum number of records waiting to be sent (0:
+	// DefaultForwardQueueSize). Records are dropped when the queue is full.
+	QueueSize int
+}
+
+// ForwardStats holds statistics of ForwardSink.
+type ForwardStats struct {
+	// Number of records acknowledged by the collector.
+	Forwarded uint
+	// Number of records dropped because the queue is full.
+	Dropped uint
+	// Number of records written to the buffer directory.
+	Buffered uint
+	// Number of records lost because they could not be buffered.
+	Lost uint
+	// Number of failures of connections and batches.
+	Errors uint
+}
+
+// ForwardSink forwards sessions and events to a collector (see Collector)
+// over mutually-authenticated TLS.
+//
+// Records are put into a bounded queue and sent in batches of BatchSize
+// records (or every FlushInterval) by a single goroutine. Each batch is
+// acknowledged by the collector after its records are accepted (queued) by
+// the sinks of the collector. Batches which are not acknowledged (e.g. the
+// collector is down) are written to BufferDir, and sent again in order with
+// exponential backoff, before new batches, until they are acknowledged. Batches in BufferDir survive restarts. The
+// collector drops duplicates of records sent again, so batches may be sent
+// more than once.
+type ForwardSink struct {
+	opts ForwardOptions
+	// Connection to the collector (nil: not connected).
+	conn   net.Conn
+	reader *bufio.Reader
+	seq    uint64
+	// Time when the last batch was acknowledged.
+	lastAck time.Time
+	// Number of files and total size of batches in BufferDir.
+	bufferFiles int
+	bufferSize  int64
+	// Sequence number of the next batch file in BufferDir.
+	bufferSeq uint64
+	// Time to retry after failures (zero: not failing).
+	retryAt    time.Time
+	retryDelay time.Duration
+	// Records waiting to be sent.
+	queue chan json.RawMessage
+	// True if this sink is closed (records are not queued any more).
+	closed bool
+	// Mutex object for exclusive control of closed and queue.
+	queueMutex sync.RWMutex
+	// Closed when the sender goroutine exits.
+	stopped chan struct{}
+	// True while the collector accepts batches.
+	healthy bool
+	mutex   sync.Mutex
+	// Statistics.
+	forwarded *SessionCounter
+	dropped   *SessionCounter
+	buffered  *SessionCounter
+	lost      *SessionCounter
+	errors    *SessionCounter
+}
+
+// NewForwardSink creates the buffer directory and starts the sender
+// goroutine. The collector is not connected until the first batch is sent.
+func NewForwardSink(opts ForwardOptions) (*ForwardSink, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("Address of the collector is not given.")
+	}
+	if opts.TLSConfig == nil {
+		return nil, errors.New("TLS configuration of the collector is not given.")
+	}
+	if opts.BufferDir == "" {
+		return nil, errors.New("Buffer directory is not given.")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultForwardBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultForwardFlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultForwardQueueSize
+	}
+	if opts.TLSConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(opts.Addr); err == nil {
+			opts.TLSConfig = opts.TLSConfig.Clone()
+			opts.TLSConfig.ServerName = host
+		}
+	}
+
+	if err := os.MkdirAll(opts.BufferDir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create buffer directory: %s (%w)", opts.BufferDir, err)
+	}
+
+	s := &ForwardSink{
+		opts:       opts,
+		retryDelay: forwardRetryDelay,
+		queue:      make(chan json.RawMessage, opts.QueueSize),
+		stopped:    make(chan struct{}),
+		healthy:    true,
+		forwarded:  NewSessionCounter(),
+		dropped:    NewSessionCounter(),
+		buffered:   NewSessionCounter(),
+		lost:       NewSessionCounter(),
+		errors:     NewSessionCounter(),
+	}
+
+	files, err := s.bufferedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read buffer directory: %s (%w)", opts.BufferDir, err)
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			s.bufferFiles += 1
+			s.bufferSize += info.Size()
+		}
+		// Batches buffered from now on are sent after the existing ones.
+		if seq, ok := batchSeq(file); ok && seq >= s.bufferSeq {
+			s.bufferSeq = seq + 1
+		}
+	}
+	if s.bufferFiles > 0 {
+		log.Printf("Forward: %d batches (%d bytes) are buffered in %s\n", s.bufferFiles, s.bufferSize, opts.BufferDir)
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *ForwardSink) Name() string {
+	return fmt.Sprintf("forward (%s)", s.opts.Addr)
+}
+
+func (s *ForwardSink) WriteSession(session *Session) error {
+	data, err := json.Marshal(forwardRecord{Session: session})
+	if err != nil {
+		return fmt.Errorf("Failed to encode session: %w", err)
+	}
+
+	return s.enqueue(data)
+}
+
+func (s *ForwardSink) WriteEvent(event *Event) error {
+	data, err := json.Marshal(forwardRecord{Event: event})
+	if err != nil {
+		return fmt.Errorf("Failed to encode event: %w", err)
+	}
+
+	return s.enqueue(data)
+}
+
+// enqueue puts a record into the queue without blocking.
+func (s *ForwardSink) enqueue(record json.RawMessage) error {
+	s.queueMutex.RLock()
+	defer s.queueMutex.RUnlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		s.dropped.inc()
+		return ErrQueueFull
+	}
+}
+
+// run sends records in the queue until the sink is closed.
+func (s *ForwardSink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []json.RawMessage
+	for {
+		select {
+		case record, ok := <-s.queue:
+			if !ok {
+				s.flush(batch)
+				s.disconnect()
+				return
+			}
+
+			batch = append(batch, record)
+			if len(batch) >= s.opts.BatchSize {
+				s.flush(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			s.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush sends buffered batches and then the batch. The batch is buffered if
+// it can not be sent now.
+func (s *ForwardSink) flush(batch []json.RawMessage) {
+	if s.sendBuffered() && len(batch) > 0 {
+		err := s.send(batch)
+		if err == nil {
+			return
+		}
+		s.fail(err)
+	}
+
+	if len(batch) > 0 {
+		s.buffer(batch)
+	}
+}
+
+// sendBuffered sends batches in the buffer directory in order, and returns
+// true if all of them are acknowledged. It does nothing until retryAt after
+// failures.
+func (s *ForwardSink) sendBuffered() bool {
+	if !s.retryAt.IsZero() && time.Now().Before(s.retryAt) {
+		return false
+	}
+	if s.bufferFiles == 0 {
+		return true
+	}
+
+	files, err := s.bufferedFiles()
+	if err != nil {
+		s.fail(fmt.Errorf("Failed to read buffer directory: %s (%w)", s.opts.BufferDir, err))
+		return false
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			s.fail(fmt.Errorf("Failed to read buffered batch: %s (%w)", file, err))
+			return false
+		}
+
+		var batch []json.RawMessage
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if len(line) > 0 {
+				batch = append(batch, json.RawMessage(line))
+			}
+		}
+
+		if len(batch) > 0 {
+			if err := s.send(batch); err != nil {
+				s.fail(err)
+				return false
+			}
+		}
+
+		if err := os.Remove(file); err != nil {
+			// The batch will be sent again (and dropped as duplicates).
+			log.Printf("Forward: failed to remove buffered batch: %s\n", err)
+		}
+		s.bufferFiles -= 1
+		s.bufferSize -= int64(len(data))
+	}
+
+	s.bufferFiles, s.bufferSize = 0, 0
+
+	return true
+}
+
+// bufferedFiles returns batch files in the buffer directory in order.
+func (s *ForwardSink) bufferedFiles() ([]string, error) {
+	entries, err := os.ReadDir(s.opts.BufferDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), forwardBatchSuffix) {
+			files = append(files, filepath.Join(s.opts.BufferDir, entry.Name()))
+		}
+	}
+	// Names are zero-padded sequence numbers (see batchSeq), which are sorted
+	// in the order that batches are buffered, even if the clock goes
+	// backwards.
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// batchSeq returns the sequence number in the name of the batch file.
+func batchSeq(file string) (uint64, bool) {
+	name := strings.TrimSuffix(filepath.Base(file), forwardBatchSuffix)
+	seq, err := strconv.ParseUint(name, 10, 64)
+	return seq, err == nil
+}
+
+// buffer writes the batch to a new file in the buffer directory.
+func (s *ForwardSink) buffer(batch []json.RawMessage) {
+	var data bytes.Buffer
+	for _, record := range batch {
+		data.Write(record)
+		data.WriteByte('\n')
+	}
+
+	if s.opts.BufferMax > 0 && s.bufferSize+int64(data.Len()) > s.opts.BufferMax {
+		s.lost.add(uint(len(batch)))
+		log.Printf("Forward: buffer is full: %d records lost\n", len(batch))
+		return
+	}
+
+	fileName := filepath.Join(s.opts.BufferDir, fmt.Sprintf(forwardBatchNameFmt, s.bufferSeq)+forwardBatchSuffix)
+	tmpName := fileName + ".tmp"
+
+	err := os.WriteFile(tmpName, data.Bytes(), 0644)
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		s.lost.add(uint(len(batch)))
+		log.Printf("Forward: failed to buffer batch: %s (%d records lost)\n", err, len(batch))
+		return
+	}
+
+	s.bufferSeq += 1
+	s.buffered.add(uint(len(batch)))
+	s.bufferFiles += 1
+	s.bufferSize += int64(data.Len())
+}
+
+// connect connects to the collector if not connected.
+func (s *ForwardSink) connect() error {
+	if s.conn != nil && time.Since(s.lastAck) > forwardIdleTimeout {
+		s.disconnect()
+	}
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: forwardDialTimeout},
+		Config:    s.opts.TLSConfig,
+	}
+	conn, err := dialer.Dial("tcp", s.opts.Addr)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to collector: %s (%w)", s.opts.Addr, err)
+	}
+
+	log.Printf("Forward: connected to collector: %s\n", s.opts.Addr)
+
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	s.lastAck = time.Now()
+
+	return nil
+}
+
+func (s *ForwardSink) disconnect() {
+	if s.conn == nil {
+		return
+	}
+
+	s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+}
+
+// send sends the batch and waits for its acknowledgement.
+func (s *ForwardSink) send(batch []json.RawMessage) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+
+	s.seq += 1
+	msg, err := json.Marshal(forwardBatch{Seq: s.seq, Records: batch})
+	if err != nil {
+		return fmt.Errorf("Failed to encode batch: %w", err)
+	}
+
+	s.conn.SetDeadline(time.Now().Add(forwardAckTimeout))
+
+	if _, err := s.conn.Write(append(msg, '\n')); err != nil {
+		s.disconnect()
+		return fmt.Errorf("Failed to send batch: %w", err)
+	}
+
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		s.disconnect()
+		return fmt.Errorf("Failed to receive acknowledgement: %w", err)
+	}
+
+	var ack forwardAck
+	if err := json.Unmarshal(line, &ack); err != nil {
+		s.disconnect()
+		return fmt.Errorf("Failed to parse acknowledgement: %w", err)
+	}
+	if ack.Seq != s.seq {
+		s.disconnect()
+		return fmt.Errorf("Unexpected acknowledgement: seq: %d (expected %d)", ack.Seq, s.seq)
+	}
+	if ack.Error != "" {
+		return fmt.Errorf("Collector failed to write batch: %s", ack.Error)
+	}
+
+	s.conn.SetDeadline(time.Time{})
+	s.lastAck = time.Now()
+
+	s.forwarded.add(uint(len(batch)))
+	s.retryAt = time.Time{}
+	s.retryDelay = forwardRetryDelay
+
+	s.mutex.Lock()
+	s.healthy = true
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// fail schedules the next retry with exponential backoff.
+func (s *ForwardSink) fail(err error) {
+	s.errors.inc()
+	log.Printf("Forward: %s (retry in %s)\n", err, s.retryDelay)
+
+	s.retryAt = time.Now().Add(s.retryDelay)
+	if s.retryDelay *= 2; s.retryDelay > forwardMaxRetryDelay {
+		s.retryDelay = forwardMaxRetryDelay
+	}
+
+	s.mutex.Lock()
+	s.healthy = false
+	s.mutex.Unlock()
+}
+
+// Healthy returns false if the last attempt to send a batch failed.
+func (s *ForwardSink) Healthy() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.healthy
+}
+
+// Stats returns the current statistics of the sink.
+func (s *ForwardSink) Stats() ForwardStats {
+	return ForwardStats{
+		Forwarded: s.forwarded.count(),
+		Dropped:   s.dropped.count(),
+		Buffered:  s.buffered.count(),
+		Lost:      s.lost.count(),
+		Errors:    s.errors.count(),
+	}
+}
+
+// Close sends queued records (or buffers them if the collector is not
+// available) and stops the sender goroutine.
+func (s *ForwardSink) Close() error {
+	s.queueMutex.Lock()
+	if s.closed {
+		s.queueMutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.queueMutex.Unlock()
+
+	<-s.stopped
+
+	return nil
+}
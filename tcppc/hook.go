@@ -0,0 +1,138 @@
+package tcppc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum number of finalised files waiting for the hook.
+	hookQueueSize = 1024
+	// Maximum number of attempts of the hook for each file.
+	hookMaxAttempts = 5
+	// Delay before the first retry of the hook (doubled on each retry).
+	hookRetryDelay = time.Second
+	// Maximum time for the hook to run.
+	hookTimeout = 5 * time.Minute
+)
+
+// FinalFile is a session file finalised by RotWriter.
+type FinalFile struct {
+	// Path of the file.
+	Path string
+	// Directory which does not depend on time or tokens in the filename
+	// format of the writer (see BaseDir).
+	BaseDir string
+	// Number of sessions and size in bytes of the file.
+	Sessions uint
+	Size     int64
+}
+
+// hookRunner invokes a command for each finalised file one by one.
+//
+// The command is split into fields (no shell syntax is supported), and the
+// path, the number of sessions and the size in bytes are appended to its
+// arguments. They are also given by environment variables TCPPC_FILE,
+// TCPPC_SESSIONS and TCPPC_BYTES. If the command fails, it is retried up to
+// hookMaxAttempts times.
+type hookRunner struct {
+	args  []string
+	queue chan FinalFile
+	// Closed when all files in the queue are processed.
+	done chan struct{}
+	// Number of failures of the hook.
+	errors *SessionCounter
+}
+
+// newHookRunner starts the goroutine which invokes the command. An error is
+// returned if the command is empty (e.g. only whitespace).
+func newHookRunner(cmd string, errors *SessionCounter) (*hookRunner, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Hook command is empty: %q", cmd)
+	}
+
+	h := &hookRunner{
+		args:   args,
+		queue:  make(chan FinalFile, hookQueueSize),
+		done:   make(chan struct{}),
+		errors: errors,
+	}
+
+	go h.run()
+
+	return h, nil
+}
+
+// enqueue requests to invoke the hook for the file without blocking.
+func (h *hookRunner) enqueue(f FinalFile) {
+	select {
+	case h.queue <- f:
+	default:
+		h.errors.inc()
+		log.Printf("Hook: queue is full, skipped: %s\n", f.Path)
+	}
+}
+
+// close waits for the hook to be invoked for all files in the queue.
+func (h *hookRunner) close() {
+	close(h.queue)
+	<-h.done
+}
+
+func (h *hookRunner) run() {
+	defer close(h.done)
+
+	for f := range h.queue {
+		delay := hookRetryDelay
+
+		for attempt := 1; ; attempt++ {
+			err := h.invoke(f)
+			if err == nil {
+				log.Printf("Hook: %s: exit status 0\n", f.Path)
+				break
+			}
+
+			h.errors.inc()
+
+			if attempt >= hookMaxAttempts {
+				log.Printf("Hook: %s: %s (gave up after %d attempts)\n", f.Path, err, attempt)
+				break
+			}
+
+			log.Printf("Hook: %s: %s (retry in %s)\n", f.Path, err, delay)
+
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (h *hookRunner) invoke(f FinalFile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	sessions := strconv.FormatUint(uint64(f.Sessions), 10)
+	size := strconv.FormatInt(f.Size, 10)
+
+	args := append(append([]string{}, h.args[1:]...), f.Path, sessions, size)
+
+	cmd := exec.CommandContext(ctx, h.args[0], args...)
+	cmd.Env = append(os.Environ(), "TCPPC_FILE="+f.Path, "TCPPC_SESSIONS="+sessions, "TCPPC_BYTES="+size)
+
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("Hook: %s: output: %s\n", f.Path, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to run the hook: %w", err)
+	}
+
+	return nil
+}
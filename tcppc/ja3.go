@@ -0,0 +1,280 @@
+package tcppc
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Maximum number of bytes recorded to find the ClientHello.
+	maxClientHelloSize = 16 * 1024
+
+	// TLS record and handshake types.
+	tlsRecordHandshake   = 22
+	tlsHandshakeHello    = 1
+	tlsRecordHeaderSize  = 5
+	tlsHandshakeHeadSize = 4
+
+	// TLS extensions used by JA3.
+	tlsExtServerName      = 0
+	tlsExtSupportedGroups = 10
+	tlsExtPointFormats    = 11
+)
+
+var errShortClientHello = errors.New("ClientHello is truncated.")
+
+// TLSInfo holds the attributes of the TLS handshake of a session.
+type TLSInfo struct {
+	// Negotiated version (e.g. "1.3") and cipher suite (empty if the
+	// handshake failed).
+	Version string `json:"version,omitempty"`
+	Cipher  string `json:"cipher,omitempty"`
+	// Server name (SNI) requested by the client.
+	ServerName string `json:"server_name,omitempty"`
+	// JA3 fingerprint of the ClientHello (https://github.com/salesforce/ja3)
+	// and the string from which it is computed.
+	JA3       string `json:"ja3,omitempty"`
+	JA3String string `json:"ja3_string,omitempty"`
+}
+
+// Names of TLS versions.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// newTLSInfo returns the attributes of the handshake from the state of the
+// connection and the raw ClientHello recorded by helloRecorder.
+func newTLSInfo(state tls.ConnectionState, hello []byte) *TLSInfo {
+	info := &TLSInfo{}
+
+	if state.HandshakeComplete {
+		info.Version = tlsVersionNames[state.Version]
+		info.Cipher = tls.CipherSuiteName(state.CipherSuite)
+		info.ServerName = state.ServerName
+	}
+
+	if ch, err := parseClientHello(hello); err == nil {
+		info.JA3String = ch.ja3String()
+		sum := md5.Sum([]byte(info.JA3String))
+		info.JA3 = hex.EncodeToString(sum[:])
+
+		if info.ServerName == "" {
+			info.ServerName = ch.serverName
+		}
+	}
+
+	return info
+}
+
+// helloRecorder is a connection which records the bytes read from it until
+// the ClientHello is received, so that it is fingerprinted even if the
+// handshake fails.
+type helloRecorder struct {
+	net.Conn
+	buf   []byte
+	done  bool
+	mutex sync.Mutex
+}
+
+func newHelloRecorder(conn net.Conn) *helloRecorder {
+	return &helloRecorder{Conn: conn}
+}
+
+func (r *helloRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.done && n > 0 {
+		r.buf = append(r.buf, b[:n]...)
+
+		_, perr := parseClientHello(r.buf)
+		if perr != errShortClientHello || len(r.buf) >= maxClientHelloSize {
+			r.done = true
+		}
+	}
+
+	return n, err
+}
+
+// clientHello returns the bytes recorded so far.
+func (r *helloRecorder) clientHello() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.buf
+}
+
+// clientHelloFields holds the fields of a ClientHello used by JA3.
+type clientHelloFields struct {
+	version      uint16
+	ciphers      []uint16
+	extensions   []uint16
+	curves       []uint16
+	pointFormats []uint8
+	serverName   string
+}
+
+// parseClientHello parses the ClientHello from TLS records. It returns
+// errShortClientHello if more bytes are needed.
+func parseClientHello(data []byte) (*clientHelloFields, error) {
+	// Reassemble the handshake message from (possibly fragmented) records.
+	var msg []byte
+	for {
+		if len(data) < tlsRecordHeaderSize {
+			return nil, errShortClientHello
+		}
+		if data[0] != tlsRecordHandshake {
+			return nil, errors.New("Not a TLS handshake record.")
+		}
+
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < tlsRecordHeaderSize+length {
+			return nil, errShortClientHello
+		}
+
+		msg = append(msg, data[tlsRecordHeaderSize:tlsRecordHeaderSize+length]...)
+		data = data[tlsRecordHeaderSize+length:]
+
+		if len(msg) >= tlsHandshakeHeadSize {
+			if msg[0] != tlsHandshakeHello {
+				return nil, errors.New("Not a ClientHello.")
+			}
+			msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+			if len(msg) >= tlsHandshakeHeadSize+msgLen {
+				msg = msg[tlsHandshakeHeadSize : tlsHandshakeHeadSize+msgLen]
+				break
+			}
+		}
+	}
+
+	p := &helloParser{data: msg}
+	ch := &clientHelloFields{}
+
+	ch.version = p.uint16()
+	p.skip(32)
+	p.skip(int(p.uint8()))
+
+	ciphers := p.bytes(int(p.uint16()))
+	for i := 0; i+1 < len(ciphers); i += 2 {
+		ch.ciphers = append(ch.ciphers, binary.BigEndian.Uint16(ciphers[i:]))
+	}
+
+	p.skip(int(p.uint8()))
+
+	// Extensions are optional.
+	if p.err == nil && len(p.data) > 0 {
+		exts := &helloParser{data: p.bytes(int(p.uint16()))}
+		for exts.err == nil && len(exts.data) > 0 {
+			extType := exts.uint16()
+			ext := &helloParser{data: exts.bytes(int(exts.uint16()))}
+			ch.extensions = append(ch.extensions, extType)
+
+			switch extType {
+			case tlsExtServerName:
+				list := &helloParser{data: ext.bytes(int(ext.uint16()))}
+				for list.err == nil && len(list.data) > 0 {
+					nameType := list.uint8()
+					name := list.bytes(int(list.uint16()))
+					if nameType == 0 && ch.serverName == "" {
+						ch.serverName = string(name)
+					}
+				}
+			case tlsExtSupportedGroups:
+				groups := ext.bytes(int(ext.uint16()))
+				for i := 0; i+1 < len(groups); i += 2 {
+					ch.curves = append(ch.curves, binary.BigEndian.Uint16(groups[i:]))
+				}
+			case tlsExtPointFormats:
+				ch.pointFormats = append(ch.pointFormats, ext.bytes(int(ext.uint8()))...)
+			}
+		}
+		if exts.err != nil {
+			return nil, exts.err
+		}
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return ch, nil
+}
+
+// ja3String returns the JA3 string: version, ciphers, extensions, curves and
+// point formats in decimal, excluding GREASE values.
+func (ch *clientHelloFields) ja3String() string {
+	join := func(values []uint16) string {
+		strs := make([]string, 0, len(values))
+		for _, v := range values {
+			if !isGREASE(v) {
+				strs = append(strs, strconv.Itoa(int(v)))
+			}
+		}
+		return strings.Join(strs, "-")
+	}
+
+	points := make([]uint16, len(ch.pointFormats))
+	for i, v := range ch.pointFormats {
+		points[i] = uint16(v)
+	}
+
+	return fmt.Sprintf("%d,%s,%s,%s,%s", ch.version, join(ch.ciphers), join(ch.extensions), join(ch.curves), join(points))
+}
+
+// isGREASE returns true if v is a GREASE value (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloParser reads big-endian fields of a handshake message. Once it runs
+// out of data, it keeps err and returns zero values.
+type helloParser struct {
+	data []byte
+	err  error
+}
+
+func (p *helloParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.data) < n {
+		p.err = errors.New("Malformed ClientHello.")
+		return nil
+	}
+	b := p.data[:n]
+	p.data = p.data[n:]
+	return b
+}
+
+func (p *helloParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *helloParser) uint8() uint8 {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *helloParser) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,163 @@
+package tcppc
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Overflow behaviours of Limiter.
+	// OverflowClose closes the connection immediately.
+	OverflowClose = "close"
+	// OverflowRecord closes the connection and records a minimal session
+	// (flow only) marked as rejected.
+	OverflowRecord = "record"
+
+	// Reasons why a connection is rejected.
+	RejectMaxConns       = "max_conns"
+	RejectMaxConnsPerSrc = "max_conns_per_src"
+	RejectRatePerSrc     = "rate_per_src"
+
+	// Interval to remove idle sources from Limiter.
+	limiterSweepInt = 60 * time.Second
+)
+
+type source struct {
+	// Number of concurrent connections from this source.
+	conns int
+	// Tokens left in the bucket of this source.
+	tokens float64
+	// Last time when tokens were refilled.
+	lstRefill time.Time
+}
+
+// Limiter limits the number of connections before handlers are spawned so
+// that floods from a few aggressive sources do not exhaust file descriptors.
+type Limiter struct {
+	// Maximum number of concurrent connections in total (0: unlimited).
+	MaxConns int
+	// Maximum number of concurrent connections per source IP (0: unlimited).
+	MaxConnsPerSrc int
+	// Number of new connections per second per source IP (0: unlimited).
+	RatePerSrc float64
+	// Bucket size of new connections per source IP.
+	BurstPerSrc int
+	// Behaviour when a connection exceeds the limits (OverflowClose or
+	// OverflowRecord).
+	Overflow string
+	// Number of current connections.
+	conns int
+	// Per-source states keyed on the source IP address.
+	sources map[string]*source
+	// Last time when idle sources were removed.
+	lstSweep time.Time
+	// Mutex object for exclusive control of the states.
+	mutex sync.Mutex
+}
+
+func NewLimiter(maxConns, maxConnsPerSrc int, ratePerSrc float64, burstPerSrc int, overflow string) *Limiter {
+	if burstPerSrc < 1 {
+		burstPerSrc = 1
+	}
+
+	return &Limiter{
+		MaxConns:       maxConns,
+		MaxConnsPerSrc: maxConnsPerSrc,
+		RatePerSrc:     ratePerSrc,
+		BurstPerSrc:    burstPerSrc,
+		Overflow:       overflow,
+		sources:        make(map[string]*source),
+		lstSweep:       time.Now(),
+	}
+}
+
+// RecordsOverflow returns true if rejected connections should be recorded.
+func (l *Limiter) RecordsOverflow() bool {
+	return l != nil && l.Overflow == OverflowRecord
+}
+
+func (l *Limiter) refill(s *source, now time.Time) {
+	if l.RatePerSrc <= 0 {
+		return
+	}
+
+	s.tokens += now.Sub(s.lstRefill).Seconds() * l.RatePerSrc
+	if s.tokens > float64(l.BurstPerSrc) {
+		s.tokens = float64(l.BurstPerSrc)
+	}
+	s.lstRefill = now
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for key, s := range l.sources {
+		l.refill(s, now)
+		if s.conns == 0 && (l.RatePerSrc <= 0 || s.tokens >= float64(l.BurstPerSrc)) {
+			delete(l.sources, key)
+		}
+	}
+
+	l.lstSweep = now
+}
+
+// Acquire reserves a connection slot for the given source IP.
+// It returns an empty string if the connection is accepted, or the reason
+// (Reject*) otherwise. Accepted connections must be released by Release.
+// A nil Limiter accepts all connections.
+func (l *Limiter) Acquire(ip net.IP) string {
+	if l == nil {
+		return ""
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lstSweep) > limiterSweepInt {
+		l.sweep(now)
+	}
+
+	if l.MaxConns > 0 && l.conns >= l.MaxConns {
+		return RejectMaxConns
+	}
+
+	key := ip.String()
+	s, ok := l.sources[key]
+	if !ok {
+		s = &source{tokens: float64(l.BurstPerSrc), lstRefill: now}
+		l.sources[key] = s
+	}
+
+	if l.MaxConnsPerSrc > 0 && s.conns >= l.MaxConnsPerSrc {
+		return RejectMaxConnsPerSrc
+	}
+
+	if l.RatePerSrc > 0 {
+		l.refill(s, now)
+		if s.tokens < 1 {
+			return RejectRatePerSrc
+		}
+		s.tokens -= 1
+	}
+
+	s.conns += 1
+	l.conns += 1
+
+	return ""
+}
+
+// Release frees the connection slot reserved by Acquire.
+func (l *Limiter) Release(ip net.IP) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.conns -= 1
+
+	if s, ok := l.sources[ip.String()]; ok {
+		s.conns -= 1
+	}
+}
@@ -0,0 +1,788 @@
+package tcppc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/jehiah/go-strftime"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of S3Options.
+	DefaultS3Region    = "us-east-1"
+	DefaultS3KeyPrefix = "tcppc/{sensor}/"
+	DefaultS3PartSize  = 16 * 1024 * 1024
+
+	// Minimum size of parts of multipart uploads (except the last one).
+	s3MinPartSize = 5 * 1024 * 1024
+	// Maximum number of finalised files waiting to be uploaded.
+	s3QueueSize = 1024
+	// Delay before the first retry of an upload (doubled on each retry up to
+	// s3MaxRetryDelay).
+	s3RetryDelay    = 5 * time.Second
+	s3MaxRetryDelay = time.Hour
+	// Timeout of a request.
+	s3RequestTimeout = 5 * time.Minute
+
+	// Signature Version 4.
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	s3Service   = "s3"
+	s3DateFmt   = "20060102T150405Z"
+)
+
+// errS3NoFile is returned when the file to upload does not exist any more.
+var errS3NoFile = errors.New("File does not exist.")
+
+// S3Options configures S3Uploader.
+type S3Options struct {
+	// Endpoint of the S3-compatible service (e.g.
+	// "https://s3.ap-northeast-1.amazonaws.com", "http://127.0.0.1:9000").
+	Endpoint string
+	// Region used for signatures ("": DefaultS3Region).
+	Region string
+	Bucket string
+	// Credentials (the session token is needed for temporary credentials
+	// only).
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Prefix of object keys w/ time indicators of strftime and TokenSensor
+	// ("": DefaultS3KeyPrefix). The path of the file relative to the base
+	// directory of its writer is appended to it.
+	KeyPrefix string
+	// True to put the bucket in the path ("<endpoint>/<bucket>/<key>", e.g.
+	// MinIO) instead of the hostname ("<bucket>.<endpoint host>/<key>").
+	PathStyle bool
+	// Size of parts of multipart uploads in bytes (0: DefaultS3PartSize).
+	// Smaller files are uploaded by a single request.
+	PartSize int64
+	// True to delete files after they are uploaded.
+	DeleteAfterUpload bool
+	// File where uploads which have not succeeded are kept across restarts
+	// (empty: they are lost on exit).
+	StateFile string
+	// Location used as timezone in KeyPrefix.
+	Location *time.Location
+	// Value of TokenSensor in KeyPrefix.
+	Sensor string
+	// HTTP client (nil: a client with s3RequestTimeout).
+	Client *http.Client
+}
+
+// S3Stats holds statistics of S3Uploader.
+type S3Stats struct {
+	// Number of files uploaded.
+	Uploaded uint
+	// Number of bytes uploaded.
+	Bytes uint
+	// Number of failed attempts of uploads.
+	Errors uint
+	// Number of files skipped because the queue is full or they vanished.
+	Skipped uint
+	// Number of files waiting to be uploaded.
+	Pending uint
+}
+
+// s3Upload is an upload of a file, which is kept in the state file until it
+// succeeds.
+type s3Upload struct {
+	Path string `json:"path"`
+	Key  string `json:"key"`
+	// Number of failed attempts, time of the next attempt and the last error.
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	// State of the multipart upload which is resumed by the next attempt.
+	UploadID string   `json:"upload_id,omitempty"`
+	PartSize int64    `json:"part_size,omitempty"`
+	Parts    []s3Part `json:"parts,omitempty"`
+}
+
+// s3Part is a part of a multipart upload.
+type s3Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// s3State is the content of the state file.
+type s3State struct {
+	Uploads []*s3Upload `json:"uploads"`
+}
+
+// s3Error is the error response of S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// S3Uploader uploads finalised files to a bucket of Amazon S3 or an
+// S3-compatible service (e.g. MinIO).
+//
+// Files are given by Enqueue (e.g. RotWriter.OnFinal) and uploaded one by
+// one by a single goroutine. Files larger than PartSize are uploaded by
+// multipart uploads. Requests are signed by Signature Version 4 with the
+// SHA-256 of the payload, and each request carries Content-MD5, so that the
+// service rejects corrupted data; the size of the object is checked after
+// the upload.
+//
+// Failed uploads are retried with exponential backoff until they succeed,
+// resuming multipart uploads from the last uploaded part. Uploads which have
+// not succeeded are kept in StateFile, so that they are resumed after
+// restarts.
+type S3Uploader struct {
+	opts     S3Options
+	endpoint *url.URL
+	// Finalised files waiting to be uploaded.
+	queue chan *s3Upload
+	// True if this uploader is closed (files are not queued any more).
+	closed bool
+	// Mutex object for exclusive control of closed and queue.
+	queueMutex sync.RWMutex
+	// Closed when the uploader goroutine exits.
+	stopped chan struct{}
+	// Uploads which have not succeeded (owned by the uploader goroutine).
+	pending []*s3Upload
+	// Statistics.
+	uploaded     *SessionCounter
+	bytes        *SessionCounter
+	errors       *SessionCounter
+	skipped      *SessionCounter
+	pendingCount *SessionCounter
+}
+
+// NewS3Uploader loads uploads in the state file and starts the uploader
+// goroutine.
+func NewS3Uploader(opts S3Options) (*S3Uploader, error) {
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid endpoint of S3: %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("Bucket of S3 is not given.")
+	}
+	if opts.Region == "" {
+		opts.Region = DefaultS3Region
+	}
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = DefaultS3KeyPrefix
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = DefaultS3PartSize
+	}
+	if opts.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("Part size of S3 must be at least %d bytes: %d", s3MinPartSize, opts.PartSize)
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: s3RequestTimeout}
+	}
+
+	u := &S3Uploader{
+		opts:         opts,
+		endpoint:     endpoint,
+		queue:        make(chan *s3Upload, s3QueueSize),
+		stopped:      make(chan struct{}),
+		uploaded:     NewSessionCounter(),
+		bytes:        NewSessionCounter(),
+		errors:       NewSessionCounter(),
+		skipped:      NewSessionCounter(),
+		pendingCount: NewSessionCounter(),
+	}
+
+	if err := u.loadState(); err != nil {
+		return nil, err
+	}
+
+	go u.run()
+
+	return u, nil
+}
+
+// loadState loads uploads which have not succeeded in the previous run.
+func (u *S3Uploader) loadState() error {
+	if u.opts.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(u.opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read state file of S3: %w", err)
+	}
+
+	var state s3State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("Failed to parse state file of S3: %s: %w", u.opts.StateFile, err)
+	}
+
+	for _, upload := range state.Uploads {
+		// Retry at once.
+		upload.NextAttempt = time.Time{}
+		u.pending = append(u.pending, upload)
+	}
+	u.pendingCount.add(uint(len(u.pending)))
+
+	if len(u.pending) > 0 {
+		log.Printf("S3: %d files left by the previous run will be uploaded.\n", len(u.pending))
+	}
+
+	return nil
+}
+
+// saveState writes uploads which have not succeeded to the state file
+// atomically.
+func (u *S3Uploader) saveState() {
+	if u.opts.StateFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(s3State{Uploads: u.pending})
+	if err != nil {
+		log.Printf("S3: failed to encode state: %s\n", err)
+		return
+	}
+
+	tmp := u.opts.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("S3: failed to write state file: %s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, u.opts.StateFile); err != nil {
+		log.Printf("S3: failed to write state file: %s\n", err)
+	}
+}
+
+// objectKey returns the key of the object of the file. A unique ID (ULID) is
+// inserted before the extensions of the filename (e.g.
+// "tcppc-20240101.01HVGQ1A2B3C4D5E6F7G8H9J0K.jsonl"), so that an object is
+// never overwritten even if a file of the same name is finalised again
+// (e.g. a database reopened after restarts).
+func (u *S3Uploader) objectKey(f FinalFile, t time.Time) string {
+	prefix := strings.Replace(u.opts.KeyPrefix, TokenSensor, sanitizeToken(u.opts.Sensor), -1)
+	prefix = strftime.Format(prefix, t.In(u.opts.Location))
+
+	rel, err := filepath.Rel(f.BaseDir, f.Path)
+	if err != nil || f.BaseDir == "" || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(f.Path)
+	}
+
+	dir, name := filepath.Split(filepath.ToSlash(rel))
+	id := newULID(t)
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i] + "." + id + name[i:]
+	} else {
+		name += "." + id
+	}
+
+	return prefix + dir + name
+}
+
+// Enqueue requests to upload the finalised file without blocking. Files
+// without sessions are not uploaded.
+func (u *S3Uploader) Enqueue(f FinalFile) {
+	if f.Sessions == 0 {
+		return
+	}
+
+	u.queueMutex.RLock()
+	defer u.queueMutex.RUnlock()
+
+	if u.closed {
+		u.skipped.inc()
+		log.Printf("S3: uploader is closed, skipped: %s\n", f.Path)
+		return
+	}
+
+	select {
+	case u.queue <- &s3Upload{Path: f.Path, Key: u.objectKey(f, time.Now())}:
+	default:
+		u.skipped.inc()
+		log.Printf("S3: queue is full, skipped: %s\n", f.Path)
+	}
+}
+
+// run uploads files until the uploader is closed. Files which are queued
+// before Close are tried once more before exit.
+func (u *S3Uploader) run() {
+	defer close(u.stopped)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case upload, ok := <-u.queue:
+			if !ok {
+				u.uploadDue(true)
+				u.saveState()
+				return
+			}
+
+			u.pending = append(u.pending, upload)
+			u.pendingCount.inc()
+			u.saveState()
+
+		case <-timer.C:
+		}
+
+		u.uploadDue(false)
+
+		// Wake up for the next retry.
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if wait, ok := u.nextWait(); ok {
+			timer.Reset(wait)
+		}
+	}
+}
+
+// nextWait returns the time until the next retry (false if no upload is
+// pending).
+func (u *S3Uploader) nextWait() (time.Duration, bool) {
+	var next time.Time
+	for _, upload := range u.pending {
+		if next.IsZero() || upload.NextAttempt.Before(next) {
+			next = upload.NextAttempt
+		}
+	}
+	if len(u.pending) == 0 {
+		return 0, false
+	}
+
+	wait := time.Until(next)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// uploadDue uploads files whose time of the next attempt has come. If
+// firstOnly is true, only files which have never been tried are uploaded.
+func (u *S3Uploader) uploadDue(firstOnly bool) {
+	uploads := u.pending
+	var remaining []*s3Upload
+
+	for i, upload := range uploads {
+		if time.Now().Before(upload.NextAttempt) || (firstOnly && upload.Attempts > 0) {
+			remaining = append(remaining, upload)
+			continue
+		}
+
+		size, err := u.upload(upload)
+		switch {
+		case err == nil:
+			u.uploaded.inc()
+			u.bytes.add(uint(size))
+			u.pendingCount.dec()
+			log.Printf("S3: uploaded: %s -> s3://%s/%s (%d bytes)\n", upload.Path, u.opts.Bucket, upload.Key, size)
+
+			if u.opts.DeleteAfterUpload {
+				if err := os.Remove(upload.Path); err != nil {
+					log.Printf("S3: failed to delete the uploaded file: %s\n", err)
+				}
+			}
+
+		case errors.Is(err, errS3NoFile):
+			u.skipped.inc()
+			u.pendingCount.dec()
+			log.Printf("S3: %s: %s (skipped)\n", upload.Path, err)
+
+		default:
+			u.errors.inc()
+
+			delay := s3RetryDelay << upload.Attempts
+			if delay > s3MaxRetryDelay || delay <= 0 {
+				delay = s3MaxRetryDelay
+			}
+			upload.Attempts += 1
+			upload.NextAttempt = time.Now().Add(delay)
+			upload.LastError = err.Error()
+			remaining = append(remaining, upload)
+
+			log.Printf("S3: %s: %s (retry in %s)\n", upload.Path, err, delay)
+		}
+
+		// Keep uploads which are not done in the state.
+		u.pending = append(append([]*s3Upload{}, remaining...), uploads[i+1:]...)
+		u.saveState()
+	}
+}
+
+// upload uploads the file by a single request or a multipart upload, and
+// returns its size.
+func (u *S3Uploader) upload(upload *s3Upload) (int64, error) {
+	f, err := os.Open(upload.Path)
+	if os.IsNotExist(err) {
+		return 0, errS3NoFile
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	if size <= u.opts.PartSize && upload.UploadID == "" {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := u.do(http.MethodPut, upload.Key, nil, data); err != nil {
+			return 0, err
+		}
+	} else {
+		if err := u.uploadMultipart(upload, f, size); err != nil {
+			return 0, err
+		}
+	}
+
+	// Make sure that the object is complete.
+	resp, err := u.do(http.MethodHead, upload.Key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if resp.contentLength != size {
+		return 0, fmt.Errorf("Size of the uploaded object does not match: %d (expected %d)", resp.contentLength, size)
+	}
+
+	return size, nil
+}
+
+// uploadMultipart uploads the file by a multipart upload. It resumes the
+// upload of the previous attempt (if any) from the next part.
+func (u *S3Uploader) uploadMultipart(upload *s3Upload, f *os.File, size int64) error {
+	if upload.UploadID == "" || upload.PartSize <= 0 || int64(len(upload.Parts))*upload.PartSize > size {
+		resp, err := u.do(http.MethodPost, upload.Key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+
+		var result s3InitiateResult
+		if err := xml.Unmarshal(resp.body, &result); err != nil || result.UploadID == "" {
+			return fmt.Errorf("Failed to parse response of CreateMultipartUpload: %s", resp.body)
+		}
+
+		upload.UploadID = result.UploadID
+		upload.PartSize = u.opts.PartSize
+		upload.Parts = nil
+		u.saveState()
+	}
+
+	buf := make([]byte, upload.PartSize)
+	for offset := int64(len(upload.Parts)) * upload.PartSize; offset < size; offset += upload.PartSize {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		number := len(upload.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload.UploadID}}
+
+		resp, err := u.do(http.MethodPut, upload.Key, query, buf[:n])
+		if err != nil {
+			var s3err *s3ResponseError
+			if errors.As(err, &s3err) && s3err.Code == "NoSuchUpload" {
+				// Start over by the next attempt.
+				upload.UploadID = ""
+				upload.Parts = nil
+			}
+			return err
+		}
+
+		upload.Parts = append(upload.Parts, s3Part{Number: number, ETag: resp.header.Get("ETag")})
+		u.saveState()
+	}
+
+	complete := s3CompleteRequest{}
+	for _, part := range upload.Parts {
+		complete.Parts = append(complete.Parts, s3CompletePart{PartNumber: part.Number, ETag: part.ETag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	if _, err := u.do(http.MethodPost, upload.Key, url.Values{"uploadId": {upload.UploadID}}, body); err != nil {
+		var s3err *s3ResponseError
+		if errors.As(err, &s3err) && s3err.Code == "NoSuchUpload" {
+			upload.UploadID = ""
+			upload.Parts = nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// s3Response is a successful response of S3.
+type s3Response struct {
+	header        http.Header
+	body          []byte
+	contentLength int64
+}
+
+// s3ResponseError is an error response of S3.
+type s3ResponseError struct {
+	Status  string
+	Code    string
+	Message string
+}
+
+func (e *s3ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed: %s", e.Status)
+	}
+	return fmt.Sprintf("S3 request failed: %s: %s: %s", e.Status, e.Code, e.Message)
+}
+
+// do sends a signed request for the object.
+func (u *S3Uploader) do(method, key string, query url.Values, body []byte) (*s3Response, error) {
+	req, err := u.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e := &s3ResponseError{Status: resp.Status}
+		var body s3Error
+		if xml.Unmarshal(data, &body) == nil {
+			e.Code, e.Message = body.Code, body.Message
+		}
+		return nil, e
+	}
+
+	// CompleteMultipartUpload may fail after "200 OK".
+	if method == http.MethodPost && bytes.Contains(data, []byte("<Error>")) {
+		var body s3Error
+		if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+			return nil, &s3ResponseError{Status: resp.Status, Code: body.Code, Message: body.Message}
+		}
+	}
+
+	return &s3Response{header: resp.Header, body: data, contentLength: resp.ContentLength}, nil
+}
+
+// newRequest returns a request for the object signed by Signature Version 4
+// (https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html).
+func (u *S3Uploader) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	host := u.endpoint.Host
+	path := strings.TrimRight(u.endpoint.Path, "/")
+	if u.opts.PathStyle {
+		path += "/" + s3Escape(u.opts.Bucket, false)
+	} else {
+		host = u.opts.Bucket + "." + host
+	}
+	path += "/" + s3Escape(key, true)
+
+	rawQuery := s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.endpoint.Scheme+"://"+host+path+s3QuerySuffix(rawQuery), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+
+	u.sign(req, path, rawQuery, body, time.Now())
+
+	return req, nil
+}
+
+// sign adds the headers of Signature Version 4 to the request whose
+// canonical (escaped) path and query are given.
+func (u *S3Uploader) sign(req *http.Request, path, rawQuery string, body []byte, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFmt)
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if u.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", u.opts.SessionToken)
+	}
+
+	// Canonical headers: host, Content-MD5 and x-amz-*.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + u.opts.Region + "/" + s3Service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+u.opts.SecretKey), date)
+	key = hmacSHA256(key, u.opts.Region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, u.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes the string as URI-encoded by Signature Version 4: all
+// bytes except unreserved characters (and '/' if keepSlash is true) are
+// percent-encoded.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery returns the query string sorted by names and escaped.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func s3QuerySuffix(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	return "?" + rawQuery
+}
+
+// Stats returns the current statistics of the uploader.
+func (u *S3Uploader) Stats() S3Stats {
+	return S3Stats{
+		Uploaded: u.uploaded.count(),
+		Bytes:    u.bytes.count(),
+		Errors:   u.errors.count(),
+		Skipped:  u.skipped.count(),
+		Pending:  u.pendingCount.count(),
+	}
+}
+
+// Close uploads files which are queued but have never been tried, saves the
+// state and stops the uploader goroutine. Files which can not be uploaded
+// are left in the state file.
+func (u *S3Uploader) Close() error {
+	u.queueMutex.Lock()
+	if u.closed {
+		u.queueMutex.Unlock()
+		return nil
+	}
+	u.closed = true
+	close(u.queue)
+	u.queueMutex.Unlock()
+
+	<-u.stopped
+
+	return nil
+}
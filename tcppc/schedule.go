@@ -0,0 +1,205 @@
+package tcppc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule determines when RotWriter rotates files.
+type Schedule interface {
+	// Next returns the first rotation time after t.
+	Next(t time.Time) time.Time
+}
+
+// IntervalSchedule rotates files every Interval seconds with Offset seconds
+// offset from the unix epoch (e.g. 86400 and 0 rotate at 00:00 UTC).
+type IntervalSchedule struct {
+	Interval int64
+	Offset   int64
+}
+
+func NewIntervalSchedule(interval, offset int) *IntervalSchedule {
+	return &IntervalSchedule{
+		Interval: int64(interval),
+		Offset:   int64(offset),
+	}
+}
+
+func (s *IntervalSchedule) Next(t time.Time) time.Time {
+	cur := t.Unix() - s.Offset
+	next := (cur/s.Interval+1)*s.Interval + s.Offset
+
+	// Round towards negative infinity for times before the offset.
+	if cur < 0 && cur%s.Interval != 0 {
+		next -= s.Interval
+	}
+
+	return time.Unix(next, 0).In(t.Location())
+}
+
+// CronSchedule rotates files at times matching a cron expression.
+type CronSchedule struct {
+	// Bitsets of allowed values of each field.
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// True if the field is restricted (not "*"). As in cron, a time matches
+	// if either the day of month or the day of week matches when both are
+	// restricted.
+	domRestricted bool
+	dowRestricted bool
+}
+
+// Descriptors of cron expressions.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression of 5 fields (minute, hour, day of month,
+// month and day of week) or a descriptor such as "@daily". Each field
+// supports "*", numbers, ranges ("1-5"), lists ("1,15") and steps ("*/10").
+// Names of months and days of week are not supported.
+func ParseCron(spec string) (*CronSchedule, error) {
+	if d, ok := cronDescriptors[strings.TrimSpace(spec)]; ok {
+		spec = d
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron expression (5 fields are required): %q", spec)
+	}
+
+	s := &CronSchedule{}
+
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("Invalid minute field: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("Invalid hour field: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("Invalid day of month field: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("Invalid month field: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("Invalid day of week field: %w", err)
+	}
+
+	// Both 0 and 7 are Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1 << 0
+	}
+
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("Cron expression never matches: %q", spec)
+	}
+
+	return s, nil
+}
+
+// parseCronField returns the bitset of values of a field between min and max.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, expr := range strings.Split(field, ",") {
+		rng, step := expr, 1
+		if i := strings.Index(expr, "/"); i >= 0 {
+			n, err := strconv.Atoi(expr[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step: %q", expr)
+			}
+			rng, step = expr[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			if i := strings.Index(rng, "-"); i >= 0 {
+				if lo, err = strconv.Atoi(rng[:i]); err != nil {
+					return 0, fmt.Errorf("invalid range: %q", expr)
+				}
+				if hi, err = strconv.Atoi(rng[i+1:]); err != nil {
+					return 0, fmt.Errorf("invalid range: %q", expr)
+				}
+			} else {
+				if lo, err = strconv.Atoi(rng); err != nil {
+					return 0, fmt.Errorf("invalid value: %q", expr)
+				}
+				hi = lo
+				// "5/10" means from 5 to max every 10.
+				if step > 1 {
+					hi = max
+				}
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("out of range (%d-%d): %q", min, max, expr)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+
+	// Start from the next minute.
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	// No time matches (e.g. "0 0 31 2 *").
+	return time.Time{}
+}
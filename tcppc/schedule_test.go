@@ -0,0 +1,120 @@
+package tcppc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIntervalScheduleNext(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+
+	tests := []struct {
+		name     string
+		interval int
+		offset   int
+		t        time.Time
+		want     time.Time
+	}{
+		{"hourly", 3600, 0, time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC), time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)},
+		{"on boundary", 3600, 0, time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)},
+		{"daily at 00:00 JST", 86400, -9 * 3600, time.Date(2024, 1, 2, 1, 0, 0, 0, jst), time.Date(2024, 1, 3, 0, 0, 0, 0, jst)},
+		{"before offset", 60, 30, time.Unix(10, 0).UTC(), time.Unix(30, 0).UTC()},
+		{"before epoch", 60, 0, time.Unix(-30, 0).UTC(), time.Unix(0, 0).UTC()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewIntervalSchedule(tt.interval, tt.offset).Next(tt.t)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.t, got, tt.want)
+			}
+			if got.Location() != tt.t.Location() {
+				t.Errorf("Location = %s, want %s", got.Location(), tt.t.Location())
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@reboot",
+		// February 31st never comes.
+		"0 0 31 2 *",
+	} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	date := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec string
+		t    time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", date(2024, 1, 1, 10, 7).Add(30 * time.Second), date(2024, 1, 1, 10, 15)},
+		{"0 * * * *", date(2024, 1, 1, 10, 0), date(2024, 1, 1, 11, 0)},
+		{"5/20 * * * *", date(2024, 1, 1, 10, 6), date(2024, 1, 1, 10, 25)},
+		{"0,30 9-17 * * *", date(2024, 1, 1, 17, 30), date(2024, 1, 2, 9, 0)},
+		{"30 9 * * *", date(2024, 1, 31, 10, 0), date(2024, 2, 1, 9, 30)},
+		{"@daily", date(2024, 1, 1, 10, 0), date(2024, 1, 2, 0, 0)},
+		{"@yearly", date(2024, 6, 1, 0, 0), date(2025, 1, 1, 0, 0)},
+		{"0 0 29 2 *", date(2024, 3, 1, 0, 0), date(2028, 2, 29, 0, 0)},
+		// 2024-01-06 is Saturday.
+		{"0 12 * * 1-5", date(2024, 1, 6, 0, 0), date(2024, 1, 8, 12, 0)},
+		// Both 0 and 7 are Sunday.
+		{"0 0 * * 7", date(2024, 1, 1, 0, 0), date(2024, 1, 7, 0, 0)},
+		// Either the day of month or the day of week matches (Friday).
+		{"0 0 13 * 5", date(2024, 1, 1, 0, 0), date(2024, 1, 5, 0, 0)},
+		{"0 0 13 * 5", date(2024, 1, 12, 0, 0), date(2024, 1, 13, 0, 0)},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", tt.spec, err)
+		}
+		if got := s.Next(tt.t); !got.Equal(tt.want) {
+			t.Errorf("Next(%s) of %q = %s, want %s", tt.t, tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestCronScheduleNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Timezone database is not available: %s", err)
+	}
+
+	s, err := ParseCron("@hourly")
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+
+	// Hours are not skipped or repeated in absolute time when clocks are
+	// set forward (2024-03-10 02:00) or back (2024-11-03 02:00).
+	for _, start := range []time.Time{
+		time.Date(2024, 3, 10, 1, 30, 0, 0, loc),
+		time.Date(2024, 11, 3, 1, 30, 0, 0, loc),
+	} {
+		if got, want := s.Next(start), start.Add(30*time.Minute); !got.Equal(want) {
+			t.Errorf("Next(%s) = %s, want %s", start, got, want)
+		}
+	}
+}
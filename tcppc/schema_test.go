@@ -0,0 +1,187 @@
+package tcppc
+
+import (
+	"encoding/json"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compileSchema compiles the JSON Schema of records in ../schema. Both
+// schemas are added as resources by their $id, so that references between
+// them are resolved without network access.
+func compileSchema(t *testing.T, name string) *jsonschema.Schema {
+	t.Helper()
+
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.AssertFormat = true
+
+	var target string
+	for _, file := range []string{"session.v1.schema.json", "event.v1.schema.json"} {
+		data, err := os.ReadFile(filepath.Join("..", "schema", file))
+		if err != nil {
+			t.Fatalf("Failed to read the schema: %s", err)
+		}
+
+		var schema struct {
+			ID string `json:"$id"`
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("Failed to parse the schema: %s: %s", file, err)
+		}
+
+		if err := c.AddResource(schema.ID, strings.NewReader(string(data))); err != nil {
+			t.Fatalf("Failed to add the schema: %s: %s", file, err)
+		}
+		if file == name {
+			target = schema.ID
+		}
+	}
+
+	schema, err := c.Compile(target)
+	if err != nil {
+		t.Fatalf("Failed to compile the schema: %s: %s", name, err)
+	}
+
+	return schema
+}
+
+// validateRecord validates the record encoded by the native formatter.
+func validateRecord(t *testing.T, schema *jsonschema.Schema, name string, data []byte) {
+	t.Helper()
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s: Failed to decode the record: %s", name, err)
+	}
+
+	if err := schema.Validate(v); err != nil {
+		t.Errorf("%s: Record does not match the schema: %#v\n%s", name, err, data)
+	}
+}
+
+// testSessions returns representative sessions: TCP, TLS, UDP, truncated by
+// session limits and rejected by connection limits.
+func testSessions() map[string]*Session {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 23}
+	sensor := &SensorInfo{Name: "sensor-1", Tags: []string{"tokyo", "cloud"}}
+	listener := &ListenerInfo{Name: "tcp", Addr: "0.0.0.0:12345"}
+
+	newSession := func(flow *Flow) *Session {
+		session := NewSession(flow)
+		session.CommunityID = flow.CommunityID(0)
+		session.Sensor = sensor
+		session.Listener = listener
+		return session
+	}
+	end := func(session *Session) *Session {
+		ts := session.Timestamp.Add(time.Second)
+		session.EndTimestamp = &ts
+		return session
+	}
+
+	tcp := newSession(NewTCPFlow(src, dst))
+	tcp.AddPayload([]byte("root\r\n"))
+	tcp.AddPayload([]byte{0xff, 0xfb, 0x01, 0x00})
+
+	tlsSession := newSession(NewTLSFlow(src, &net.TCPAddr{IP: dst.IP, Port: 443}))
+	tlsSession.TLS = &TLSInfo{
+		Version:    "1.3",
+		Cipher:     "TLS_AES_128_GCM_SHA256",
+		ServerName: "example.com",
+		JA3:        "e7d705a3286e19ea42f587b344ee6865",
+		JA3String:  "771,4865-4866-4867,0-23-65281,29-23-24,0",
+	}
+	tlsSession.AddPayload([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	udp := newSession(NewUDPFlow(&net.UDPAddr{IP: src.IP, Port: 5353}, &net.UDPAddr{IP: dst.IP, Port: 53}))
+	udp.Listener = &ListenerInfo{Name: "udp", Addr: "0.0.0.0:12345"}
+	udp.AddPayload([]byte("\x12\x34\x01\x00"))
+
+	truncated := newSession(NewTCPFlow(src, dst))
+	truncated.AddPayload([]byte(strings.Repeat("A", 1024)))
+	truncated.Truncated = true
+	truncated.MaxDuration = true
+
+	rejected := newSession(NewTCPFlow(src, dst))
+	rejected.Rejected = "max_conns_per_src"
+
+	empty := NewSession(NewTCPFlow(src, dst))
+
+	return map[string]*Session{
+		"tcp":       end(tcp),
+		"tls":       end(tlsSession),
+		"udp":       end(udp),
+		"truncated": end(truncated),
+		"rejected":  end(rejected),
+		"minimal":   end(empty),
+	}
+}
+
+func TestSessionSchema(t *testing.T) {
+	schema := compileSchema(t, "session.v1.schema.json")
+
+	for name, session := range testSessions() {
+		data, err := nativeFormatter{}.FormatSession(session)
+		if err != nil {
+			t.Fatalf("%s: Failed to encode the session: %s", name, err)
+		}
+
+		validateRecord(t, schema, name, data)
+	}
+}
+
+func TestEventSchema(t *testing.T) {
+	schema := compileSchema(t, "event.v1.schema.json")
+
+	for name, session := range testSessions() {
+		events := []*Event{NewSessionStartEvent(session)}
+		for _, payload := range session.Payloads {
+			events = append(events, NewPayloadEvent(session, payload))
+		}
+		events = append(events, NewSessionEndEvent(session))
+
+		for _, event := range events {
+			data, err := nativeFormatter{}.FormatEvent(event)
+			if err != nil {
+				t.Fatalf("%s: Failed to encode the event: %s", name, err)
+			}
+
+			validateRecord(t, schema, name+"/"+event.Type, data)
+		}
+	}
+}
+
+// TestSchemaRejects makes sure that the schemas are actually checked, i.e.
+// records which break them are rejected.
+func TestSchemaRejects(t *testing.T) {
+	sessionSchema := compileSchema(t, "session.v1.schema.json")
+	eventSchema := compileSchema(t, "event.v1.schema.json")
+
+	tests := []struct {
+		name   string
+		schema *jsonschema.Schema
+		record string
+	}{
+		{"session w/o flow", sessionSchema, `{"schema_version": 1, "timestamp": "2024-01-01T00:00:00Z", "payloads": null}`},
+		{"session of another version", sessionSchema, `{"schema_version": 2, "timestamp": "2024-01-01T00:00:00Z", "flow": {"proto": "tcp", "src": "192.0.2.1", "sport": 1, "dst": "198.51.100.1", "dport": 23}, "payloads": null}`},
+		{"event of unknown type", eventSchema, `{"schema_version": 1, "type": "unknown", "session_id": "01HVGQ1A2B3C4D5E6F7G8H9J0K", "timestamp": "2024-01-01T00:00:00Z", "flow": {"proto": "tcp", "src": "192.0.2.1", "sport": 1, "dst": "198.51.100.1", "dport": 23}}`},
+		{"payload event w/o payload", eventSchema, `{"schema_version": 1, "type": "payload", "session_id": "01HVGQ1A2B3C4D5E6F7G8H9J0K", "timestamp": "2024-01-01T00:00:00Z", "flow": {"proto": "tcp", "src": "192.0.2.1", "sport": 1, "dst": "198.51.100.1", "dport": 23}}`},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.record), &v); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if err := tt.schema.Validate(v); err == nil {
+			t.Errorf("%s: Record is accepted by the schema.", tt.name)
+		}
+	}
+}
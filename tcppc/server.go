@@ -0,0 +1,524 @@
+package tcppc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Number of rejected connections which can wait to be recorded. Rejected
+// connections are not recorded while the queue is full (e.g. during floods
+// of connections with blocking sinks).
+const rejectQueueSize = 1024
+
+// Default idle timeout of TCP/TLS sessions (Options.Timeout).
+const DefaultTimeout = 60 * time.Second
+
+// Hooks are callbacks invoked as sessions happen.
+//
+// Hooks of a TCP/TLS session are called one by one from the goroutine which
+// handles the session: OnSessionStart when the session is established,
+// OnPayload for each payload in order, and OnSessionEnd after the session is
+// written. OnUDPDatagram is called once for each UDP datagram after it is
+// written. Hooks of different sessions are called concurrently, so they must
+// be safe for concurrent use. Hooks block the handler of the session, so
+// slow work should be handed off to other goroutines. The Session and
+// Payload objects must not be modified. The Session keeps being updated by
+// the handler until OnSessionEnd is called, so hooks which hand it off to
+// other goroutines before that must copy what they need.
+// Connections rejected by Limiter are not reported.
+type Hooks struct {
+	OnSessionStart func(session *Session)
+	OnPayload      func(session *Session, payload *Payload)
+	OnSessionEnd   func(session *Session)
+	OnUDPDatagram  func(session *Session)
+}
+
+// Options configures Server.
+type Options struct {
+	// Hostname to listen on.
+	Host string
+	// Port number to listen on.
+	Port int
+	// TLS configuration. If it is not nil, the server works as TLS
+	// handshaker instead of TCP handshaker.
+	TLSConfig *tls.Config
+	// True to disable TCP/TLS server.
+	DisableTCP bool
+	// True to disable UDP server.
+	DisableUDP bool
+	// Idle timeout of TCP/TLS sessions (0: DefaultTimeout).
+	Timeout time.Duration
+	// Writer of session data in the native format (nil: not used). It is
+	// the same as a FileSink in Sinks.
+	Writer *RotWriter
+	// Destinations of session data.
+	Sinks []Sink
+	// Output mode of session data: OutputSessions (default) or OutputEvents.
+	Output string
+	// Seed of Community ID of sessions (0 by default as in Zeek and
+	// Suricata).
+	CommunityIDSeed uint16
+	// Sensor written in each session (nil: not written).
+	Sensor *SensorInfo
+	// Names of listeners written in each session ("tcp" and "udp" by
+	// default).
+	TCPListenerName string
+	UDPListenerName string
+	// Connection limits of TCP/TLS server (nil: unlimited).
+	Limiter *Limiter
+	// Session limits of TCP/TLS server (nil: unlimited).
+	Limits *SessionLimits
+	// Pre-opened listeners (e.g. by systemd socket activation). If they are
+	// nil, listeners are bound to Host and Port.
+	TCPListener *net.TCPListener
+	UDPConn     *net.UDPConn
+	// Callbacks invoked as sessions happen (nil fields are ignored).
+	Hooks Hooks
+}
+
+// Stats holds statistics of Server.
+type Stats struct {
+	// Number of active TCP/TLS sessions.
+	ActiveSessions uint
+	// Number of TCP/TLS sessions accepted.
+	Sessions uint
+	// Number of UDP datagrams received.
+	Datagrams uint
+	// Number of connections rejected by Limiter.
+	Rejected uint
+	// Number of rejected connections which are not recorded because too
+	// many of them are waiting to be recorded.
+	RejectedDropped uint
+	// Number of errors on accepting connections.
+	AcceptErrors uint
+}
+
+// Server captures payloads of TCP/TLS sessions and UDP datagrams.
+type Server struct {
+	opts Options
+	// Destinations of session data (Writer and Sinks of opts).
+	sinks []Sink
+	// Listeners bound by Listen.
+	tcpLn *net.TCPListener
+	udpLn *net.UDPConn
+	// True if listeners are bound.
+	bound bool
+	// Listeners written in each session.
+	tcpInfo *ListenerInfo
+	udpInfo *ListenerInfo
+	// Closed when all listeners are bound.
+	ready chan struct{}
+	// Active TCP/TLS connections closed on shutdown.
+	conns map[net.Conn]struct{}
+	// True if the server is shutting down.
+	closing bool
+	// Closed when the server is shutting down.
+	done chan struct{}
+	// Mutex object for exclusive control of conns and closing.
+	mutex sync.Mutex
+	// WaitGroup of session handlers.
+	handlers sync.WaitGroup
+	// Rejected connections waiting to be recorded.
+	rejects chan *Session
+	// Backoffs of accept loops used to check health.
+	backoffs []*acceptBackoff
+	// Statistics.
+	active       *SessionCounter
+	sessions     *SessionCounter
+	datagrams    *SessionCounter
+	rejected     *SessionCounter
+	rejectDrops  *SessionCounter
+	acceptErrors *SessionCounter
+}
+
+func NewServer(opts Options) *Server {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	var sinks []Sink
+	if opts.Writer != nil {
+		sinks = append(sinks, NewFileSink(opts.Writer, nativeFormatter{}))
+	}
+	sinks = append(sinks, opts.Sinks...)
+
+	return &Server{
+		opts:         opts,
+		sinks:        sinks,
+		ready:        make(chan struct{}),
+		done:         make(chan struct{}),
+		conns:        make(map[net.Conn]struct{}),
+		rejects:      make(chan *Session, rejectQueueSize),
+		active:       NewSessionCounter(),
+		sessions:     NewSessionCounter(),
+		datagrams:    NewSessionCounter(),
+		rejected:     NewSessionCounter(),
+		rejectDrops:  NewSessionCounter(),
+		acceptErrors: NewSessionCounter(),
+	}
+}
+
+// Ready returns a channel which is closed when all listeners are bound and
+// Serve starts accepting connections.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Stats returns the current statistics of the server.
+func (s *Server) Stats() Stats {
+	return Stats{
+		ActiveSessions:  s.active.count(),
+		Sessions:        s.sessions.count(),
+		Datagrams:       s.datagrams.count(),
+		Rejected:        s.rejected.count(),
+		RejectedDropped: s.rejectDrops.count(),
+		AcceptErrors:    s.acceptErrors.count(),
+	}
+}
+
+// Listen binds listeners (or takes the pre-opened ones) without accepting
+// connections, so that privileges can be dropped and the process can be
+// sandboxed before any connection is handled. If it fails, the listeners are
+// closed. Serve calls it if it is not called beforehand. Listen must not be
+// called concurrently with Serve.
+func (s *Server) Listen() error {
+	if s.bound {
+		return nil
+	}
+
+	if s.opts.DisableTCP && s.opts.DisableUDP {
+		return errors.New("Both TCP/TLS and UDP servers are disabled.")
+	}
+
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	s.bound = true
+
+	return nil
+}
+
+// Serve binds listeners (unless Listen is called) and serves until ctx is
+// done or a server fails. On return, all listeners are closed and all
+// sessions are written. Serve must be called only once.
+func (s *Server) Serve(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	close(s.ready)
+
+	if s.opts.Limiter.RecordsOverflow() {
+		s.handlers.Add(1)
+		go s.recordRejected()
+	}
+
+	errc := make(chan error, 2)
+	numServers := 0
+
+	if s.tcpLn != nil {
+		numServers += 1
+		if s.opts.TLSConfig != nil {
+			go func() { errc <- s.serveTLS(s.tcpLn) }()
+		} else {
+			go func() { errc <- s.serveTCP(s.tcpLn) }()
+		}
+	}
+	if s.udpLn != nil {
+		numServers += 1
+		go func() { errc <- s.serveUDP(s.udpLn) }()
+	}
+
+	var err error
+
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+		numServers -= 1
+	}
+
+	s.shutdown()
+
+	for ; numServers > 0; numServers-- {
+		<-errc
+	}
+	// No connection is rejected any more after accept loops exit.
+	close(s.rejects)
+	s.handlers.Wait()
+
+	log.Printf("Server stopped.\n")
+
+	return err
+}
+
+func (s *Server) listen() error {
+	var err error
+
+	if !s.opts.DisableTCP {
+		if s.opts.TCPListener != nil {
+			log.Printf("Listen: %s (TCP, pre-opened)\n", s.opts.TCPListener.Addr())
+			s.tcpLn = s.opts.TCPListener
+			err = setTransparent(s.tcpLn)
+		} else {
+			s.tcpLn, err = listenTCP(s.opts.Host, s.opts.Port)
+		}
+		if err != nil {
+			return err
+		}
+
+		s.tcpInfo = newListenerInfo(s.opts.TCPListenerName, "tcp", s.tcpLn.Addr())
+	}
+
+	if !s.opts.DisableUDP {
+		if s.opts.UDPConn != nil {
+			log.Printf("Listen: %s (UDP, pre-opened)\n", s.opts.UDPConn.LocalAddr())
+			s.udpLn = s.opts.UDPConn
+			err = setTransparent(s.udpLn)
+		} else {
+			s.udpLn, err = listenUDP(s.opts.Host, s.opts.Port)
+		}
+		if err != nil {
+			return err
+		}
+
+		s.udpInfo = newListenerInfo(s.opts.UDPListenerName, "udp", s.udpLn.LocalAddr())
+	}
+
+	return nil
+}
+
+func newListenerInfo(name, defaultName string, addr net.Addr) *ListenerInfo {
+	if name == "" {
+		name = defaultName
+	}
+
+	return &ListenerInfo{Name: name, Addr: addr.String()}
+}
+
+func (s *Server) closeListeners() {
+	if s.tcpLn != nil {
+		s.tcpLn.Close()
+	}
+	if s.udpLn != nil {
+		s.udpLn.Close()
+	}
+}
+
+// shutdown closes listeners and makes active sessions finish immediately.
+func (s *Server) shutdown() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closing = true
+	close(s.done)
+	s.closeListeners()
+
+	for conn := range s.conns {
+		conn.SetDeadline(time.Now())
+	}
+}
+
+// trackConn registers an active connection. It returns false if the server
+// is shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closing {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.conns, conn)
+	s.handlers.Done()
+}
+
+// newAcceptBackoff returns a backoff of an accept loop whose health is
+// reported by Healthy.
+func (s *Server) newAcceptBackoff(name string) *acceptBackoff {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := &acceptBackoff{name: name, errors: s.acceptErrors}
+	s.backoffs = append(s.backoffs, b)
+
+	return b
+}
+
+// Healthy returns false if the server is not serving or accepting
+// connections keeps failing (e.g. file descriptors are exhausted).
+func (s *Server) Healthy() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.ready:
+	default:
+		return false
+	}
+
+	if s.closing {
+		return false
+	}
+
+	for _, b := range s.backoffs {
+		if !b.healthy() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Server) isClosing() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closing
+}
+
+// setTransparent enables TPROXY and original destination addresses on the
+// socket of the listener.
+func setTransparent(sc syscall.Conn) error {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("Failed to get a file descriptor of the listener: %w", err)
+	}
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		// Pre-opened sockets may already be transparent (e.g. Transparent=yes
+		// of systemd), which can not be set again without CAP_NET_ADMIN.
+		if v, err := syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT); err != nil || v != 1 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+				sockErr = fmt.Errorf("Failed to set socket option (IP_TRANSPARENT): %w", err)
+				return
+			}
+		}
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+			sockErr = fmt.Errorf("Failed to set socket option (IP_RECVORIGDSTADDR): %w", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// newSession returns a new session of the flow with its Community ID, the
+// sensor and the listener.
+func (s *Server) newSession(flow *Flow) *Session {
+	session := NewSession(flow)
+	session.CommunityID = flow.CommunityID(s.opts.CommunityIDSeed)
+	session.Sensor = s.opts.Sensor
+
+	if flow.Proto == "udp" {
+		session.Listener = s.udpInfo
+	} else {
+		session.Listener = s.tcpInfo
+	}
+
+	return session
+}
+
+// rejectSession counts a connection rejected by Limiter and queues it to be
+// recorded if the overflow behaviour is OverflowRecord. It never blocks the
+// accept loop: the connection is not recorded if the queue is full.
+func (s *Server) rejectSession(flow *Flow, reason string) {
+	s.rejected.inc()
+
+	if !s.opts.Limiter.RecordsOverflow() {
+		return
+	}
+
+	session := s.newSession(flow)
+	session.Rejected = reason
+
+	log.Printf("Rejected: %s: %s\n", session, reason)
+
+	select {
+	case s.rejects <- session:
+	default:
+		s.rejectDrops.inc()
+	}
+}
+
+// recordRejected writes rejected connections one by one until the queue is
+// closed on shutdown.
+func (s *Server) recordRejected() {
+	defer s.handlers.Done()
+
+	for session := range s.rejects {
+		s.writeEvent(NewSessionStartEvent(session))
+		s.writeSession(session)
+	}
+}
+
+// writeEvent writes an event to the sinks if the output mode is
+// OutputEvents. It returns true if the event is written to all sinks.
+func (s *Server) writeEvent(event *Event) bool {
+	if len(s.sinks) == 0 || s.opts.Output != OutputEvents {
+		return false
+	}
+
+	ok := true
+	for _, sink := range s.sinks {
+		if err := sink.WriteEvent(event); err != nil {
+			log.Printf("Failed to write data: %s: %s (%s)\n", sink.Name(), event, err)
+			ok = false
+		}
+	}
+
+	return ok
+}
+
+// writeSession writes session data to the sinks (if any). If the output mode
+// is OutputEvents, it writes the session_end event instead.
+func (s *Server) writeSession(session *Session) {
+	if session.EndTimestamp == nil {
+		now := time.Now()
+		session.EndTimestamp = &now
+	}
+
+	if len(s.sinks) == 0 {
+		return
+	}
+
+	if s.opts.Output == OutputEvents {
+		if s.writeEvent(NewSessionEndEvent(session)) {
+			log.Printf("Wrote data: %s\n", session)
+		}
+		return
+	}
+
+	ok := true
+	for _, sink := range s.sinks {
+		if err := sink.WriteSession(session); err != nil {
+			log.Printf("Failed to write data: %s: %s (%s)\n", sink.Name(), session, err)
+			ok = false
+		}
+	}
+
+	if ok {
+		log.Printf("Wrote data: %s\n", session)
+	}
+}
@@ -0,0 +1,273 @@
+package tcppc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memSink keeps sessions and events written by Server in memory.
+type memSink struct {
+	sessions []*Session
+	events   []*Event
+	mutex    sync.Mutex
+}
+
+func (s *memSink) Name() string {
+	return "memory"
+}
+
+func (s *memSink) WriteSession(session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions = append(s.sessions, session)
+	return nil
+}
+
+func (s *memSink) WriteEvent(event *Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memSink) Close() error {
+	return nil
+}
+
+// startServer starts the server on 127.0.0.1 with random ports. It returns
+// the cancel function of Serve and the channel of its result.
+func startServer(t *testing.T, server *Server) (context.CancelFunc, <-chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(ctx) }()
+
+	select {
+	case <-server.Ready():
+	case err := <-errc:
+		cancel()
+		// Listeners need IP_TRANSPARENT, which requires CAP_NET_ADMIN, and
+		// IP_RECVORIGDSTADDR, which some kernels (e.g. gVisor) lack.
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOPROTOOPT) {
+			t.Skipf("Listeners can not be transparent: %s", err)
+		}
+		t.Fatalf("Serve failed: %s", err)
+	case <-time.After(5 * time.Second):
+		cancel()
+		t.Fatal("Server is not ready.")
+	}
+
+	return cancel, errc
+}
+
+func stopServer(t *testing.T, cancel context.CancelFunc, errc <-chan error) {
+	t.Helper()
+
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Serve failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the context is canceled.")
+	}
+}
+
+func TestServerServeAndShutdown(t *testing.T) {
+	sink := &memSink{}
+	payloads := make(chan string, 16)
+
+	server := NewServer(Options{
+		Host:    "127.0.0.1",
+		Timeout: time.Minute,
+		Sinks:   []Sink{sink},
+		Hooks: Hooks{
+			OnPayload: func(session *Session, payload *Payload) {
+				payloads <- string(payload.Data)
+			},
+			OnUDPDatagram: func(session *Session) {
+				payloads <- string(session.Payloads[0].Data)
+			},
+		},
+	})
+
+	cancel, errc := startServer(t, server)
+
+	// TCP sessions which are still active when the context is canceled.
+	const numSessions = 3
+	for i := 0; i < numSessions; i++ {
+		conn, err := net.Dial("tcp", server.tcpLn.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %s", err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Failed to send: %s", err)
+		}
+	}
+
+	udp, err := net.Dial("udp", server.udpLn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer udp.Close()
+
+	if _, err := udp.Write([]byte("datagram")); err != nil {
+		t.Fatalf("Failed to send: %s", err)
+	}
+
+	for i := 0; i < numSessions+1; i++ {
+		select {
+		case <-payloads:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Payloads are not received.")
+		}
+	}
+
+	if stats := server.Stats(); stats.ActiveSessions != numSessions {
+		t.Errorf("ActiveSessions = %d, want %d", stats.ActiveSessions, numSessions)
+	}
+
+	stopServer(t, cancel, errc)
+
+	stats := server.Stats()
+	if stats.Sessions != numSessions || stats.Datagrams != 1 || stats.ActiveSessions != 0 {
+		t.Errorf("Stats = %+v, want %d sessions, 1 datagram and no active session", stats, numSessions)
+	}
+
+	if server.Healthy() {
+		t.Error("Server is healthy after shutdown.")
+	}
+
+	// All sessions are written when Serve returns.
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if len(sink.sessions) != numSessions+1 {
+		t.Fatalf("%d sessions are written, want %d", len(sink.sessions), numSessions+1)
+	}
+
+	var tcp, udps int
+	for _, session := range sink.sessions {
+		if session.EndTimestamp == nil {
+			t.Errorf("Session has no end timestamp: %s", session)
+		}
+		if len(session.Payloads) != 1 {
+			t.Errorf("Session has %d payloads, want 1: %s", len(session.Payloads), session)
+			continue
+		}
+
+		switch session.Flow.Proto {
+		case "tcp":
+			tcp++
+			if got := string(session.Payloads[0].Data); got != "hello" {
+				t.Errorf("Payload = %q, want %q", got, "hello")
+			}
+		case "udp":
+			udps++
+			if got := string(session.Payloads[0].Data); got != "datagram" {
+				t.Errorf("Payload = %q, want %q", got, "datagram")
+			}
+		}
+	}
+
+	if tcp != numSessions || udps != 1 {
+		t.Errorf("%d TCP and %d UDP sessions are written, want %d and 1", tcp, udps, numSessions)
+	}
+}
+
+func TestServerRecordsRejected(t *testing.T) {
+	sink := &memSink{}
+	established := make(chan struct{}, 1)
+
+	server := NewServer(Options{
+		Host:       "127.0.0.1",
+		DisableUDP: true,
+		Timeout:    time.Minute,
+		Sinks:      []Sink{sink},
+		Output:     OutputEvents,
+		Limiter:    NewLimiter(1, 0, 0, 0, OverflowRecord),
+		Hooks: Hooks{
+			OnSessionStart: func(session *Session) {
+				established <- struct{}{}
+			},
+		},
+	})
+
+	cancel, errc := startServer(t, server)
+
+	conn, err := net.Dial("tcp", server.tcpLn.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-established:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session is not established.")
+	}
+
+	// The second connection exceeds MaxConns.
+	rejected, err := net.Dial("tcp", server.tcpLn.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer rejected.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Stats().Rejected < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopServer(t, cancel, errc)
+
+	stats := server.Stats()
+	if stats.Sessions != 1 || stats.Rejected != 1 || stats.RejectedDropped != 0 {
+		t.Errorf("Stats = %+v, want 1 session and 1 rejected connection", stats)
+	}
+
+	// The rejected connection is recorded before Serve returns.
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	var starts, ends, rejects int
+	for _, event := range sink.events {
+		switch event.Type {
+		case EventSessionStart:
+			starts++
+		case EventSessionEnd:
+			ends++
+		}
+		if event.Type == EventSessionEnd && event.Rejected != "" {
+			rejects++
+		}
+	}
+
+	if starts != 2 || ends != 2 {
+		t.Errorf("%d session_start and %d session_end events are written, want 2 each", starts, ends)
+	}
+	if rejects != 1 {
+		t.Errorf("%d session_end events of rejected connections are written, want 1", rejects)
+	}
+}
+
+func TestNewServerDefaults(t *testing.T) {
+	server := NewServer(Options{})
+
+	// Zero timeout would end every session at once.
+	if server.opts.Timeout != DefaultTimeout {
+		t.Errorf("Timeout = %s, want %s", server.opts.Timeout, DefaultTimeout)
+	}
+}
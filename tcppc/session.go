@@ -53,20 +53,73 @@ func (p *Payload) String() string {
 	return fmt.Sprintf("Payload %d: %s: %v", p.Index, formatTimeStr(&p.Timestamp), p.Data)
 }
 
+// SensorInfo identifies the sensor which captured sessions.
+type SensorInfo struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// ListenerInfo identifies the listener which accepted sessions.
+type ListenerInfo struct {
+	// Name of the listener (e.g. the name of the socket passed by systemd).
+	Name string `json:"name"`
+	// Local address which the listener is bound to.
+	Addr string `json:"addr"`
+}
+
 type Session struct {
-	Timestamp time.Time  `json:"timestamp"`
-	Flow      *Flow      `json:"flow"`
-	Payloads  []*Payload `json:"payloads"`
+	// Version of the format of session data (SchemaVersion).
+	SchemaVersion int `json:"schema_version"`
+	// Unique ID (ULID) sorted by the timestamp, shared by events of the
+	// session.
+	ID        string    `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// Time when the session ended (nil until it is written).
+	EndTimestamp *time.Time `json:"end_timestamp,omitempty"`
+	// Sensor and listener which captured the session, and the version of
+	// tcppc.
+	Sensor   *SensorInfo   `json:"sensor,omitempty"`
+	Listener *ListenerInfo `json:"listener,omitempty"`
+	Version  string        `json:"tcppc_version,omitempty"`
+	Flow     *Flow         `json:"flow"`
+	// Community ID v1 of the flow.
+	CommunityID string `json:"community_id,omitempty"`
+	// Attributes of the TLS handshake (tls sessions only).
+	TLS      *TLSInfo   `json:"tls,omitempty"`
+	Payloads []*Payload `json:"payloads"`
+	Rejected string     `json:"rejected,omitempty"`
+	// True if the session was closed by SessionLimits.
+	Truncated   bool `json:"truncated,omitempty"`
+	MaxDuration bool `json:"max_duration,omitempty"`
+	// True if the session is reassembled from events and some of them are
+	// missing (e.g. the process crashed before the session ended).
+	Incomplete bool `json:"incomplete,omitempty"`
 }
 
 func NewSession(flow *Flow) *Session {
-	return &Session{Timestamp: time.Now(), Flow: flow}
+	ts := time.Now()
+	return &Session{
+		SchemaVersion: SchemaVersion,
+		ID:            newULID(ts),
+		Timestamp:     ts,
+		Version:       Version,
+		Flow:          flow,
+	}
 }
 
 func (s *Session) String() string {
 	return fmt.Sprintf("Session: %s: %s (%d payloads)", formatTimeStr(&s.Timestamp), s.Flow, len(s.Payloads))
 }
 
+// NumBytes returns the total size of the payloads.
+func (s *Session) NumBytes() int {
+	var n int
+	for _, p := range s.Payloads {
+		n += len(p.Data)
+	}
+	return n
+}
+
 func (s *Session) AddPayload(data []byte) *Payload {
 	index := uint(len(s.Payloads))
 	ts := time.Now()
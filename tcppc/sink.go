@@ -0,0 +1,64 @@
+package tcppc
+
+import (
+	"fmt"
+)
+
+// Sink is a destination of sessions and events written by Server. Server
+// calls WriteSession or WriteEvent concurrently from session handlers, so
+// sinks must be safe for concurrent use and should not block for long.
+type Sink interface {
+	// Name returns the name of the sink used in logs.
+	Name() string
+	WriteSession(session *Session) error
+	WriteEvent(event *Event) error
+	// Close flushes records and releases resources.
+	Close() error
+}
+
+// FileSink writes records to session files through RotWriter.
+type FileSink struct {
+	Writer *RotWriter
+	Format Formatter
+}
+
+func NewFileSink(writer *RotWriter, format Formatter) *FileSink {
+	return &FileSink{
+		Writer: writer,
+		Format: format,
+	}
+}
+
+func (s *FileSink) Name() string {
+	return fmt.Sprintf("file (%s)", s.Writer.FileNameFmt)
+}
+
+func (s *FileSink) WriteSession(session *Session) error {
+	data, err := s.Format.FormatSession(session)
+	if err != nil {
+		return fmt.Errorf("Failed to encode session: %w", err)
+	}
+	if data == nil {
+		return nil
+	}
+
+	_, err = s.Writer.WriteFlow(session.Flow, data)
+	return err
+}
+
+func (s *FileSink) WriteEvent(event *Event) error {
+	data, err := s.Format.FormatEvent(event)
+	if err != nil {
+		return fmt.Errorf("Failed to encode event: %w", err)
+	}
+	if data == nil {
+		return nil
+	}
+
+	_, err = s.Writer.WriteFlow(event.Flow, data)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.Writer.Close()
+}
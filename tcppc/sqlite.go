@@ -0,0 +1,773 @@
+package tcppc
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jehiah/go-strftime"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	// Pure-Go driver of SQLite, which works in binaries built with
+	// CGO_ENABLED=0 (required by the sandbox).
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// Name of the database/sql driver of SQLite.
+	sqliteDriver = "sqlite"
+
+	// Default interval of commits of transactions.
+	DefaultSQLiteCommitInterval = time.Second
+	// Maximum number of records written in a transaction.
+	sqliteMaxTxRecords = 1000
+	// Maximum number of cached IDs of flows.
+	sqliteMaxFlowCache = 10000
+	// Format of times in databases (UTC, which can be compared as strings and
+	// given to date and time functions of SQLite).
+	sqliteTimeFmt = "2006-01-02T15:04:05.000000Z"
+)
+
+// sqliteMigrations are migrations of the schema of databases. The version
+// of a migration is its index + 1. Released migrations must not be changed;
+// changes of the schema are appended as new migrations, which are applied
+// to existing databases when they are opened.
+var sqliteMigrations = []string{
+	// 1: sessions, flows and payloads.
+	`CREATE TABLE flows (
+		id    INTEGER PRIMARY KEY,
+		proto TEXT    NOT NULL,
+		src   TEXT    NOT NULL,
+		sport INTEGER NOT NULL,
+		dst   TEXT    NOT NULL,
+		dport INTEGER NOT NULL,
+		UNIQUE (proto, src, sport, dst, dport)
+	);
+	CREATE INDEX flows_src ON flows (src);
+	CREATE INDEX flows_dport ON flows (dport);
+
+	CREATE TABLE sessions (
+		id              TEXT    PRIMARY KEY,
+		flow_id         INTEGER NOT NULL REFERENCES flows (id),
+		start_time      TEXT    NOT NULL,
+		end_time        TEXT,
+		sensor          TEXT,
+		listener        TEXT,
+		tcppc_version   TEXT,
+		community_id    TEXT,
+		tls_version     TEXT,
+		tls_cipher      TEXT,
+		tls_server_name TEXT,
+		ja3             TEXT,
+		ja3_string      TEXT,
+		num_payloads    INTEGER NOT NULL DEFAULT 0,
+		num_bytes       INTEGER NOT NULL DEFAULT 0,
+		rejected        TEXT,
+		truncated       INTEGER NOT NULL DEFAULT 0,
+		max_duration    INTEGER NOT NULL DEFAULT 0,
+		incomplete      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX sessions_flow_id ON sessions (flow_id);
+	CREATE INDEX sessions_start_time ON sessions (start_time);
+
+	CREATE TABLE payloads (
+		session_id TEXT    NOT NULL REFERENCES sessions (id),
+		idx        INTEGER NOT NULL,
+		time       TEXT    NOT NULL,
+		data       BLOB    NOT NULL,
+		PRIMARY KEY (session_id, idx)
+	);
+
+	CREATE VIEW session_flows AS
+		SELECT sessions.*, flows.proto, flows.src, flows.sport, flows.dst, flows.dport
+		FROM sessions JOIN flows ON sessions.flow_id = flows.id;`,
+}
+
+// SQLiteOptions configures SQLiteSink.
+type SQLiteOptions struct {
+	// Schedule of rotation of databases (nil: not rotated).
+	Schedule Schedule
+	// Location used as timezone in the filename format and Schedule.
+	Location *time.Location
+	// Size of the queue and the behaviour when it is full (Sync is ignored;
+	// nil: a queue of DefaultQueueSize which blocks when full).
+	Queue *WriterQueue
+	// Value of TokenSensor in the filename format.
+	Sensor string
+	// Interval of commits of transactions (0: DefaultSQLiteCommitInterval).
+	CommitInterval time.Duration
+	// Function called for each finalised database (nil: none).
+	OnFinal func(f FinalFile)
+}
+
+// SQLiteStats holds statistics of SQLiteSink.
+type SQLiteStats struct {
+	// Number of sessions and events written.
+	Written uint
+	// Number of sessions and events dropped because the queue is full.
+	Dropped uint
+	// Number of sessions and events lost by errors of databases.
+	Lost uint
+	// Number of errors of databases.
+	Errors uint
+}
+
+// sqliteRecord is a session or an event waiting to be written. Values are
+// copied from the session when it is queued.
+type sqliteRecord struct {
+	// Type of the event, or "" for a session.
+	eventType   string
+	id          string
+	start       time.Time
+	end         *time.Time
+	flow        Flow
+	sensor      string
+	listener    string
+	version     string
+	communityID string
+	tls         *TLSInfo
+	payloads    []*Payload
+	numPayloads int
+	numBytes    int
+	rejected    string
+	truncated   bool
+	maxDuration bool
+	incomplete  bool
+}
+
+// SQLiteSink writes sessions into SQLite databases with normalized tables of
+// sessions, flows and payloads (see sqliteMigrations), so that they can be
+// queried by SQL.
+//
+// Records are put into a bounded queue and written by a single goroutine in
+// transactions committed every CommitInterval. Databases are opened in WAL
+// mode, and rotated by Schedule like RotWriter: the database of the current
+// period is closed (and checkpointed into a single file) and a new one is
+// opened on demand. A database whose filename does not change across
+// rotations (or restarts) is written to again, and is finalised only when it
+// is rotated to a database of another name. The filename format may contain
+// time indicators of strftime and TokenSensor.
+//
+// In the event-stream output mode, a session is inserted by its
+// session_start event, payloads are inserted as they arrive, and the session
+// is updated by its session_end event (end_time is NULL until then).
+type SQLiteSink struct {
+	// Filename format w/ time indicators of strftime and TokenSensor.
+	FileNameFmt string
+	opts        SQLiteOptions
+	// Current database (nil: not opened).
+	db       *sql.DB
+	fileName string
+	// Current transaction (nil: none) and the number of records in it.
+	tx        *sql.Tx
+	txRecords int
+	// Number of sessions written to the current database.
+	numSessions uint
+	// IDs of flows in the current database keyed by their 5-tuples.
+	flowIDs map[string]int64
+	// Next rotation time (zero: never).
+	nextRotTime time.Time
+	// Time to retry to open the database after failures (zero: not failing).
+	retryAt time.Time
+	// Records waiting to be written.
+	queue chan *sqliteRecord
+	// True if this sink is closed (records are not queued any more).
+	closed bool
+	// Mutex object for exclusive control of closed and queue.
+	queueMutex sync.RWMutex
+	// Closed when the writer goroutine exits.
+	stopped chan struct{}
+	// Owner of databases (-1: unchanged).
+	uid int
+	gid int
+	// False while the database can not be written.
+	healthy bool
+	// Mutex object for exclusive control of fileName, the owner and
+	// healthy.
+	mutex sync.Mutex
+	// Statistics.
+	written *SessionCounter
+	dropped *SessionCounter
+	lost    *SessionCounter
+	errors  *SessionCounter
+}
+
+// NewSQLiteSink opens the first database and starts the writer goroutine.
+func NewSQLiteSink(fileNameFmt string, opts SQLiteOptions) (*SQLiteSink, error) {
+	if opts.Queue == nil {
+		opts.Queue = NewWriterQueue(DefaultQueueSize, QueueBlock, SyncNever, 0)
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.CommitInterval <= 0 {
+		opts.CommitInterval = DefaultSQLiteCommitInterval
+	}
+
+	s := &SQLiteSink{
+		FileNameFmt: fileNameFmt,
+		opts:        opts,
+		queue:       make(chan *sqliteRecord, opts.Queue.Size),
+		stopped:     make(chan struct{}),
+		uid:         -1,
+		gid:         -1,
+		healthy:     true,
+		written:     NewSessionCounter(),
+		dropped:     NewSessionCounter(),
+		lost:        NewSessionCounter(),
+		errors:      NewSessionCounter(),
+	}
+
+	now := time.Now()
+	if err := s.open(now); err != nil {
+		return nil, err
+	}
+	s.scheduleRotation(now)
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *SQLiteSink) Name() string {
+	return fmt.Sprintf("sqlite (%s)", s.FileNameFmt)
+}
+
+// dbName returns the filename of the database of the period of now.
+func (s *SQLiteSink) dbName(now time.Time) string {
+	name := strings.Replace(s.FileNameFmt, TokenSensor, sanitizeToken(s.opts.Sensor), -1)
+	return strftime.Format(name, now.In(s.opts.Location))
+}
+
+// open opens the database of the period of now and migrates its schema.
+func (s *SQLiteSink) open(now time.Time) error {
+	fileName := s.dbName(now)
+
+	if dirName := filepath.Dir(fileName); !fileExists(dirName) {
+		if err := os.MkdirAll(dirName, 0755); err != nil {
+			return fmt.Errorf("Failed to create directories: %s (%w)", dirName, err)
+		}
+		log.Printf("Create directories: %s\n", dirName)
+	}
+
+	db, err := sql.Open(sqliteDriver, fileName)
+	if err != nil {
+		return fmt.Errorf("Failed to open database: %s (%w)", fileName, err)
+	}
+	// Pragmas are set per connection, and temporary files are not used
+	// (they are outside of the sandbox).
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL", "PRAGMA busy_timeout = 5000", "PRAGMA temp_store = MEMORY"} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return fmt.Errorf("Failed to set up database: %s: %s (%w)", fileName, pragma, err)
+		}
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return fmt.Errorf("Failed to migrate database: %s (%w)", fileName, err)
+	}
+
+	// Sessions already in the database (e.g. written before restarts) are
+	// counted in the finalised database.
+	var numSessions uint
+	if err := db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&numSessions); err != nil {
+		db.Close()
+		return fmt.Errorf("Failed to count sessions in database: %s (%w)", fileName, err)
+	}
+
+	log.Printf("Opened a database: %s (%d sessions)\n", fileName, numSessions)
+
+	s.db = db
+	s.numSessions = numSessions
+	s.flowIDs = make(map[string]int64)
+
+	s.mutex.Lock()
+	s.fileName = fileName
+	s.healthy = true
+	if err := s.chown(); err != nil {
+		log.Printf("Failed to change the owner of the database: %s (%s)\n", fileName, err)
+	}
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// migrateSQLite applies migrations which are not applied to the database
+// yet. Each migration is applied in a transaction with its version.
+func migrateSQLite(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT    NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("Schema version %d is newer than this program (%d)", version, len(sqliteMigrations))
+	}
+
+	for v := version + 1; v <= len(sqliteMigrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[v-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d failed: %w", v, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", v, formatSQLiteTime(time.Now())); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeDB commits the transaction, checkpoints the WAL into the database and
+// closes it. If final is true, it finalises the database (i.e. OnFinal is
+// called); otherwise, the database is opened again to be written to (e.g.
+// rotation by time with the same filename, or restarts).
+func (s *SQLiteSink) closeDB(final bool) error {
+	if s.db == nil {
+		return nil
+	}
+
+	err := s.commit()
+	if _, cerr := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := s.db.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	switch {
+	case err != nil:
+		s.errors.inc()
+		log.Printf("Failed to close the database: %s (%s)\n", s.fileName, err)
+	case !final:
+		log.Printf("Closed a database: %s (%d sessions, to be written to)\n", s.fileName, s.numSessions)
+	default:
+		log.Printf("Rotated a database: %s (%d sessions)\n", s.fileName, s.numSessions)
+
+		if s.opts.OnFinal != nil {
+			var size int64
+			if info, err := os.Stat(s.fileName); err == nil {
+				size = info.Size()
+			}
+			s.opts.OnFinal(FinalFile{Path: s.fileName, BaseDir: BaseDir(s.FileNameFmt), Sessions: s.numSessions, Size: size})
+		}
+	}
+
+	s.db = nil
+	s.flowIDs = nil
+
+	return err
+}
+
+func (s *SQLiteSink) scheduleRotation(now time.Time) {
+	if s.opts.Schedule == nil {
+		s.nextRotTime = time.Time{}
+		return
+	}
+
+	s.nextRotTime = s.opts.Schedule.Next(now.In(s.opts.Location))
+}
+
+// rotationWait returns the time to wait for the next rotation, which is
+// never longer than maxRotationWait.
+func (s *SQLiteSink) rotationWait() time.Duration {
+	wait := maxRotationWait
+	if !s.nextRotTime.IsZero() {
+		if d := time.Until(s.nextRotTime); d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// run writes queued records, and commits transactions and rotates databases
+// until the queue is closed by Close.
+func (s *SQLiteSink) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.opts.CommitInterval)
+	defer ticker.Stop()
+
+	for {
+		timer := time.NewTimer(s.rotationWait())
+
+		select {
+		case record, ok := <-s.queue:
+			timer.Stop()
+			if !ok {
+				s.closeDB(s.dbName(time.Now()) != s.fileName)
+				return
+			}
+			s.write(record)
+
+		case <-ticker.C:
+			timer.Stop()
+			if err := s.commit(); err != nil {
+				s.fail(err)
+			}
+
+		case <-timer.C:
+			now := time.Now()
+			if !s.nextRotTime.IsZero() && !now.Before(s.nextRotTime) {
+				s.closeDB(s.dbName(now) != s.fileName)
+				s.scheduleRotation(now)
+			}
+		}
+	}
+}
+
+// fail counts the error and closes the database to reopen it later.
+func (s *SQLiteSink) fail(err error) {
+	s.errors.inc()
+	log.Printf("Failed to write to the database: %s (%s)\n", s.fileName, err)
+
+	if s.tx != nil {
+		s.lost.add(uint(s.txRecords))
+		s.tx.Rollback()
+		s.tx = nil
+		s.txRecords = 0
+	}
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+	s.retryAt = time.Now().Add(openRetryInterval)
+
+	s.mutex.Lock()
+	s.healthy = false
+	s.mutex.Unlock()
+}
+
+// write writes a record in the current transaction.
+func (s *SQLiteSink) write(record *sqliteRecord) {
+	now := time.Now()
+
+	if s.db == nil {
+		if now.Before(s.retryAt) {
+			s.lost.inc()
+			return
+		}
+		if err := s.open(now); err != nil {
+			s.lost.inc()
+			s.fail(err)
+			return
+		}
+		s.retryAt = time.Time{}
+	}
+
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			s.lost.inc()
+			s.fail(err)
+			return
+		}
+		s.tx = tx
+	}
+
+	if err := s.insert(record); err != nil {
+		s.lost.inc()
+		s.fail(err)
+		return
+	}
+
+	s.txRecords += 1
+	s.written.inc()
+	if record.eventType == "" || record.eventType == EventSessionStart {
+		s.numSessions += 1
+	}
+
+	if s.txRecords >= sqliteMaxTxRecords {
+		if err := s.commit(); err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+// commit commits the current transaction (if any).
+func (s *SQLiteSink) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+
+	err := s.tx.Commit()
+	if err != nil {
+		s.lost.add(uint(s.txRecords))
+	}
+	s.tx = nil
+	s.txRecords = 0
+
+	return err
+}
+
+// flowID returns the ID of the flow, inserting it if needed.
+func (s *SQLiteSink) flowID(flow *Flow) (int64, error) {
+	src, dst := flow.Src.String(), flow.Dst.String()
+	key := fmt.Sprintf("%s %s %d %s %d", flow.Proto, src, flow.Sport, dst, flow.Dport)
+	if id, ok := s.flowIDs[key]; ok {
+		return id, nil
+	}
+
+	if _, err := s.tx.Exec("INSERT INTO flows (proto, src, sport, dst, dport) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING", flow.Proto, src, flow.Sport, dst, flow.Dport); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	if err := s.tx.QueryRow("SELECT id FROM flows WHERE proto = ? AND src = ? AND sport = ? AND dst = ? AND dport = ?", flow.Proto, src, flow.Sport, dst, flow.Dport).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	if len(s.flowIDs) >= sqliteMaxFlowCache {
+		s.flowIDs = make(map[string]int64)
+	}
+	s.flowIDs[key] = id
+
+	return id, nil
+}
+
+// insert writes the record in the current transaction.
+func (s *SQLiteSink) insert(r *sqliteRecord) error {
+	flowID, err := s.flowID(&r.flow)
+	if err != nil {
+		return err
+	}
+
+	// Sessions are inserted by sessions and all events (those which start
+	// in the previous database are inserted by their first event in the
+	// current one), and updated by session_end events.
+	var tlsVersion, tlsCipher, tlsServerName, ja3, ja3String interface{}
+	if r.tls != nil {
+		tlsVersion = nullString(r.tls.Version)
+		tlsCipher = nullString(r.tls.Cipher)
+		tlsServerName = nullString(r.tls.ServerName)
+		ja3 = nullString(r.tls.JA3)
+		ja3String = nullString(r.tls.JA3String)
+	}
+
+	var endTime interface{}
+	if r.end != nil {
+		endTime = formatSQLiteTime(*r.end)
+	}
+
+	_, err = s.tx.Exec(`INSERT INTO sessions (
+			id, flow_id, start_time, end_time, sensor, listener, tcppc_version, community_id,
+			tls_version, tls_cipher, tls_server_name, ja3, ja3_string,
+			num_payloads, num_bytes, rejected, truncated, max_duration, incomplete
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			end_time = excluded.end_time,
+			tls_version = COALESCE(excluded.tls_version, tls_version),
+			tls_cipher = COALESCE(excluded.tls_cipher, tls_cipher),
+			tls_server_name = COALESCE(excluded.tls_server_name, tls_server_name),
+			ja3 = COALESCE(excluded.ja3, ja3),
+			ja3_string = COALESCE(excluded.ja3_string, ja3_string),
+			num_payloads = excluded.num_payloads,
+			num_bytes = excluded.num_bytes,
+			rejected = excluded.rejected,
+			truncated = excluded.truncated,
+			max_duration = excluded.max_duration,
+			incomplete = excluded.incomplete
+		WHERE excluded.end_time IS NOT NULL`,
+		r.id, flowID, formatSQLiteTime(r.start), endTime, nullString(r.sensor), nullString(r.listener), nullString(r.version), nullString(r.communityID),
+		tlsVersion, tlsCipher, tlsServerName, ja3, ja3String,
+		r.numPayloads, r.numBytes, nullString(r.rejected), r.truncated, r.maxDuration, r.incomplete)
+	if err != nil {
+		return err
+	}
+
+	for _, payload := range r.payloads {
+		if _, err := s.tx.Exec("INSERT OR IGNORE INTO payloads (session_id, idx, time, data) VALUES (?, ?, ?, ?)", r.id, payload.Index, formatSQLiteTime(payload.Timestamp), payload.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatSQLiteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFmt)
+}
+
+// nullString returns nil (NULL) for an empty string.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// newSQLiteRecord returns a record with the fields common to sessions and
+// events.
+func newSQLiteRecord(eventType, id string, start time.Time, flow *Flow, sensor *SensorInfo, listener *ListenerInfo, version, communityID string, tlsInfo *TLSInfo) *sqliteRecord {
+	r := &sqliteRecord{
+		eventType:   eventType,
+		id:          id,
+		start:       start,
+		flow:        *flow,
+		version:     version,
+		communityID: communityID,
+		tls:         tlsInfo,
+	}
+	if sensor != nil {
+		r.sensor = sensor.Name
+	}
+	if listener != nil {
+		r.listener = listener.Name
+	}
+	return r
+}
+
+func (s *SQLiteSink) WriteSession(session *Session) error {
+	r := newSQLiteRecord("", session.ID, session.Timestamp, session.Flow, session.Sensor, session.Listener, session.Version, session.CommunityID, session.TLS)
+
+	end := time.Now()
+	if session.EndTimestamp != nil {
+		end = *session.EndTimestamp
+	}
+	r.end = &end
+	r.payloads = append([]*Payload{}, session.Payloads...)
+	r.numPayloads = len(session.Payloads)
+	r.numBytes = session.NumBytes()
+	r.rejected = session.Rejected
+	r.truncated = session.Truncated
+	r.maxDuration = session.MaxDuration
+	r.incomplete = session.Incomplete
+
+	return s.enqueue(r)
+}
+
+func (s *SQLiteSink) WriteEvent(event *Event) error {
+	start := event.Timestamp
+	if event.Start != nil {
+		start = *event.Start
+	}
+
+	r := newSQLiteRecord(event.Type, event.SessionID, start, event.Flow, event.Sensor, event.Listener, event.Version, event.CommunityID, event.TLS)
+
+	switch event.Type {
+	case EventPayload:
+		r.payloads = []*Payload{event.Payload}
+	case EventSessionEnd:
+		end := event.Timestamp
+		r.end = &end
+		r.numPayloads = event.NumPayloads
+		r.numBytes = event.NumBytes
+		r.rejected = event.Rejected
+		r.truncated = event.Truncated
+		r.maxDuration = event.MaxDuration
+	}
+
+	return s.enqueue(r)
+}
+
+// enqueue puts a record into the queue. When the queue is full, it blocks or
+// returns ErrQueueFull according to Queue.OnFull.
+func (s *SQLiteSink) enqueue(r *sqliteRecord) error {
+	s.queueMutex.RLock()
+	defer s.queueMutex.RUnlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	if s.opts.Queue.OnFull == QueueDrop {
+		select {
+		case s.queue <- r:
+		default:
+			s.dropped.inc()
+			return ErrQueueFull
+		}
+	} else {
+		s.queue <- r
+	}
+
+	return nil
+}
+
+// SetOwner changes the owner of databases to uid/gid, including the current
+// one. This is used when the process drops privileges after the sink is
+// started as root.
+func (s *SQLiteSink) SetOwner(uid, gid int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.uid = uid
+	s.gid = gid
+
+	return s.chown()
+}
+
+// chown changes the owner of the current database and its WAL files.
+// It must be called with the mutex held.
+func (s *SQLiteSink) chown() error {
+	if (s.uid < 0 && s.gid < 0) || s.fileName == "" {
+		return nil
+	}
+
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Lchown(s.fileName+suffix, s.uid, s.gid); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Healthy returns false if the sink is closed or the database can not be
+// written.
+func (s *SQLiteSink) Healthy() bool {
+	s.queueMutex.RLock()
+	closed := s.closed
+	s.queueMutex.RUnlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return !closed && s.healthy
+}
+
+// Stats returns the current statistics of the sink.
+func (s *SQLiteSink) Stats() SQLiteStats {
+	return SQLiteStats{
+		Written: s.written.count(),
+		Dropped: s.dropped.count(),
+		Lost:    s.lost.count(),
+		Errors:  s.errors.count(),
+	}
+}
+
+// Close writes all queued records, stops the writer goroutine and closes the
+// database.
+func (s *SQLiteSink) Close() error {
+	s.queueMutex.Lock()
+	if s.closed {
+		s.queueMutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.queueMutex.Unlock()
+
+	<-s.stopped
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package tcppc
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T, fileName string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open(sqliteDriver, fileName)
+	if err != nil {
+		t.Fatalf("Failed to open the database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "tcppc.sqlite"))
+
+	// Migrations are applied once.
+	for i := 0; i < 2; i++ {
+		if err := migrateSQLite(db); err != nil {
+			t.Fatalf("Failed to migrate the database: %s", err)
+		}
+	}
+
+	var count, version int
+	if err := db.QueryRow("SELECT COUNT(*), MAX(version) FROM schema_migrations").Scan(&count, &version); err != nil {
+		t.Fatalf("Failed to query versions: %s", err)
+	}
+	if count != len(sqliteMigrations) || version != len(sqliteMigrations) {
+		t.Errorf("Migrations = %d (version %d), want %d", count, version, len(sqliteMigrations))
+	}
+
+	// Databases of newer versions are not written to.
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", len(sqliteMigrations)+1, formatSQLiteTime(time.Now())); err != nil {
+		t.Fatalf("Failed to insert a version: %s", err)
+	}
+	if err := migrateSQLite(db); err == nil || !strings.Contains(err.Error(), "is newer") {
+		t.Errorf("migrateSQLite() = %v, want an error of a newer version", err)
+	}
+}
+
+func TestSQLiteSinkWriteSession(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "tcppc.sqlite")
+
+	s, err := NewSQLiteSink(fileName, SQLiteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open the database: %s", err)
+	}
+	session := newTestSession(23)
+	for _, written := range []*Session{session, newTestSession(23), newTestSession(80)} {
+		if err := s.WriteSession(written); err != nil {
+			t.Fatalf("Failed to write the session: %s", err)
+		}
+	}
+	s.Close()
+
+	if stats := s.Stats(); stats.Written != 3 || stats.Lost != 0 || stats.Errors != 0 {
+		t.Errorf("Stats = %+v, want 3 written", stats)
+	}
+
+	db := openTestDB(t, fileName)
+
+	var dport, numPayloads int
+	var data []byte
+	if err := db.QueryRow("SELECT dport, num_payloads, data FROM session_flows JOIN payloads ON payloads.session_id = session_flows.id WHERE id = ?", session.ID).Scan(&dport, &numPayloads, &data); err != nil {
+		t.Fatalf("Failed to query the session: %s", err)
+	}
+	if dport != 23 || numPayloads != 1 || string(data) != "hello" {
+		t.Errorf("Session = %d, %d, %q, want 23, 1, %q", dport, numPayloads, data, "hello")
+	}
+
+	// Sessions of the same flow share the row of the flow.
+	var numFlows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM flows").Scan(&numFlows); err != nil {
+		t.Fatalf("Failed to count flows: %s", err)
+	}
+	if numFlows != 2 {
+		t.Errorf("Flows = %d, want 2", numFlows)
+	}
+
+	// Sessions written before restarts are counted.
+	s, err = NewSQLiteSink(fileName, SQLiteOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open the database again: %s", err)
+	}
+	defer s.Close()
+	if s.numSessions != 3 {
+		t.Errorf("Sessions = %d, want 3", s.numSessions)
+	}
+}
+
+func TestSQLiteSinkRotationUnderLoad(t *testing.T) {
+	finals := &finalFiles{}
+	s, err := NewSQLiteSink(filepath.Join(t.TempDir(), "db-%H%M%S.sqlite"), SQLiteOptions{
+		Schedule: NewIntervalSchedule(1, 0),
+		// Commits come more often than rotations.
+		CommitInterval: 20 * time.Millisecond,
+		OnFinal:        finals.add,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open the database: %s", err)
+	}
+	defer s.Close()
+
+	// Records keep coming more often than the timer of rotation.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				s.WriteSession(newTestSession(23))
+			}
+		}
+	}()
+
+	waitFor(t, 3*time.Second, "the database is not rotated", func() bool { return len(finals.get()) > 0 })
+}
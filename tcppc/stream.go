@@ -0,0 +1,108 @@
+package tcppc
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// SessionLimits bounds the size and the duration of TCP/TLS sessions so that
+// clients which trickle bytes forever or stream huge data do not keep
+// sessions open indefinitely.
+type SessionLimits struct {
+	// Maximum number of bytes received per session (0: unlimited).
+	MaxBytes int
+	// Maximum number of payloads per session (0: unlimited).
+	MaxPayloads int
+	// Maximum duration of a session (0: unlimited).
+	MaxDuration time.Duration
+}
+
+func NewSessionLimits(maxBytes, maxPayloads, maxDuration int) *SessionLimits {
+	return &SessionLimits{
+		MaxBytes:    maxBytes,
+		MaxPayloads: maxPayloads,
+		MaxDuration: time.Duration(maxDuration) * time.Second,
+	}
+}
+
+// receivePayloads reads payloads from conn and adds them to session until
+// the connection is closed, timed out, the session exceeds limits, or the
+// server is shutting down. It returns nil if the connection is closed by the
+// peer or by limits.
+func (s *Server) receivePayloads(conn net.Conn, session *Session) error {
+	limits := s.opts.Limits
+	if limits == nil {
+		limits = &SessionLimits{}
+	}
+
+	var endTime time.Time
+	if limits.MaxDuration > 0 {
+		endTime = session.Timestamp.Add(limits.MaxDuration)
+	}
+
+	var numBytes int
+
+	buf := make([]byte, 4096)
+
+	for {
+		select {
+		case <-s.done:
+			return errors.New("Server is shutting down.")
+		default:
+		}
+
+		deadline := time.Now().Add(s.opts.Timeout)
+		if !endTime.IsZero() && endTime.Before(deadline) {
+			deadline = endTime
+		}
+		conn.SetDeadline(deadline)
+
+		length, err := conn.Read(buf)
+
+		if limits.MaxBytes > 0 && numBytes+length > limits.MaxBytes {
+			length = limits.MaxBytes - numBytes
+			session.Truncated = true
+		}
+
+		if length > 0 {
+			data := make([]byte, length)
+			copy(data, buf[:length])
+
+			payload := session.AddPayload(data)
+			numBytes += length
+
+			s.writeEvent(NewPayloadEvent(session, payload))
+
+			if s.opts.Hooks.OnPayload != nil {
+				s.opts.Hooks.OnPayload(session, payload)
+			}
+
+			log.Printf("%s: Received: %s: %q (%d bytes)\n", strings.ToUpper(session.Flow.Proto), session, buf[:length], length)
+
+			if limits.MaxPayloads > 0 && len(session.Payloads) >= limits.MaxPayloads {
+				session.Truncated = true
+			}
+		}
+
+		if session.Truncated {
+			log.Printf("%s: Reached size limits: %s\n", strings.ToUpper(session.Flow.Proto), session)
+			return nil
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !endTime.IsZero() && !time.Now().Before(endTime) {
+				session.MaxDuration = true
+				log.Printf("%s: Reached duration limit: %s\n", strings.ToUpper(session.Flow.Proto), session)
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,718 @@
+package tcppc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Transports of SyslogSink.
+	SyslogUnix     = "unix"
+	SyslogUDP      = "udp"
+	SyslogTCP      = "tcp"
+	SyslogTLS      = "tls"
+	SyslogJournald = "journald"
+
+	// Default sockets of the local syslog daemon and journald.
+	DefaultSyslogSocket   = "/dev/log"
+	DefaultJournaldSocket = "/run/systemd/journal/socket"
+
+	// Defaults of SyslogOptions.
+	DefaultSyslogFacility   = 16 // local0
+	DefaultSyslogMaxSize    = 2048
+	DefaultSyslogMaxPayload = 1024
+	DefaultSyslogQueueSize  = 4096
+
+	// Maximum of MaxSize over datagram transports (unix, udp and journald),
+	// which send a message in a single datagram (the maximum payload of UDP
+	// over IPv4). Journal entries are not passed by memfd, so entries larger
+	// than a datagram can not be sent.
+	SyslogMaxDatagramSize = 65507
+
+	// SD-ID of structured data of sessions. 32473 is the private enterprise
+	// number reserved for documentation (RFC 5612).
+	syslogSDID = "tcppc@32473"
+	// Severities of messages (informational and notice).
+	syslogSeverityInfo   = 6
+	syslogSeverityNotice = 5
+	// Delay before reconnecting after failures (doubled on each failure up
+	// to syslogMaxRetryDelay).
+	syslogRetryDelay    = time.Second
+	syslogMaxRetryDelay = time.Minute
+	// Timeout of connecting and writing a message.
+	syslogTimeout = 10 * time.Second
+)
+
+// Names of syslog facilities (RFC 5424).
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseSyslogFacility returns the code of the facility name (e.g. "local0").
+func ParseSyslogFacility(name string) (int, error) {
+	code, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown syslog facility: %q", name)
+	}
+	return code, nil
+}
+
+// ParseSyslogURL returns the transport and the address of the URL of a
+// syslog server: "unix:///dev/log", "udp://host:514", "tcp://host:514",
+// "tls://host:6514" or "journald://" (the address of unix and journald is
+// the path of the socket, which may be omitted).
+func ParseSyslogURL(s string) (network, addr string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case SyslogUnix, SyslogJournald:
+		addr = u.Path
+		if addr == "" {
+			addr = DefaultSyslogSocket
+			if u.Scheme == SyslogJournald {
+				addr = DefaultJournaldSocket
+			}
+		}
+	case SyslogUDP, SyslogTCP, SyslogTLS:
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return "", "", fmt.Errorf("Address of syslog must be host:port: %q", u.Host)
+		}
+		addr = u.Host
+	default:
+		return "", "", fmt.Errorf("Unknown scheme of syslog: %q", u.Scheme)
+	}
+
+	return u.Scheme, addr, nil
+}
+
+// SyslogOptions configures SyslogSink.
+type SyslogOptions struct {
+	// Transport (SyslogUnix, SyslogUDP, SyslogTCP, SyslogTLS or
+	// SyslogJournald) and the address (the path of the socket or host:port).
+	Network string
+	Addr    string
+	// TLS configuration of SyslogTLS (nil: system roots).
+	TLSConfig *tls.Config
+	// Facility of messages (0: kern; see ParseSyslogFacility).
+	Facility int
+	// HOSTNAME of messages (empty: the hostname).
+	Hostname string
+	// Maximum size of a message in bytes (0: DefaultSyslogMaxSize; at most
+	// SyslogMaxDatagramSize over datagram transports). Payload data are
+	// truncated, and then fields are dropped, to fit into it.
+	MaxSize int
+	// Maximum number of bytes of payload data in a message (0:
+	// DefaultSyslogMaxPayload, negative: no payload data).
+	MaxPayload int
+	// Maximum number of messages waiting to be sent (0:
+	// DefaultSyslogQueueSize). Messages are dropped when the queue is full.
+	QueueSize int
+}
+
+// SyslogStats holds statistics of SyslogSink.
+type SyslogStats struct {
+	// Number of messages sent.
+	Sent uint
+	// Number of messages dropped because the queue is full.
+	Dropped uint
+	// Number of messages lost because the server is not available or they
+	// do not fit into MaxSize.
+	Lost uint
+	// Number of messages whose payload data or fields are truncated.
+	Truncated uint
+}
+
+// syslogField is a field of a session written as a parameter of structured
+// data (syslog) or a journal field (journald, in upper case with TCPPC_).
+type syslogField struct {
+	name  string
+	value string
+}
+
+// syslogRecord holds the fields of a message of a session.
+type syslogRecord struct {
+	msgID     string
+	timestamp time.Time
+	severity  int
+	message   string
+	fields    []syslogField
+	// Payload data (concatenated and cut at MaxPayload) and whether they are
+	// truncated.
+	data      []byte
+	truncated bool
+}
+
+// SyslogSink writes each finished session as an RFC 5424 message with
+// structured data to a syslog server (through the local socket, UDP, or TCP
+// w/ or w/o TLS framed by octet counting), or as a native journald entry
+// whose fields are journal fields.
+//
+// Messages are formatted when sessions are written, put into a bounded
+// queue and sent by a single goroutine. Messages are lost while the server
+// is not available, and the connection is retried with exponential backoff.
+// In the event-stream output mode, only session_end events are written
+// (without payload data).
+type SyslogSink struct {
+	opts     SyslogOptions
+	hostname string
+	procID   string
+	// Connection to the server (nil: not connected).
+	conn net.Conn
+	// Time to retry to connect after failures (zero: not failing).
+	retryAt    time.Time
+	retryDelay time.Duration
+	// Messages waiting to be sent.
+	queue chan []byte
+	// True if this sink is closed (messages are not queued any more).
+	closed bool
+	// Mutex object for exclusive control of closed and queue.
+	queueMutex sync.RWMutex
+	// Closed when the sender goroutine exits.
+	stopped chan struct{}
+	// Statistics.
+	sent      *SessionCounter
+	dropped   *SessionCounter
+	lost      *SessionCounter
+	truncated *SessionCounter
+}
+
+// NewSyslogSink connects to the server and starts the sender goroutine.
+func NewSyslogSink(opts SyslogOptions) (*SyslogSink, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultSyslogMaxSize
+	}
+	if opts.MaxPayload == 0 {
+		opts.MaxPayload = DefaultSyslogMaxPayload
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultSyslogQueueSize
+	}
+	if opts.Network != SyslogTCP && opts.Network != SyslogTLS && opts.MaxSize > SyslogMaxDatagramSize {
+		return nil, fmt.Errorf("Maximum size of syslog messages over %s must be at most %d: %d", opts.Network, SyslogMaxDatagramSize, opts.MaxSize)
+	}
+
+	hostname := opts.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	s := &SyslogSink{
+		opts:       opts,
+		hostname:   syslogHeaderField(hostname, 255),
+		procID:     strconv.Itoa(os.Getpid()),
+		retryDelay: syslogRetryDelay,
+		queue:      make(chan []byte, opts.QueueSize),
+		stopped:    make(chan struct{}),
+		sent:       NewSessionCounter(),
+		dropped:    NewSessionCounter(),
+		lost:       NewSessionCounter(),
+		truncated:  NewSessionCounter(),
+	}
+
+	// Connect now to find errors of the configuration at startup.
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *SyslogSink) Name() string {
+	return fmt.Sprintf("syslog (%s://%s)", s.opts.Network, s.opts.Addr)
+}
+
+// connect connects to the server if not connected.
+func (s *SyslogSink) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: syslogTimeout}
+	switch s.opts.Network {
+	case SyslogUnix, SyslogJournald:
+		conn, err = dialer.Dial("unixgram", s.opts.Addr)
+	case SyslogUDP, SyslogTCP:
+		conn, err = dialer.Dial(s.opts.Network, s.opts.Addr)
+	case SyslogTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.opts.Addr, s.opts.TLSConfig)
+	default:
+		return fmt.Errorf("Unknown transport of syslog: %q", s.opts.Network)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to connect to syslog: %s://%s (%w)", s.opts.Network, s.opts.Addr, err)
+	}
+
+	s.conn = conn
+
+	return nil
+}
+
+func (s *SyslogSink) WriteSession(session *Session) error {
+	r := &syslogRecord{
+		msgID:     "session",
+		timestamp: session.Timestamp,
+		severity:  syslogSeverityInfo,
+		fields: syslogFields(session.ID, session.Flow, session.Sensor, session.Listener, session.CommunityID, session.TLS,
+			session.EndTimestamp, len(session.Payloads), session.NumBytes(), session.Rejected, session.Truncated, session.MaxDuration),
+	}
+
+	if s.opts.MaxPayload > 0 {
+		for _, payload := range session.Payloads {
+			if n := s.opts.MaxPayload - len(r.data); len(payload.Data) > n {
+				r.data = append(r.data, payload.Data[:n]...)
+				r.truncated = true
+				break
+			}
+			r.data = append(r.data, payload.Data...)
+		}
+	}
+
+	r.message = syslogMessage(session.Flow, len(session.Payloads), session.NumBytes(), session.Rejected)
+	if session.Rejected != "" {
+		r.severity = syslogSeverityNotice
+	}
+
+	return s.enqueue(r)
+}
+
+func (s *SyslogSink) WriteEvent(event *Event) error {
+	if event.Type != EventSessionEnd {
+		return nil
+	}
+
+	start := event.Timestamp
+	if event.Start != nil {
+		start = *event.Start
+	}
+	end := event.Timestamp
+
+	r := &syslogRecord{
+		msgID:     "session",
+		timestamp: start,
+		severity:  syslogSeverityInfo,
+		fields: syslogFields(event.SessionID, event.Flow, event.Sensor, event.Listener, event.CommunityID, event.TLS,
+			&end, event.NumPayloads, event.NumBytes, event.Rejected, event.Truncated, event.MaxDuration),
+		message: syslogMessage(event.Flow, event.NumPayloads, event.NumBytes, event.Rejected),
+	}
+	if event.Rejected != "" {
+		r.severity = syslogSeverityNotice
+	}
+
+	return s.enqueue(r)
+}
+
+// syslogMessage returns the human-readable message of a session.
+func syslogMessage(flow *Flow, numPayloads, numBytes int, rejected string) string {
+	msg := fmt.Sprintf("%s %s -> %s (%d payloads, %d bytes)", flow.Proto,
+		net.JoinHostPort(flow.Src.String(), strconv.Itoa(flow.Sport)),
+		net.JoinHostPort(flow.Dst.String(), strconv.Itoa(flow.Dport)), numPayloads, numBytes)
+	if rejected != "" {
+		msg += " rejected: " + rejected
+	}
+	return msg
+}
+
+// syslogFields returns the fields of a session. Empty values are omitted.
+func syslogFields(id string, flow *Flow, sensor *SensorInfo, listener *ListenerInfo, communityID string, tlsInfo *TLSInfo,
+	end *time.Time, numPayloads, numBytes int, rejected string, truncated, maxDuration bool) []syslogField {
+	var fields []syslogField
+	add := func(name, value string) {
+		if value != "" {
+			fields = append(fields, syslogField{name, value})
+		}
+	}
+
+	add("id", id)
+	add("proto", flow.Proto)
+	add("src", flow.Src.String())
+	add("sport", strconv.Itoa(flow.Sport))
+	add("dst", flow.Dst.String())
+	add("dport", strconv.Itoa(flow.Dport))
+	if end != nil {
+		add("end", end.UTC().Format(time.RFC3339Nano))
+	}
+	add("payloads", strconv.Itoa(numPayloads))
+	add("bytes", strconv.Itoa(numBytes))
+	add("community_id", communityID)
+	if sensor != nil {
+		add("sensor", sensor.Name)
+		add("sensor_tags", strings.Join(sensor.Tags, ","))
+	}
+	if listener != nil {
+		add("listener", listener.Name)
+	}
+	if tlsInfo != nil {
+		add("tls_version", tlsInfo.Version)
+		add("tls_cipher", tlsInfo.Cipher)
+		add("tls_server_name", tlsInfo.ServerName)
+		add("ja3", tlsInfo.JA3)
+	}
+	add("rejected", rejected)
+	if truncated {
+		add("session_truncated", "true")
+	}
+	if maxDuration {
+		add("max_duration", "true")
+	}
+
+	return fields
+}
+
+// syslogHeaderField returns the value as a field of the header of RFC 5424
+// (printable ASCII without spaces, at most n characters; "-" if empty).
+func syslogHeaderField(value string, n int) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		if c < 0x21 || c > 0x7e {
+			c = '_'
+		}
+		b.WriteByte(c)
+	}
+
+	value = b.String()
+	if len(value) > n {
+		value = value[:n]
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// escapeSDValue escapes a parameter value of structured data (RFC 5424
+// section 6.3.3).
+func escapeSDValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// escapeSyslogData escapes payload data in a message (non-printable bytes
+// and characters special in structured data are written as \xNN) up to
+// limit bytes. It returns the escaped data and the number of bytes escaped.
+func escapeSyslogData(data []byte, limit int) (string, int) {
+	var b strings.Builder
+	for i, c := range data {
+		var s string
+		if c < 0x20 || c > 0x7e || c == '\\' || c == '"' || c == ']' {
+			s = fmt.Sprintf("\\x%02x", c)
+		} else {
+			s = string(c)
+		}
+
+		if b.Len()+len(s) > limit {
+			return b.String(), i
+		}
+		b.WriteString(s)
+	}
+	return b.String(), len(data)
+}
+
+// formatRFC5424 formats the record as an RFC 5424 message of at most
+// MaxSize bytes. Payload data are the last parameter of the structured data,
+// truncated at escape sequences to fit into the message. If the message does
+// not fit even without payload data, the message text and then parameters
+// from the last one are dropped as a whole, so that the message is never cut
+// in the middle of the structured data.
+func (s *SyslogSink) formatRFC5424(r *syslogRecord) ([]byte, error) {
+	head := fmt.Sprintf("<%d>1 %s %s tcppc %s %s [%s", s.opts.Facility*8+r.severity,
+		r.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"), s.hostname, s.procID, r.msgID, syslogSDID)
+	text := " " + r.message
+
+	size := len(head) + len("]") + len(text)
+	params := make([]string, len(r.fields))
+	for i, f := range r.fields {
+		params[i] = fmt.Sprintf(" %s=\"%s\"", f.name, escapeSDValue(f.value))
+		size += len(params[i])
+	}
+
+	const dataParam, dataTruncatedParam, fieldsTruncatedParam = ` data="`, ` data_truncated="true"`, ` fields_truncated="true"`
+	var data string
+	truncated := r.truncated
+	if len(r.data) > 0 {
+		limit := s.opts.MaxSize - size - len(dataParam) - len(`"`) - len(dataTruncatedParam)
+		escaped, n := escapeSyslogData(r.data, limit)
+		if n < len(r.data) {
+			truncated = true
+		}
+		if escaped != "" {
+			data = dataParam + escaped + `"`
+		}
+	}
+	if truncated {
+		data += dataTruncatedParam
+	}
+	size += len(data)
+
+	if size > s.opts.MaxSize {
+		size -= len(text)
+		text = ""
+	}
+	fieldsTruncated := false
+	for size > s.opts.MaxSize && len(params) > 0 {
+		if !fieldsTruncated {
+			fieldsTruncated = true
+			size += len(fieldsTruncatedParam)
+		}
+		size -= len(params[len(params)-1])
+		params = params[:len(params)-1]
+	}
+	if size > s.opts.MaxSize {
+		return nil, fmt.Errorf("Message does not fit into %d bytes: %d bytes", s.opts.MaxSize, size)
+	}
+
+	if truncated || fieldsTruncated {
+		s.truncated.inc()
+	}
+
+	msg := make([]byte, 0, size)
+	msg = append(msg, head...)
+	for _, param := range params {
+		msg = append(msg, param...)
+	}
+	msg = append(msg, data...)
+	if fieldsTruncated {
+		msg = append(msg, fieldsTruncatedParam...)
+	}
+	msg = append(msg, ']')
+	msg = append(msg, text...)
+
+	return msg, nil
+}
+
+// appendJournalField appends a field of the native protocol of journald.
+// Values with newlines are written in the binary-safe form.
+func appendJournalField(buf []byte, name string, value []byte) []byte {
+	if bytes.IndexByte(value, '\n') >= 0 {
+		return appendJournalBinary(buf, name, value)
+	}
+
+	buf = append(buf, name...)
+	buf = append(buf, '=')
+	buf = append(buf, value...)
+	return append(buf, '\n')
+}
+
+// appendJournalBinary appends a field in the binary-safe form (the name, a
+// newline, the size of the value in little-endian uint64, the value and a
+// newline).
+func appendJournalBinary(buf []byte, name string, value []byte) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, '\n')
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(value)))
+	buf = append(buf, value...)
+	return append(buf, '\n')
+}
+
+// formatJournal formats the record as an entry of the native protocol of
+// journald of at most MaxSize bytes. Fields of the session are prefixed with
+// TCPPC_, and payload data are TCPPC_DATA (binary), truncated to fit into the
+// entry. If the entry does not fit even without payload data, fields are
+// dropped from the last one.
+func (s *SyslogSink) formatJournal(r *syslogRecord) ([]byte, error) {
+	var buf []byte
+	buf = appendJournalField(buf, "MESSAGE", []byte(r.message))
+	buf = appendJournalField(buf, "PRIORITY", []byte(strconv.Itoa(r.severity)))
+	buf = appendJournalField(buf, "SYSLOG_FACILITY", []byte(strconv.Itoa(s.opts.Facility)))
+	buf = appendJournalField(buf, "SYSLOG_IDENTIFIER", []byte("tcppc"))
+	buf = appendJournalField(buf, "TCPPC_MSGID", []byte(r.msgID))
+	buf = appendJournalField(buf, "TCPPC_START", []byte(r.timestamp.UTC().Format(time.RFC3339Nano)))
+
+	size := len(buf)
+	fields := make([][]byte, len(r.fields))
+	for i, f := range r.fields {
+		fields[i] = appendJournalField(nil, "TCPPC_"+strings.ToUpper(f.name), []byte(f.value))
+		size += len(fields[i])
+	}
+
+	const dataTruncatedField, fieldsTruncatedField = "TCPPC_DATA_TRUNCATED=1\n", "TCPPC_FIELDS_TRUNCATED=1\n"
+	var data []byte
+	truncated := r.truncated
+	if len(r.data) > 0 {
+		// Name, size and newline of the binary-safe form.
+		limit := s.opts.MaxSize - size - len(dataTruncatedField) - len("TCPPC_DATA\n") - 8 - 1
+		if limit < 0 {
+			limit = 0
+		}
+		data = r.data
+		if len(data) > limit {
+			data = data[:limit]
+			truncated = true
+		}
+		if len(data) > 0 {
+			data = appendJournalBinary(nil, "TCPPC_DATA", data)
+		}
+	}
+	if truncated {
+		data = append(data, dataTruncatedField...)
+	}
+	size += len(data)
+
+	fieldsTruncated := false
+	for size > s.opts.MaxSize && len(fields) > 0 {
+		if !fieldsTruncated {
+			fieldsTruncated = true
+			size += len(fieldsTruncatedField)
+		}
+		size -= len(fields[len(fields)-1])
+		fields = fields[:len(fields)-1]
+	}
+	if size > s.opts.MaxSize {
+		return nil, fmt.Errorf("Journal entry does not fit into %d bytes: %d bytes", s.opts.MaxSize, size)
+	}
+
+	if truncated || fieldsTruncated {
+		s.truncated.inc()
+	}
+
+	for _, field := range fields {
+		buf = append(buf, field...)
+	}
+	buf = append(buf, data...)
+	if fieldsTruncated {
+		buf = append(buf, fieldsTruncatedField...)
+	}
+
+	return buf, nil
+}
+
+// enqueue formats the record and puts it into the queue without blocking.
+func (s *SyslogSink) enqueue(r *syslogRecord) error {
+	s.queueMutex.RLock()
+	defer s.queueMutex.RUnlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	var msg []byte
+	var err error
+	if s.opts.Network == SyslogJournald {
+		msg, err = s.formatJournal(r)
+	} else {
+		msg, err = s.formatRFC5424(r)
+	}
+	if err != nil {
+		s.lost.inc()
+		return err
+	}
+
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		s.dropped.inc()
+		return ErrQueueFull
+	}
+}
+
+// run sends messages in the queue until the sink is closed.
+func (s *SyslogSink) run() {
+	defer close(s.stopped)
+
+	for msg := range s.queue {
+		s.send(msg)
+	}
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// send sends a message. It is lost if the server is not available.
+func (s *SyslogSink) send(msg []byte) {
+	if !s.retryAt.IsZero() && time.Now().Before(s.retryAt) {
+		s.lost.inc()
+		return
+	}
+
+	err := s.connect()
+	if err == nil {
+		err = s.write(msg)
+	}
+	if err != nil {
+		s.lost.inc()
+		log.Printf("Syslog: %s (retry in %s)\n", err, s.retryDelay)
+
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		s.retryAt = time.Now().Add(s.retryDelay)
+		if s.retryDelay *= 2; s.retryDelay > syslogMaxRetryDelay {
+			s.retryDelay = syslogMaxRetryDelay
+		}
+		return
+	}
+
+	s.sent.inc()
+	s.retryAt = time.Time{}
+	s.retryDelay = syslogRetryDelay
+}
+
+// write writes a message to the connection. Messages over TCP are framed by
+// octet counting (RFC 6587 and RFC 5425).
+func (s *SyslogSink) write(msg []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+
+	if s.opts.Network == SyslogTCP || s.opts.Network == SyslogTLS {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	n, err := s.conn.Write(msg)
+	if err != nil {
+		return fmt.Errorf("Failed to send message: %w", err)
+	}
+	if n < len(msg) {
+		return errors.New("Failed to send message: short write")
+	}
+
+	return nil
+}
+
+// Stats returns the current statistics of the sink.
+func (s *SyslogSink) Stats() SyslogStats {
+	return SyslogStats{
+		Sent:      s.sent.count(),
+		Dropped:   s.dropped.count(),
+		Lost:      s.lost.count(),
+		Truncated: s.truncated.count(),
+	}
+}
+
+// Close sends all queued messages and stops the sender goroutine.
+func (s *SyslogSink) Close() error {
+	s.queueMutex.Lock()
+	if s.closed {
+		s.queueMutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.queueMutex.Unlock()
+
+	<-s.stopped
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package tcppc
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// newTestSyslogSink returns a sink which formats messages without
+// connecting to the server.
+func newTestSyslogSink(network string, maxSize int) *SyslogSink {
+	return &SyslogSink{
+		opts:      SyslogOptions{Network: network, Facility: DefaultSyslogFacility, MaxSize: maxSize},
+		hostname:  "sensor-1",
+		procID:    "1234",
+		lost:      NewSessionCounter(),
+		truncated: NewSessionCounter(),
+	}
+}
+
+// newTestSyslogRecord returns a record whose fields and payload data are
+// longer than MaxSize.
+func newTestSyslogRecord(tags, data int) *syslogRecord {
+	session := newTestSession(23)
+	session.Sensor = &SensorInfo{Name: "sensor-1", Tags: []string{strings.Repeat("タグ", tags)}}
+	session.TLS = &TLSInfo{Version: "1.3", ServerName: "example.com"}
+
+	return &syslogRecord{
+		msgID:     "session",
+		timestamp: session.Timestamp,
+		severity:  syslogSeverityInfo,
+		fields: syslogFields(session.ID, session.Flow, session.Sensor, session.Listener, session.CommunityID, session.TLS,
+			session.EndTimestamp, len(session.Payloads), session.NumBytes(), session.Rejected, session.Truncated, session.MaxDuration),
+		message: syslogMessage(session.Flow, len(session.Payloads), session.NumBytes(), session.Rejected),
+		data:    bytes.Repeat([]byte("\"]\xe3\x81\x82"), data),
+	}
+}
+
+// checkStructuredData checks that the structured data of the message are
+// closed, i.e. the message is not cut in the middle of them.
+func checkStructuredData(t *testing.T, msg []byte) string {
+	t.Helper()
+
+	start := bytes.IndexByte(msg, '[')
+	if start < 0 {
+		t.Fatalf("Message has no structured data: %s", msg)
+	}
+
+	inValue := false
+	for i := start + 1; i < len(msg); i++ {
+		switch {
+		case inValue && msg[i] == '\\':
+			i++
+		case msg[i] == '"':
+			inValue = !inValue
+		case !inValue && msg[i] == ']':
+			return string(msg[start : i+1])
+		}
+	}
+
+	t.Fatalf("Structured data are not closed: %s", msg)
+	return ""
+}
+
+func TestSyslogFormatRFC5424(t *testing.T) {
+	tests := []struct {
+		name string
+		// Sizes of the record.
+		tags, data int
+		// Expected parts of the message.
+		text, dataTruncated, fieldsTruncated bool
+	}{
+		{"fits", 1, 4, true, false, false},
+		{"data truncated", 1, 200, true, true, false},
+		{"fields dropped", 200, 200, false, true, true},
+	}
+
+	for _, tt := range tests {
+		s := newTestSyslogSink(SyslogUDP, 1024)
+
+		msg, err := s.formatRFC5424(newTestSyslogRecord(tt.tags, tt.data))
+		if err != nil {
+			t.Fatalf("%s: Failed to format the message: %s", tt.name, err)
+		}
+
+		if len(msg) > s.opts.MaxSize {
+			t.Errorf("%s: Size = %d, want at most %d", tt.name, len(msg), s.opts.MaxSize)
+		}
+		if !utf8.Valid(msg) {
+			t.Errorf("%s: Message is not valid UTF-8: %q", tt.name, msg)
+		}
+
+		sd := checkStructuredData(t, msg)
+		if got := strings.HasSuffix(string(msg), " bytes)"); got != tt.text {
+			t.Errorf("%s: Message text is written: %t, want %t: %s", tt.name, got, tt.text, msg)
+		}
+		if got := strings.Contains(sd, ` data_truncated="true"`); got != tt.dataTruncated {
+			t.Errorf("%s: data_truncated: %t, want %t: %s", tt.name, got, tt.dataTruncated, msg)
+		}
+		if got := strings.Contains(sd, ` fields_truncated="true"`); got != tt.fieldsTruncated {
+			t.Errorf("%s: fields_truncated: %t, want %t: %s", tt.name, got, tt.fieldsTruncated, msg)
+		}
+		if !strings.Contains(sd, ` id="`) {
+			t.Errorf("%s: ID is dropped: %s", tt.name, msg)
+		}
+	}
+}
+
+func TestSyslogFormatRFC5424TooLarge(t *testing.T) {
+	s := newTestSyslogSink(SyslogUDP, 40)
+
+	if msg, err := s.formatRFC5424(newTestSyslogRecord(1, 4)); err == nil {
+		t.Errorf("Message larger than MaxSize is formatted: %s", msg)
+	}
+}
+
+func TestSyslogFormatJournal(t *testing.T) {
+	for _, tags := range []int{1, 200} {
+		s := newTestSyslogSink(SyslogJournald, 1024)
+
+		entry, err := s.formatJournal(newTestSyslogRecord(tags, 200))
+		if err != nil {
+			t.Fatalf("Failed to format the entry: %s", err)
+		}
+
+		if len(entry) > s.opts.MaxSize {
+			t.Errorf("Size = %d, want at most %d", len(entry), s.opts.MaxSize)
+		}
+		if !bytes.Contains(entry, []byte("TCPPC_DATA_TRUNCATED=1\n")) {
+			t.Errorf("Payload data are not marked as truncated: %q", entry)
+		}
+		if got := bytes.Contains(entry, []byte("TCPPC_FIELDS_TRUNCATED=1\n")); got != (tags > 1) {
+			t.Errorf("TCPPC_FIELDS_TRUNCATED: %t, want %t: %q", got, tags > 1, entry)
+		}
+	}
+}
@@ -1,68 +1,49 @@
 package tcppc
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net"
-	"syscall"
-	"time"
 )
 
-func HandleTCPSession(conn *net.TCPConn, writer *RotWriter, timeout int) {
+func (s *Server) handleTCPSession(conn *net.TCPConn) {
 	defer conn.Close()
-	defer counter.dec()
-	counter.inc()
+	defer s.active.dec()
+	s.active.inc()
+	s.sessions.inc()
 
 	var src, dst *net.TCPAddr
 	src = conn.RemoteAddr().(*net.TCPAddr)
 	dst = conn.LocalAddr().(*net.TCPAddr)
 
 	flow := NewTCPFlow(src, dst)
-	session := NewSession(flow)
+	session := s.newSession(flow)
 
-	log.Printf("TCP: Established: %s (#Sessions: %d)\n", session, counter.count())
+	log.Printf("TCP: Established: %s (#Sessions: %d)\n", session, s.active.count())
 
-	var length uint
-	var err error
+	s.writeEvent(NewSessionStartEvent(session))
 
-	buf := make([]byte, 4096)
-
-	for {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-
-		length, err := conn.Read(buf)
-		if err != nil {
-			break
-		}
-
-		data := make([]byte, length)
-		copy(data, buf[:length])
+	if s.opts.Hooks.OnSessionStart != nil {
+		s.opts.Hooks.OnSessionStart(session)
+	}
 
-		session.AddPayload(data)
+	err := s.receivePayloads(conn, session)
 
-		log.Printf("TCP: Received: %s: %q (%d bytes)\n", session, buf[:length], length)
-	}
+	s.writeSession(session)
 
-	if writer != nil {
-		outputJson, err := json.Marshal(session)
-		if err == nil {
-			log.Printf("Wrote data: %s\n", session)
-			writer.Write(outputJson)
-		} else {
-			log.Printf("Failed to encode data as json: %s\n", err)
-		}
+	if s.opts.Hooks.OnSessionEnd != nil {
+		s.opts.Hooks.OnSessionEnd(session)
 	}
 
-	if length == 0 {
-		log.Printf("Closed: %s (#Sessions: %d)\n", session, counter.count())
+	if err == nil {
+		log.Printf("Closed: %s (#Sessions: %d)\n", session, s.active.count())
 	} else {
-		log.Printf("Aborted: %s %s (#Sessions: %d)\n", session, err, counter.count())
+		log.Printf("Aborted: %s %s (#Sessions: %d)\n", session, err, s.active.count())
 	}
 }
 
-func StartTCPServer(host string, port int, writer *RotWriter, timeout int) {
-	log.Printf("Server Mode: TCP\n")
-	log.Printf("Listen: %s:%d\n", host, port)
+func listenTCP(host string, port int) (*net.TCPListener, error) {
+	log.Printf("Listen: %s:%d (TCP)\n", host, port)
 
 	addr := &net.TCPAddr{
 		IP:   net.ParseIP(host),
@@ -71,32 +52,52 @@ func StartTCPServer(host string, port int, writer *RotWriter, timeout int) {
 
 	ln, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		log.Fatalf("Failed to listen TCP socket: %s\n", err)
+		return nil, fmt.Errorf("Failed to listen TCP socket: %w", err)
 	}
-	defer ln.Close()
 
-	file, err := ln.File()
-	if err != nil {
-		log.Fatalf("Failed to get a file descriptor of the listener: %s\n", err)
+	if err := setTransparent(ln); err != nil {
+		ln.Close()
+		return nil, err
 	}
-	defer file.Close()
 
-	fd := int(file.Fd())
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
-		log.Fatalf("Failed to set socket option (IP_TRANSPARENT): %s\n", err)
-	}
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
-		log.Fatalf("Failed to set socket option (IP_RECVORIGDSTADDR): %s\n", err)
-	}
+	return ln, nil
+}
 
+func (s *Server) serveTCP(ln *net.TCPListener) error {
 	log.Printf("Start TCP server.\n")
 
+	backoff := s.newAcceptBackoff("TCP")
+
 	for {
 		conn, err := ln.AcceptTCP()
 		if err != nil {
-			log.Fatalf("Failed to accept a new connection: %s\n", err)
+			if s.isClosing() {
+				return nil
+			}
+			if err := backoff.retry(err); err != nil {
+				return err
+			}
+			continue
+		}
+		backoff.reset()
+
+		src := conn.RemoteAddr().(*net.TCPAddr)
+		if reason := s.opts.Limiter.Acquire(src.IP); reason != "" {
+			conn.Close()
+			s.rejectSession(NewTCPFlow(src, conn.LocalAddr().(*net.TCPAddr)), reason)
+			continue
+		}
+
+		if !s.trackConn(conn) {
+			s.opts.Limiter.Release(src.IP)
+			conn.Close()
+			return nil
 		}
 
-		go HandleTCPSession(conn, writer, timeout)
+		go func() {
+			defer s.untrackConn(conn)
+			defer s.opts.Limiter.Release(src.IP)
+			s.handleTCPSession(conn)
+		}()
 	}
 }
@@ -2,104 +2,95 @@ package tcppc
 
 import (
 	"crypto/tls"
-	"encoding/json"
 	"log"
 	"net"
-	"syscall"
 	"time"
 )
 
-func HandleTLSSession(conn *tls.Conn, writer *RotWriter, timeout int) {
+func (s *Server) handleTLSSession(conn *tls.Conn, hello *helloRecorder) {
 	defer conn.Close()
-	defer counter.dec()
-	counter.inc()
+	defer s.active.dec()
+	s.active.inc()
+	s.sessions.inc()
 
 	var src, dst *net.TCPAddr
 	src = conn.RemoteAddr().(*net.TCPAddr)
 	dst = conn.LocalAddr().(*net.TCPAddr)
 
 	flow := NewTLSFlow(src, dst)
-	session := NewSession(flow)
-
-	log.Printf("TLS: Established: %s (#Sessions: %d)\n", session, counter.count())
-
-	var length uint
-	var err error
+	session := s.newSession(flow)
+
+	// Finish the handshake first to write the attributes of TLS. If it
+	// fails, the session is still recorded with the ClientHello (if any), and
+	// receivePayloads returns the error.
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("TLS: Handshake failed: %s: %s\n", session, err)
+	}
+	session.TLS = newTLSInfo(conn.ConnectionState(), hello.clientHello())
 
-	buf := make([]byte, 4096)
+	log.Printf("TLS: Established: %s (#Sessions: %d)\n", session, s.active.count())
 
-	for {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
-
-		length, err := conn.Read(buf)
-		if err != nil {
-			break
-		}
+	s.writeEvent(NewSessionStartEvent(session))
 
-		data := make([]byte, length)
-		copy(data, buf[:length])
+	if s.opts.Hooks.OnSessionStart != nil {
+		s.opts.Hooks.OnSessionStart(session)
+	}
 
-		session.AddPayload(data)
+	err := s.receivePayloads(conn, session)
 
-		log.Printf("TLS: Received: %s: %q (%d bytes)\n", session, buf[:length], length)
-	}
+	s.writeSession(session)
 
-	if writer != nil {
-		outputJson, err := json.Marshal(session)
-		if err == nil {
-			log.Printf("Wrote data: %s\n", session)
-			writer.Write(outputJson)
-		} else {
-			log.Printf("Failed to encode data as json: %s\n", err)
-		}
+	if s.opts.Hooks.OnSessionEnd != nil {
+		s.opts.Hooks.OnSessionEnd(session)
 	}
 
-	if length == 0 {
-		log.Printf("Closed: %s (#Sessions: %d)\n", session, counter.count())
+	if err == nil {
+		log.Printf("Closed: %s (#Sessions: %d)\n", session, s.active.count())
 	} else {
-		log.Printf("Aborted: %s %s (#Sessions: %d)\n", session, err, counter.count())
+		log.Printf("Aborted: %s %s (#Sessions: %d)\n", session, err, s.active.count())
 	}
 }
 
-func StartTLSServer(host string, port int, config *tls.Config, writer *RotWriter, timeout int) {
-	log.Printf("Server Mode: TLS\n")
-	log.Printf("Listen: %s:%d\n", host, port)
-
-	addr := &net.TCPAddr{
-		IP:   net.ParseIP(host),
-		Port: port,
-	}
-
-	tcpLn, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		log.Fatalf("Failed to listen TCP socket: %s\n", err)
-	}
-	defer tcpLn.Close()
+func (s *Server) serveTLS(ln *net.TCPListener) error {
+	log.Printf("Start TLS server.\n")
 
-	file, err := tcpLn.File()
-	if err != nil {
-		log.Fatalf("Failed to get a file descriptor of the listener: %s\n", err)
-	}
-	defer file.Close()
+	backoff := s.newAcceptBackoff("TLS")
 
-	fd := int(file.Fd())
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
-		log.Fatalf("Failed to set socket option (IP_TRANSPARENT): %s\n", err)
-	}
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
-		log.Fatalf("Failed to set socket option (IP_RECVORIGDSTADDR): %s\n", err)
-	}
+	for {
+		tcpConn, err := ln.AcceptTCP()
+		if err != nil {
+			if s.isClosing() {
+				return nil
+			}
+			if err := backoff.retry(err); err != nil {
+				return err
+			}
+			continue
+		}
+		backoff.reset()
 
-	ln := tls.NewListener(tcpLn, config)
+		src := tcpConn.RemoteAddr().(*net.TCPAddr)
+		if reason := s.opts.Limiter.Acquire(src.IP); reason != "" {
+			tcpConn.Close()
+			s.rejectSession(NewTLSFlow(src, tcpConn.LocalAddr().(*net.TCPAddr)), reason)
+			continue
+		}
 
-	log.Printf("Start TLS server.\n")
+		// Record the ClientHello to fingerprint the client.
+		hello := newHelloRecorder(tcpConn)
+		conn := tls.Server(hello, s.opts.TLSConfig)
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Fatalf("Failed to accept a new connection: %s\n", err)
+		if !s.trackConn(conn) {
+			s.opts.Limiter.Release(src.IP)
+			conn.Close()
+			return nil
 		}
 
-		go HandleTLSSession(conn.(*tls.Conn), writer, timeout)
+		go func() {
+			defer s.untrackConn(conn)
+			defer s.opts.Limiter.Release(src.IP)
+			s.handleTLSSession(conn, hello)
+		}()
 	}
 }
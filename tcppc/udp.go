@@ -3,8 +3,8 @@ package tcppc
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"syscall"
@@ -45,57 +45,51 @@ func getOrigDst(oob []byte, oobn int) (*net.UDPAddr, error) {
 	return origDst, err
 }
 
-func HandleUDPSession(src, dst *net.UDPAddr, buf []byte, length int, writer *RotWriter) {
+func (s *Server) handleUDPSession(src, dst *net.UDPAddr, buf []byte, length int) {
+	s.datagrams.inc()
+
 	flow := NewUDPFlow(src, dst)
-	session := NewSession(flow)
+	session := s.newSession(flow)
 
 	data := make([]byte, length)
 	copy(data, buf[:length])
 
-	session.AddPayload(data)
+	payload := session.AddPayload(data)
 
 	log.Printf("UDP: Received: %s: %q (%d bytes)\n", session, buf[:length], length)
 
-	if writer != nil {
-		outputJson, err := json.Marshal(session)
-		if err == nil {
-			log.Printf("Wrote data: %s", session)
-			writer.Write(outputJson)
-		} else {
-			log.Printf("Failed to encode data as json: %s\n", err)
-		}
+	s.writeEvent(NewSessionStartEvent(session))
+	s.writeEvent(NewPayloadEvent(session, payload))
+
+	s.writeSession(session)
+
+	if s.opts.Hooks.OnUDPDatagram != nil {
+		s.opts.Hooks.OnUDPDatagram(session)
 	}
 }
 
-func StartUDPServer(host string, port int, writer *RotWriter) {
-	log.Printf("Server Mode: UDP\n")
-	log.Printf("Listen: %s:%d\n", host, port)
+func listenUDP(host string, port int) (*net.UDPConn, error) {
+	log.Printf("Listen: %s:%d (UDP)\n", host, port)
 
 	addr := &net.UDPAddr{
 		IP:   net.ParseIP(host),
-		Port: int(port),
+		Port: port,
 	}
 
 	ln, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Fatalf("Failed to listen UDP socket: %s\n", err)
+		return nil, fmt.Errorf("Failed to listen UDP socket: %w", err)
 	}
-	defer ln.Close()
 
-	file, err := ln.File()
-	if err != nil {
-		log.Fatalf("Failed to get a file descriptor of the listener: %s", err)
+	if err := setTransparent(ln); err != nil {
+		ln.Close()
+		return nil, err
 	}
-	defer file.Close()
 
-	fd := int(file.Fd())
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
-		log.Fatalf("Failed to set socket option (IP_TRANSPARENT): %s\n", err)
-	}
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
-		log.Fatalf("Failed to set socket option (IP_RECVORIGDSTADDR): %s\n", err)
-	}
+	return ln, nil
+}
 
+func (s *Server) serveUDP(ln *net.UDPConn) error {
 	log.Printf("Start UDP server.\n")
 
 	for {
@@ -104,6 +98,12 @@ func StartUDPServer(host string, port int, writer *RotWriter) {
 
 		length, oobn, _, src, err := ln.ReadMsgUDP(buf, oob)
 		if err != nil {
+			if s.isClosing() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Printf("Failed to read UDP message: %s\n", err)
 			continue
 		}
@@ -114,6 +114,10 @@ func StartUDPServer(host string, port int, writer *RotWriter) {
 			continue
 		}
 
-		go HandleUDPSession(src, origDst, buf, length, writer)
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.handleUDPSession(src, origDst, buf, length)
+		}()
 	}
 }
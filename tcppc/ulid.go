@@ -0,0 +1,95 @@
+package tcppc
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Crockford's base32 alphabet used by ULIDs.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidGenerator generates ULIDs (https://github.com/ulid/spec), which consist
+// of a timestamp in milliseconds (48 bits) and random bits (80 bits) and are
+// sorted by time as strings. ULIDs generated in the same millisecond are
+// monotonically increasing.
+type ulidGenerator struct {
+	lastTime int64
+	lastRand [10]byte
+	mutex    sync.Mutex
+}
+
+var ulids = &ulidGenerator{}
+
+// newULID returns a new ULID of the time t.
+func newULID(t time.Time) string {
+	return ulids.generate(t)
+}
+
+func (g *ulidGenerator) generate(t time.Time) string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	ms := t.UnixNano() / int64(time.Millisecond)
+
+	if ms > g.lastTime {
+		if _, err := rand.Read(g.lastRand[:]); err != nil {
+			return ""
+		}
+		g.lastTime = ms
+	} else {
+		// Keep IDs increasing in the same millisecond or even if the clock
+		// goes backwards.
+		if !g.increment() {
+			g.lastTime += 1
+		}
+		ms = g.lastTime
+	}
+
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(b[6:], g.lastRand[:])
+
+	return encodeULID(b)
+}
+
+// increment increments the random bits by one. It returns false on overflow.
+func (g *ulidGenerator) increment() bool {
+	for i := len(g.lastRand) - 1; i >= 0; i-- {
+		g.lastRand[i] += 1
+		if g.lastRand[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID encodes 128 bits into 26 characters of Crockford's base32.
+func encodeULID(b [16]byte) string {
+	var s [26]byte
+
+	// The first character holds the top 3 bits (128 = 3 + 25 * 5).
+	var acc uint
+	var bits uint
+	pos := 0
+
+	acc = uint(b[0]) >> 5
+	s[pos] = ulidAlphabet[acc&0x1f]
+	pos += 1
+
+	acc = uint(b[0]) & 0x1f
+	bits = 5
+	for i := 1; i < len(b); i++ {
+		acc = acc<<8 | uint(b[i])
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			s[pos] = ulidAlphabet[(acc>>bits)&0x1f]
+			pos += 1
+		}
+	}
+
+	return string(s[:])
+}
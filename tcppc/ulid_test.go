@@ -0,0 +1,82 @@
+package tcppc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	// The timestamp of the example of the specification
+	// (https://github.com/ulid/spec).
+	ms := int64(1469918176385)
+
+	var b [16]byte
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> uint(40-8*i))
+	}
+	for i := 6; i < len(b); i++ {
+		b[i] = 0xff
+	}
+
+	if got, want := encodeULID(b), "01ARYZ6S41ZZZZZZZZZZZZZZZZ"; got != want {
+		t.Errorf("encodeULID() = %q, want %q", got, want)
+	}
+}
+
+func TestULIDGeneratorOrder(t *testing.T) {
+	g := &ulidGenerator{}
+	now := time.Now()
+
+	times := []time.Time{
+		now,
+		// The same millisecond.
+		now,
+		now.Add(100 * time.Microsecond),
+		// Later.
+		now.Add(time.Millisecond),
+		now.Add(time.Second),
+		// The clock goes backwards.
+		now,
+		now.Add(-time.Hour),
+	}
+
+	var last string
+	for i, ts := range times {
+		id := g.generate(ts)
+		if len(id) != 26 {
+			t.Fatalf("Length of %q = %d, want 26", id, len(id))
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(ulidAlphabet, c) {
+				t.Fatalf("%q has an invalid character: %q", id, c)
+			}
+		}
+		if id <= last {
+			t.Errorf("ULID #%d %q is not greater than %q", i, id, last)
+		}
+		last = id
+	}
+}
+
+func TestULIDGeneratorTimestamp(t *testing.T) {
+	g := &ulidGenerator{}
+	t1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Millisecond)
+
+	// IDs of later times are greater whatever the random bits are.
+	id1, id2 := g.generate(t1), g.generate(t2)
+	if id1[:10] >= id2[:10] {
+		t.Errorf("Timestamp of %q is not less than that of %q", id1, id2)
+	}
+
+	// Random bits which overflow carry into the timestamp.
+	for i := range g.lastRand {
+		g.lastRand[i] = 0xff
+	}
+	id3 := g.generate(t2)
+	want := (&ulidGenerator{}).generate(t2.Add(time.Millisecond))
+	if id3 <= id2 || id3[:10] != want[:10] {
+		t.Errorf("Overflow of %q is not carried into the timestamp: %q", id2, id3)
+	}
+}
@@ -0,0 +1,11 @@
+package tcppc
+
+const (
+	// Version of tcppc.
+	Version = "0.4.0"
+
+	// Version of the format of session data (schema_version in each record).
+	// It is incremented when fields are removed or changed incompatibly; new
+	// optional fields do not change it. See schema/ for the JSON Schema.
+	SchemaVersion = 1
+)
@@ -1,10 +1,16 @@
 package tcppc
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/jehiah/go-strftime"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,121 +20,1152 @@ func fileExists(filename string) bool {
 	return err == nil
 }
 
+const (
+	// Behaviours when the write queue is full.
+	QueueBlock = "block"
+	QueueDrop  = "drop"
+
+	// Policies to sync files to disk.
+	SyncNever    = "never"
+	SyncInterval = "interval"
+	SyncAlways   = "always"
+
+	// Default size of the write queue.
+	DefaultQueueSize = 1024
+	// Default maximum number of open files.
+	DefaultMaxOpenFiles = 64
+)
+
+// Tokens in the filename format replaced with values of each session.
+const (
+	TokenProto  = "{proto}"
+	TokenDport  = "{dport}"
+	TokenDst    = "{dst}"
+	TokenSensor = "{sensor}"
+)
+
+// Value of tokens of data without a flow.
+const unknownToken = "unknown"
+
+// Maximum time to wait for the next rotation at once. The writer wakes up at
+// least this often to follow changes of the wall clock.
+const maxRotationWait = time.Minute
+
+// Size of the buffer of files. Queued sessions are written together up to
+// this size.
+const fileBufferSize = 64 * 1024
+
+// Interval of retries to open a file after failures.
+const openRetryInterval = 5 * time.Second
+
+// Suffix of files being written when WriterOptions.Partial is true.
+const partialSuffix = ".partial"
+
+// Maximum number of files closed to be appended to whose numbers of sessions
+// are kept (e.g. files of all ports closed by MaxOpenFiles during a port
+// scan). Files not kept are read to count sessions when they are opened
+// again.
+const maxFileCounts = 65536
+
+// ErrQueueFull is returned by Write when the session is dropped because the
+// write queue is full.
+var ErrQueueFull = errors.New("Write queue is full.")
+
+// WriterQueue configures the write queue and syncs of RotWriter.
+type WriterQueue struct {
+	// Maximum number of sessions waiting to be written.
+	Size int
+	// Behaviour when the queue is full (QueueBlock or QueueDrop).
+	OnFull string
+	// Policy to sync files to disk (SyncNever, SyncInterval or SyncAlways).
+	Sync string
+	// Interval of syncs for SyncInterval.
+	SyncPeriod time.Duration
+}
+
+func NewWriterQueue(size int, onFull, sync string, syncPeriod int) *WriterQueue {
+	return &WriterQueue{
+		Size:       size,
+		OnFull:     onFull,
+		Sync:       sync,
+		SyncPeriod: time.Duration(syncPeriod) * time.Second,
+	}
+}
+
+// WriterOptions configures RotWriter.
+type WriterOptions struct {
+	// Schedule of rotation (nil: files are not rotated by time).
+	Schedule Schedule
+	// Maximum size of a file in bytes (0: unlimited).
+	MaxFileSize int64
+	// Location used as timezone in the filename format and Schedule (nil:
+	// Local).
+	Location *time.Location
+	// Configuration of the write queue and syncs (nil: a queue of
+	// DefaultQueueSize which blocks when full, and files are not synced).
+	Queue *WriterQueue
+	// Directory where sessions are written while files can not be written
+	// (empty: sessions are lost).
+	SpoolDir string
+	// True to write to "<name>.partial" and rename it to "<name>" when the
+	// file is finalised (i.e. rotated or closed).
+	Partial bool
+	// Command invoked for each finalised file with its path, number of
+	// sessions and size in bytes (empty: none). See hookRunner.
+	HookCmd string
+	// Value of TokenSensor in the filename format.
+	Sensor string
+	// Maximum number of files open at once (0: DefaultMaxOpenFiles).
+	MaxOpenFiles int
+	// Files of a filename format with tokens are closed when no session is
+	// written for this duration (0: never).
+	IdleTimeout time.Duration
+	// Function which returns the header written at the beginning of each new
+	// file given the time when it is opened (nil: no header).
+	Header func(t time.Time) []byte
+	// Function called by the writer goroutine for each finalised file (nil:
+	// none). It must not block (e.g. S3Uploader.Enqueue).
+	OnFinal func(f FinalFile)
+}
+
+// WriterStats holds statistics of RotWriter.
+type WriterStats struct {
+	// Number of sessions waiting to be written.
+	Queued uint
+	// Number of sessions written to files.
+	Written uint
+	// Number of sessions dropped because the write queue is full.
+	Dropped uint
+	// Number of sessions written to the spool directory.
+	Spooled uint
+	// Number of sessions lost because they could not be written anywhere.
+	Lost uint
+	// Number of errors on opening and writing files.
+	Errors uint
+	// Number of failures of the hook command.
+	HookErrors uint
+	// Number of files open.
+	OpenFiles uint
+}
+
+// queuedData is session data waiting to be written.
+type queuedData struct {
+	// Filename format whose tokens are replaced.
+	key string
+	// Data w/ '\n'.
+	data []byte
+}
+
+// outFile is the state of the file written for each filename format whose
+// tokens are replaced (e.g. "data/tcp-80-%Y%m%d.jsonl").
+type outFile struct {
+	// Filename format whose tokens are replaced.
+	key string
+	// Current file object (nil: not opened or opening the file failed).
+	file *os.File
+	// Final name of the current file.
+	fileName string
+	// Filename derived from key (w/o suffix) of the current file.
+	baseName string
+	// Suffix number of the current file (0: no suffix).
+	suffix int
+	// Size of the current file in bytes.
+	fileSize int64
+	// Number of session data written to file.
+	numSessions uint
+	// Sessions not written to the file yet.
+	buf []byte
+	// Number of sessions in buf.
+	bufSessions uint
+	// True if data were written after the last sync.
+	dirty bool
+	// Time to retry to open the file after failures (zero: not failing).
+	retryAt time.Time
+	// Current spool file (nil: not spooling).
+	spool *os.File
+	// Last time when data were written.
+	lastWrite time.Time
+}
+
+// fileCount is the number of sessions in a file closed to be appended to,
+// and its size when it is closed.
+type fileCount struct {
+	sessions uint
+	size     int64
+}
+
+// RotWriter writes sessions to files rotated by time and size.
+//
+// Sessions are put into a bounded queue by Write and written by a single
+// writer goroutine with buffered I/O, so that session handlers do not wait
+// for the disk. The writer goroutine also rotates and syncs files.
+//
+// The filename format may contain tokens (TokenProto, TokenDport, TokenDst
+// and TokenSensor) to split sessions into files. A file is kept open for
+// each distinct filename up to MaxOpenFiles; the least recently written one
+// is closed to open another, and idle ones are closed after IdleTimeout.
+// Files are opened on demand after rotation. Unless Partial is true, a file
+// whose filename does not change across rotations (or restarts) is appended
+// to, and is finalised only when it is rotated to a file of another name.
+//
+// When a file can not be opened or written (e.g. the disk is full), the
+// writer retries to open it every openRetryInterval, and sessions are
+// written to a file in SpoolDir meanwhile. Sessions which can not be written
+// to the spool either are counted as lost.
 type RotWriter struct {
-	// Filename format w/ time indicators of strftime.
+	// Filename format w/ time indicators of strftime and tokens.
 	FileNameFmt string
-	// Rotation interval in second.
-	RotInt int64
-	// Rotation interval offset in second.
-	RotOffset int64
-	// Location used as timezone in FileNameFmt.
+	// Schedule of rotation (nil: files are not rotated by time).
+	Schedule Schedule
+	// Maximum size of a file in bytes (0: unlimited).
+	// The file is rotated before it exceeds this size.
+	MaxFileSize int64
+	// Location used as timezone in FileNameFmt and Schedule.
 	Location *time.Location
-	// Current file object.
-	file *os.File
-	// Last rotation time.
-	lstRotTime int64
-	// True if this writer is closed.
-	// This flag is used to make the update goroutine exit.
+	// Configuration of the write queue and syncs.
+	Queue *WriterQueue
+	// Directory where sessions are written while files can not be written
+	// (empty: sessions are lost).
+	SpoolDir string
+	// True to write to "<name>.partial" until the file is finalised.
+	Partial bool
+	// Command invoked for each finalised file (empty: none).
+	HookCmd string
+	// Value of TokenSensor.
+	Sensor string
+	// Maximum number of files open at once.
+	MaxOpenFiles int
+	// Duration after which idle files are closed (0: never).
+	IdleTimeout time.Duration
+	// Header of each new file (nil: no header).
+	Header func(t time.Time) []byte
+	// Function called for each finalised file (nil: none).
+	OnFinal func(f FinalFile)
+	// True if FileNameFmt contains tokens.
+	hasTokens bool
+	// Files keyed on the filename format whose tokens are replaced.
+	files map[string]*outFile
+	// Numbers of sessions in files closed to be appended to keyed by their
+	// names, so that they are not read to count sessions when they are
+	// opened again (at most maxFileCounts).
+	fileCounts map[string]fileCount
+	// Runner of HookCmd (nil: no hook).
+	hooks *hookRunner
+	// Next rotation time (zero: never).
+	nextRotTime time.Time
+	// Sessions waiting to be written by the writer goroutine.
+	queue chan queuedData
+	// True if this writer is closed (sessions are not queued any more).
 	closed bool
-	// Number of session data written to file.
-	numSessions int
-	// Mutex object for exclusive control of writing data to file.
+	// Mutex object for exclusive control of closed and queue.
+	queueMutex sync.RWMutex
+	// Closed when the writer goroutine exits.
+	stopped chan struct{}
+	// Error on closing the last files.
+	closeErr error
+	// Last time when the writer goroutine ran.
+	lstUpdate time.Time
+	// Owner of files and directories created by this writer (-1: unchanged).
+	uid int
+	gid int
+	// Mutex object for exclusive control of files.
 	mutex sync.RWMutex
+	// Statistics.
+	written    *SessionCounter
+	dropped    *SessionCounter
+	spooled    *SessionCounter
+	lost       *SessionCounter
+	errors     *SessionCounter
+	hookErrors *SessionCounter
 }
 
-func NewWriter(fileNameFmt string, rotInt, rotOffset int, loc *time.Location) *RotWriter {
+// NewWriter starts the writer goroutine. If the filename format has no
+// tokens, the first file is opened at once; otherwise, the base directory is
+// created. An error is returned if they fail.
+func NewWriter(fileNameFmt string, opts WriterOptions) (*RotWriter, error) {
+	if opts.Queue == nil {
+		opts.Queue = NewWriterQueue(DefaultQueueSize, QueueBlock, SyncNever, 0)
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+
 	w := &RotWriter{
-		FileNameFmt: fileNameFmt,
-		RotInt:      int64(rotInt),
-		RotOffset:   int64(rotOffset),
-		Location:    loc,
-		file:        nil,
-		lstRotTime:  0,
-		closed:      false,
-	}
-
-	go func() {
-		for {
-			if w.closed {
-				break
-			}
+		FileNameFmt:  fileNameFmt,
+		Schedule:     opts.Schedule,
+		MaxFileSize:  opts.MaxFileSize,
+		Location:     opts.Location,
+		Queue:        opts.Queue,
+		SpoolDir:     opts.SpoolDir,
+		Partial:      opts.Partial,
+		HookCmd:      opts.HookCmd,
+		Sensor:       opts.Sensor,
+		MaxOpenFiles: opts.MaxOpenFiles,
+		IdleTimeout:  opts.IdleTimeout,
+		Header:       opts.Header,
+		OnFinal:      opts.OnFinal,
+		hasTokens:    hasTokens(fileNameFmt),
+		files:        make(map[string]*outFile),
+		fileCounts:   make(map[string]fileCount),
+		closed:       false,
+		queue:        make(chan queuedData, opts.Queue.Size),
+		stopped:      make(chan struct{}),
+		uid:          -1,
+		gid:          -1,
+		written:      NewSessionCounter(),
+		dropped:      NewSessionCounter(),
+		spooled:      NewSessionCounter(),
+		lost:         NewSessionCounter(),
+		errors:       NewSessionCounter(),
+		hookErrors:   NewSessionCounter(),
+	}
 
-			w.update()
-			time.Sleep(100 * time.Millisecond)
+	if w.HookCmd != "" {
+		hooks, err := newHookRunner(w.HookCmd, w.hookErrors)
+		if err != nil {
+			return nil, err
+		}
+		w.hooks = hooks
+	}
+
+	now := time.Now()
+	w.lstUpdate = now
+
+	if w.hasTokens {
+		if err := w.mkdirAll(BaseDir(fileNameFmt)); err != nil {
+			w.closeHooks()
+			return nil, fmt.Errorf("Failed to create directories: %s (%w)", BaseDir(fileNameFmt), err)
+		}
+	} else {
+		if err := w.openFile(w.getFile(fileNameFmt, now), now.Unix()); err != nil {
+			w.closeHooks()
+			return nil, err
+		}
+	}
+	w.scheduleRotation(now)
+
+	go w.run()
+
+	return w, nil
+}
+
+// hasTokens returns true if the filename format contains any token.
+func hasTokens(fileNameFmt string) bool {
+	for _, token := range []string{TokenProto, TokenDport, TokenDst, TokenSensor} {
+		if strings.Contains(fileNameFmt, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitizeToken replaces characters which must not be in a path component.
+func sanitizeToken(value string) string {
+	if value == "" || value == "." || value == ".." {
+		return unknownToken
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '%', 0:
+			return '_'
 		}
-	}()
+		return r
+	}, value)
+}
+
+// expandTokens replaces tokens in FileNameFmt with values of the flow.
+func (w *RotWriter) expandTokens(flow *Flow) string {
+	if !w.hasTokens {
+		return w.FileNameFmt
+	}
+
+	proto, dport, dst := unknownToken, unknownToken, unknownToken
+	if flow != nil {
+		proto = flow.Proto
+		dport = strconv.Itoa(flow.Dport)
+		dst = flow.Dst.String()
+	}
+
+	r := strings.NewReplacer(
+		TokenProto, sanitizeToken(proto),
+		TokenDport, sanitizeToken(dport),
+		TokenDst, sanitizeToken(dst),
+		TokenSensor, sanitizeToken(w.Sensor),
+	)
 
-	return w
+	return r.Replace(w.FileNameFmt)
 }
 
-func (w *RotWriter) findFileName(ts int64) string {
+func (w *RotWriter) findFileName(key string, ts int64) string {
 	// Convert unix time to native time.
 	tmpTime := time.Unix(ts, 0).In(w.Location)
 
-	// Fill format of date and time in FileNameFmt.
-	fileNameFmt := w.FileNameFmt
-	fileName := strftime.Format(fileNameFmt, tmpTime)
+	// Fill format of date and time in the filename format.
+	fileName := strftime.Format(key, tmpTime)
 
 	return fileName
 }
 
+// getFile returns the file of key. If there are MaxOpenFiles files already,
+// the least recently written one is closed.
+// It must be called with the mutex held.
+func (w *RotWriter) getFile(key string, now time.Time) *outFile {
+	if f, ok := w.files[key]; ok {
+		return f
+	}
+
+	if len(w.files) >= w.MaxOpenFiles {
+		var lru *outFile
+		for _, f := range w.files {
+			if lru == nil || f.lastWrite.Before(lru.lastWrite) {
+				lru = f
+			}
+		}
+		w.releaseFile(lru)
+	}
+
+	f := &outFile{key: key, lastWrite: now}
+	w.files[key] = f
+
+	return f
+}
+
+// releaseFile flushes and closes the file, and forgets it.
+// It must be called with the mutex held.
+func (w *RotWriter) releaseFile(f *outFile) error {
+	w.flush(f)
+	err := w.closeFile(f, !w.reused(f, time.Now()))
+	w.closeSpool(f)
+
+	delete(w.files, f.key)
+
+	return err
+}
+
+// scheduleRotation computes the next rotation time after now.
+// It must be called with the mutex held.
+func (w *RotWriter) scheduleRotation(now time.Time) {
+	if w.Schedule == nil {
+		w.nextRotTime = time.Time{}
+		return
+	}
+
+	w.nextRotTime = w.Schedule.Next(now.In(w.Location))
+}
+
+// rotationWait returns the time to wait for the next rotation, which is
+// never longer than maxRotationWait (or IdleTimeout to close idle files in
+// time).
+func (w *RotWriter) rotationWait() time.Duration {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	wait := maxRotationWait
+	if w.hasTokens && w.IdleTimeout > 0 && w.IdleTimeout < wait {
+		wait = w.IdleTimeout
+	}
+	if !w.nextRotTime.IsZero() {
+		if d := time.Until(w.nextRotTime); d < wait {
+			wait = d
+		}
+	}
+
+	return wait
+}
+
+// run writes queued sessions, and rotates and syncs files until the queue is
+// closed by Close.
+//
+// The rotation timer is armed for the next rotation time, but never for
+// longer than maxRotationWait, and the wall clock is compared with the
+// rotation time on every wake-up. Therefore, rotations are not skipped even
+// if the process is paused (e.g. by GC or slow disks) or the wall clock
+// jumps; boundaries missed meanwhile are caught up with a single rotation.
+func (w *RotWriter) run() {
+	defer close(w.stopped)
+
+	var syncC <-chan time.Time
+	if w.Queue.Sync == SyncInterval && w.Queue.SyncPeriod > 0 {
+		ticker := time.NewTicker(w.Queue.SyncPeriod)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+
+	// The timer is reset only after update, so that writes and syncs, which
+	// may keep coming more often than the timer, do not postpone rotation,
+	// closing idle files and the health check (lstUpdate).
+	timer := time.NewTimer(w.rotationWait())
+	defer timer.Stop()
+
+	for {
+		select {
+		case item, ok := <-w.queue:
+			if !ok {
+				w.mutex.Lock()
+				for _, f := range w.files {
+					if err := w.releaseFile(f); err != nil && w.closeErr == nil {
+						w.closeErr = err
+					}
+				}
+				w.mutex.Unlock()
+				return
+			}
+			w.writeBatch(item)
+		case <-timer.C:
+			w.update()
+			timer.Reset(w.rotationWait())
+		case <-syncC:
+			w.sync()
+		}
+	}
+}
+
 func (w *RotWriter) update() {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	curTime := time.Now().Unix()
+	w.lstUpdate = time.Now()
+	w.rotateIfDue(w.lstUpdate)
+	w.closeIdleFiles(w.lstUpdate)
+}
+
+// rotateIfDue finalises all files if the rotation time has passed. New files
+// are opened when sessions are written to them.
+// It must be called with the mutex held.
+func (w *RotWriter) rotateIfDue(now time.Time) {
+	if w.nextRotTime.IsZero() || now.Before(w.nextRotTime) {
+		return
+	}
 
-	if curTime > w.lstRotTime && w.RotInt > 0 && (curTime%w.RotInt) == w.RotOffset {
-		if w.file != nil {
-			w.file.Close()
-			w.file = nil
+	for _, f := range w.files {
+		w.flush(f)
+		w.closeFile(f, !w.reused(f, now))
+	}
+	w.scheduleRotation(now)
+}
+
+// closeIdleFiles closes files of a filename format with tokens to which no
+// session is written for IdleTimeout.
+// It must be called with the mutex held.
+func (w *RotWriter) closeIdleFiles(now time.Time) {
+	if !w.hasTokens || w.IdleTimeout <= 0 {
+		return
+	}
 
-			log.Printf("Wrote %d session data.\n", w.numSessions)
+	for _, f := range w.files {
+		if now.Sub(f.lastWrite) >= w.IdleTimeout {
+			w.releaseFile(f)
 		}
 	}
+}
 
-	if w.file == nil {
-		fileName := w.findFileName(curTime)
-		dirName := filepath.Dir(fileName)
+// reopen opens the file to write to at now, and schedules a retry if it
+// fails. It must be called with the mutex held.
+func (w *RotWriter) reopen(f *outFile, now time.Time) {
+	if err := w.openFile(f, now.Unix()); err != nil {
+		w.fail(f, err)
+	}
+}
 
-		// Create directories if not exists.
-		if !fileExists(dirName) {
-			err := os.MkdirAll(dirName, 0755)
-			if err == nil {
-				log.Printf("Create directories: %s\n", dirName)
-			} else {
-				log.Fatalf("Failed to create directories: %s (%s)", dirName, err)
-			}
+// fail records the error and schedules a retry to open the file.
+// It must be called with the mutex held.
+func (w *RotWriter) fail(f *outFile, err error) {
+	w.errors.inc()
+	f.retryAt = time.Now().Add(openRetryInterval)
+
+	log.Printf("%s (retry in %s)\n", err, openRetryInterval)
+}
+
+// writeBatch writes data and sessions queued meanwhile, and syncs files if
+// the policy is SyncAlways.
+func (w *RotWriter) writeBatch(item queuedData) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	w.lstUpdate = now
+	w.rotateIfDue(now)
+
+	w.writeData(item, now)
+	for n := len(w.queue); n > 0; n-- {
+		w.writeData(<-w.queue, now)
+	}
+
+	for _, f := range w.files {
+		w.flush(f)
+	}
+
+	if w.Queue.Sync == SyncAlways {
+		w.syncFiles()
+	}
+}
+
+// writeData appends data to the buffer of the file.
+// It must be called with the mutex held.
+func (w *RotWriter) writeData(item queuedData, now time.Time) {
+	f := w.getFile(item.key, now)
+	f.lastWrite = now
+
+	// Open the file on demand, or retry to open it after failures.
+	if f.file == nil && !now.Before(f.retryAt) {
+		w.reopen(f, now)
+	}
+
+	// Rotate the file before it exceeds the maximum size.
+	size := f.fileSize + int64(len(f.buf))
+	if w.MaxFileSize > 0 && f.file != nil && size > 0 && size+int64(len(item.data)) > w.MaxFileSize {
+		w.flush(f)
+		if f.file != nil {
+			w.closeFile(f, true)
+			f.suffix += 1
+			w.reopen(f, now)
 		}
+	}
+
+	f.buf = append(f.buf, item.data...)
+	f.bufSessions += 1
+
+	if len(f.buf) >= fileBufferSize {
+		w.flush(f)
+	}
+}
+
+// flush writes the buffer to the file. If it fails, the file is closed and
+// the buffer is written to the spool.
+// It must be called with the mutex held.
+func (w *RotWriter) flush(f *outFile) {
+	if len(f.buf) == 0 {
+		return
+	}
 
-		file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if f.file != nil {
+		n, err := f.file.Write(f.buf)
 		if err == nil {
-			log.Printf("Created a session file: %s\n", fileName)
-		} else {
-			log.Fatalf("Failed to create a session file: %s (%s)\n", fileName, err)
+			f.fileSize += int64(n)
+			f.numSessions += f.bufSessions
+			f.dirty = true
+			f.retryAt = time.Time{}
+			w.written.add(f.bufSessions)
+			resetBuffer(f)
+
+			// The file is writable again.
+			w.closeSpool(f)
+			return
+		}
+
+		// Remove the partial data not to leave broken lines.
+		if n > 0 {
+			f.file.Truncate(f.fileSize)
 		}
 
-		w.lstRotTime = curTime
-		w.numSessions = 0
-		w.file = file
+		w.fail(f, fmt.Errorf("Failed to write to the session file: %s (%w)", f.file.Name(), err))
+
+		f.file.Close()
+		f.file = nil
 	}
+
+	w.spoolBuffer(f)
 }
 
-func (w *RotWriter) Write(data []byte) (n int, err error) {
+func resetBuffer(f *outFile) {
+	f.buf = f.buf[:0]
+	f.bufSessions = 0
+}
+
+// spoolBuffer writes the buffer to the spool file.
+// It must be called with the mutex held.
+func (w *RotWriter) spoolBuffer(f *outFile) {
+	defer resetBuffer(f)
+
+	if w.SpoolDir == "" {
+		w.lost.add(f.bufSessions)
+		log.Printf("Lost %d sessions (no spool directory)\n", f.bufSessions)
+		return
+	}
+
+	if f.spool == nil {
+		if err := w.openSpool(f); err != nil {
+			w.errors.inc()
+			w.lost.add(f.bufSessions)
+			log.Printf("Lost %d sessions: %s\n", f.bufSessions, err)
+			return
+		}
+	}
+
+	if _, err := f.spool.Write(f.buf); err != nil {
+		w.errors.inc()
+		w.lost.add(f.bufSessions)
+		log.Printf("Lost %d sessions: Failed to write to the spool file: %s (%s)\n", f.bufSessions, f.spool.Name(), err)
+		return
+	}
+
+	w.spooled.add(f.bufSessions)
+}
+
+// openSpool opens the spool file named after the path of the file (e.g.
+// "data_tcppc-20240101.jsonl" for "data/tcppc-20240101.jsonl").
+// It must be called with the mutex held.
+func (w *RotWriter) openSpool(f *outFile) error {
+	if err := os.MkdirAll(w.SpoolDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create the spool directory: %s (%w)", w.SpoolDir, err)
+	}
+
+	name := strings.TrimLeft(filepath.Clean(suffixedName(f.baseName, f.suffix)), string(filepath.Separator))
+	name = strings.ReplaceAll(name, string(filepath.Separator), "_")
+	fileName := filepath.Join(w.SpoolDir, name)
+
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create a spool file: %s (%w)", fileName, err)
+	}
+
+	if err := w.chown(fileName); err != nil {
+		log.Printf("Failed to change owner of the spool file: %s (%s)\n", fileName, err)
+	}
+
+	log.Printf("Spooling sessions to %s\n", fileName)
+
+	f.spool = file
+
+	return nil
+}
+
+// closeSpool closes the spool file (if any).
+// It must be called with the mutex held.
+func (w *RotWriter) closeSpool(f *outFile) {
+	if f.spool == nil {
+		return
+	}
+
+	f.spool.Close()
+
+	log.Printf("Stopped spooling sessions to %s\n", f.spool.Name())
+
+	f.spool = nil
+}
+
+func (w *RotWriter) sync() {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	w.numSessions += 1
+	w.syncFiles()
+}
 
-	// Write data to file with '\n'.
-	return w.file.Write(append(data, 0x0a))
+// syncFiles syncs files written after the last sync.
+// It must be called with the mutex held.
+func (w *RotWriter) syncFiles() {
+	for _, f := range w.files {
+		if f.file == nil || !f.dirty {
+			continue
+		}
+
+		if err := f.file.Sync(); err != nil {
+			log.Printf("Failed to sync the session file: %s (%s)\n", f.file.Name(), err)
+		}
+		f.dirty = false
+	}
 }
 
-func (w *RotWriter) Close() error {
+// suffixedName returns the filename with the suffix number (e.g. ".1").
+func suffixedName(baseName string, suffix int) string {
+	if suffix == 0 {
+		return baseName
+	}
+
+	return fmt.Sprintf("%s.%d", baseName, suffix)
+}
+
+// nextFileName returns the (final) filename of the file to write to at ts.
+// When the filename derived from the key has not changed, the file with
+// the current suffix is reused unless it is full or followed by a file of a
+// larger suffix (i.e. it has been finalised), so files are suffixed
+// deterministically (.1, .2, ...) even across restarts. If Partial is true,
+// files already finalised are never reused, while a partial file left by
+// the previous process is.
+func (w *RotWriter) nextFileName(f *outFile, ts int64) string {
+	baseName := w.findFileName(f.key, ts)
+	if baseName != f.baseName {
+		f.baseName = baseName
+		f.suffix = 0
+	}
+
+	for {
+		fileName := suffixedName(f.baseName, f.suffix)
+		if w.Partial {
+			if fileExists(fileName) {
+				f.suffix += 1
+				continue
+			}
+			fileName += partialSuffix
+		} else if fileExists(suffixedName(f.baseName, f.suffix+1)) {
+			f.suffix += 1
+			continue
+		}
+
+		if w.MaxFileSize <= 0 {
+			break
+		}
+		if info, err := os.Stat(fileName); err != nil || info.Size() < w.MaxFileSize {
+			break
+		}
+		f.suffix += 1
+	}
+
+	return suffixedName(f.baseName, f.suffix)
+}
+
+// openFile opens the file to write to at curTime.
+// It must be called with the mutex held.
+func (w *RotWriter) openFile(f *outFile, curTime int64) error {
+	finalName := w.nextFileName(f, curTime)
+	fileName := finalName
+	if w.Partial {
+		fileName += partialSuffix
+	}
+	dirName := filepath.Dir(fileName)
+
+	// Create directories if not exists.
+	if !fileExists(dirName) {
+		if err := w.mkdirAll(dirName); err != nil {
+			return fmt.Errorf("Failed to create directories: %s (%w)", dirName, err)
+		}
+
+		log.Printf("Create directories: %s\n", dirName)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create a session file: %s (%w)", fileName, err)
+	}
+
+	log.Printf("Created a session file: %s\n", fileName)
+
+	if err := w.chown(fileName); err != nil {
+		log.Printf("Failed to change owner of the session file: %s (%s)\n", fileName, err)
+	}
+
+	var fileSize int64
+	if info, err := file.Stat(); err == nil {
+		fileSize = info.Size()
+	}
+
+	// Sessions already in the file are counted when it is appended to, so
+	// that the number of sessions of the finalised file covers all of them.
+	// The count is kept when the current file is reopened (e.g. after
+	// rotation by time with the same filename) or a file closed to be
+	// appended to is opened again (e.g. after MaxOpenFiles files are open)
+	// unless it is changed meanwhile, and the file is read to count them
+	// otherwise (e.g. after restarts).
+	var numSessions uint
+	count, counted := w.fileCounts[finalName]
+	delete(w.fileCounts, finalName)
+	switch {
+	case fileSize == 0:
+	case finalName == f.fileName:
+		numSessions = f.numSessions
+	case counted && count.size == fileSize:
+		numSessions = count.sessions
+	default:
+		numSessions, err = w.countSessions(file, curTime)
+		if err != nil {
+			log.Printf("Failed to count sessions in the session file: %s (%s)\n", fileName, err)
+		}
+	}
+
+	if fileSize == 0 && w.Header != nil {
+		n, err := file.Write(w.Header(time.Unix(curTime, 0).In(w.Location)))
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("Failed to write the header: %s (%w)", fileName, err)
+		}
+		fileSize += int64(n)
+	}
+
+	f.numSessions = numSessions
+	f.fileSize = fileSize
+	f.file = file
+	f.fileName = finalName
+
+	return nil
+}
+
+// countSessions returns the number of sessions (i.e. lines except those of
+// the header) in the file.
+func (w *RotWriter) countSessions(file *os.File, curTime int64) (uint, error) {
+	var lines int
+	buf := make([]byte, fileBufferSize)
+	for offset := int64(0); ; {
+		n, err := file.ReadAt(buf, offset)
+		lines += bytes.Count(buf[:n], []byte("\n"))
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if w.Header != nil {
+		lines -= bytes.Count(w.Header(time.Unix(curTime, 0).In(w.Location)), []byte("\n"))
+	}
+	if lines < 0 {
+		lines = 0
+	}
+
+	return uint(lines), nil
+}
+
+// reused returns true if the current file of f would be opened again to
+// write to at now, i.e. files are not partial and the filename derived from
+// the key has not changed and the file is not full. Such a file is appended
+// to after it is closed, so it must not be finalised.
+// It must be called with the mutex held.
+func (w *RotWriter) reused(f *outFile, now time.Time) bool {
+	if w.Partial {
+		return false
+	}
+	if w.MaxFileSize > 0 && f.fileSize >= w.MaxFileSize {
+		return false
+	}
+
+	return w.findFileName(f.key, now.Unix()) == f.baseName
+}
+
+// closeFile syncs (unless the policy is SyncNever) and closes the current
+// file (if any). If final is true, it finalises the file: the partial file
+// is renamed to the final name and the hook is invoked. The buffer must be
+// flushed before.
+// It must be called with the mutex held.
+func (w *RotWriter) closeFile(f *outFile, final bool) error {
+	if f.file == nil {
+		return nil
+	}
+
+	var err error
+	if w.Queue.Sync != SyncNever {
+		err = f.file.Sync()
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && w.Partial {
+		if renameErr := os.Rename(f.file.Name(), f.fileName); renameErr != nil {
+			err = fmt.Errorf("Failed to rename: %w", renameErr)
+		}
+	}
+
+	switch {
+	case err != nil:
+		log.Printf("Failed to close the session file: %s (%s)\n", f.file.Name(), err)
+	case !final:
+		log.Printf("Closed a session file: %s (%d sessions, %d bytes, to be appended to)\n", f.fileName, f.numSessions, f.fileSize)
+
+		if len(w.fileCounts) >= maxFileCounts {
+			for name := range w.fileCounts {
+				delete(w.fileCounts, name)
+				break
+			}
+		}
+		w.fileCounts[f.fileName] = fileCount{sessions: f.numSessions, size: f.fileSize}
+	default:
+		log.Printf("Rotated a session file: %s (%d sessions, %d bytes)\n", f.fileName, f.numSessions, f.fileSize)
+
+		finalFile := FinalFile{Path: f.fileName, BaseDir: BaseDir(w.FileNameFmt), Sessions: f.numSessions, Size: f.fileSize}
+		if w.hooks != nil {
+			w.hooks.enqueue(finalFile)
+		}
+		if w.OnFinal != nil {
+			w.OnFinal(finalFile)
+		}
+	}
+
+	f.file = nil
+	f.dirty = false
+
+	return err
+}
+
+// BaseDir returns the directory which does not depend on time or tokens in
+// the given filename format (e.g. "data" for "data/%Y/%m/tcppc-%d.jsonl").
+func BaseDir(fileNameFmt string) string {
+	if i := strings.IndexAny(fileNameFmt, "%{"); i >= 0 {
+		fileNameFmt = fileNameFmt[:i]
+	}
+
+	return filepath.Dir(fileNameFmt)
+}
+
+// SetOwner changes the owner of files and directories under BaseDir created
+// by this writer to uid/gid, including those already created. This is used
+// when the process drops privileges after the writer is started as root.
+func (w *RotWriter) SetOwner(uid, gid int) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	w.uid = uid
+	w.gid = gid
+
+	for _, f := range w.files {
+		if f.file == nil {
+			continue
+		}
+		if err := w.chown(f.file.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chown changes the owner of path and its parent directories under BaseDir.
+// It must be called with the mutex held.
+func (w *RotWriter) chown(path string) error {
+	if w.uid < 0 && w.gid < 0 {
+		return nil
+	}
+
+	baseDir := filepath.Clean(BaseDir(w.FileNameFmt))
+
+	// Never change the owner of directories out of BaseDir.
+	if rel, err := filepath.Rel(baseDir, path); err != nil || strings.HasPrefix(rel, "..") {
+		return os.Lchown(path, w.uid, w.gid)
+	}
+
+	for p := filepath.Clean(path); p != baseDir && p != "." && p != "/"; p = filepath.Dir(p) {
+		if err := os.Lchown(p, w.uid, w.gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mkdirAll creates directories and changes their owner.
+// It must be called with the mutex held.
+func (w *RotWriter) mkdirAll(dirName string) error {
+	if err := os.MkdirAll(dirName, 0755); err != nil {
+		return err
+	}
+
+	return w.chown(dirName)
+}
+
+// Healthy returns false if the writer is closed, sessions can be written to
+// neither a file nor its spool, or the writer goroutine is stuck (e.g. by a
+// slow disk).
+func (w *RotWriter) Healthy() bool {
+	w.queueMutex.RLock()
+	closed := w.closed
+	w.queueMutex.RUnlock()
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	if closed || time.Since(w.lstUpdate) >= 2*maxRotationWait {
+		return false
+	}
+
+	for _, f := range w.files {
+		if f.file == nil && !f.retryAt.IsZero() && f.spool == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Stats returns the current statistics of the writer.
+func (w *RotWriter) Stats() WriterStats {
+	w.mutex.RLock()
+	openFiles := 0
+	for _, f := range w.files {
+		if f.file != nil {
+			openFiles += 1
+		}
+	}
+	w.mutex.RUnlock()
+
+	return WriterStats{
+		Queued:     uint(len(w.queue)),
+		Written:    w.written.count(),
+		Dropped:    w.dropped.count(),
+		Spooled:    w.spooled.count(),
+		Lost:       w.lost.count(),
+		Errors:     w.errors.count(),
+		HookErrors: w.hookErrors.count(),
+		OpenFiles:  uint(openFiles),
+	}
+}
+
+// Write puts data into the write queue. Tokens of the filename format are
+// replaced with "unknown". See WriteFlow.
+func (w *RotWriter) Write(data []byte) (n int, err error) {
+	return w.WriteFlow(nil, data)
+}
+
+// WriteFlow puts data of the flow into the write queue. Data are written
+// with '\n' by the writer goroutine later to the file whose name is given by
+// the filename format with tokens replaced with values of the flow. When the
+// queue is full, WriteFlow blocks or returns ErrQueueFull according to
+// Queue.OnFull.
+func (w *RotWriter) WriteFlow(flow *Flow, data []byte) (n int, err error) {
+	w.queueMutex.RLock()
+	defer w.queueMutex.RUnlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	// Copy data because it is written asynchronously.
+	line := make([]byte, len(data)+1)
+	copy(line, data)
+	line[len(data)] = 0x0a
+
+	item := queuedData{key: w.expandTokens(flow), data: line}
+
+	if w.Queue.OnFull == QueueDrop {
+		select {
+		case w.queue <- item:
+		default:
+			w.dropped.inc()
+			return 0, ErrQueueFull
+		}
+	} else {
+		w.queue <- item
+	}
+
+	return len(data), nil
+}
+
+// Close writes all queued sessions, stops the writer goroutine and closes
+// all files.
+func (w *RotWriter) Close() error {
+	w.queueMutex.Lock()
+	if w.closed {
+		w.queueMutex.Unlock()
+		return nil
+	}
 	w.closed = true
+	close(w.queue)
+	w.queueMutex.Unlock()
+
+	<-w.stopped
 
-	return w.file.Close()
+	w.closeHooks()
+
+	return w.closeErr
+}
+
+// closeHooks waits for the hook to be invoked for all finalised files.
+func (w *RotWriter) closeHooks() {
+	if w.hooks != nil {
+		w.hooks.close()
+	}
 }
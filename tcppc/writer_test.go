@@ -0,0 +1,590 @@
+package tcppc
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFlow(dport int) *Flow {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: dport}
+	return NewTCPFlow(src, dst)
+}
+
+// waitFor waits until cond returns true, and fails after timeout.
+func waitFor(t *testing.T, timeout time.Duration, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out: %s", msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// finalFiles collects files finalised by OnFinal.
+type finalFiles struct {
+	files []FinalFile
+	mutex sync.Mutex
+}
+
+func (f *finalFiles) add(file FinalFile) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.files = append(f.files, file)
+}
+
+func (f *finalFiles) get() []FinalFile {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]FinalFile{}, f.files...)
+}
+
+// countLines returns the number of lines in the file (-1: it does not
+// exist).
+func countLines(t *testing.T, fileName string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return -1
+	}
+	if err != nil {
+		t.Fatalf("Failed to read the file: %s", err)
+	}
+
+	return bytes.Count(data, []byte("\n"))
+}
+
+// writeLines writes n sessions without flows and closes the writer.
+func writeLines(t *testing.T, w *RotWriter, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if _, err := w.Write([]byte("{}")); err != nil {
+			t.Fatalf("Failed to write: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %s", err)
+	}
+}
+
+func TestRotWriterMaxFileSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "tcppc.jsonl")
+
+	// Files hold two sessions ("{}\n") each.
+	finals := &finalFiles{}
+	w, err := NewWriter(fileName, WriterOptions{MaxFileSize: 7, OnFinal: finals.add})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	writeLines(t, w, 5)
+
+	for name, want := range map[string]int{fileName: 2, fileName + ".1": 2, fileName + ".2": 1, fileName + ".3": -1} {
+		if got := countLines(t, name); got != want {
+			t.Errorf("Lines in %s = %d, want %d", name, got, want)
+		}
+	}
+
+	// The last file is not full, so it is appended to after restarts.
+	files := finals.get()
+	if len(files) != 2 || files[0].Path != fileName || files[1].Path != fileName+".1" {
+		t.Fatalf("Finalised files = %+v, want %s and %s.1", files, fileName, fileName)
+	}
+	if files[0].Sessions != 2 || files[0].Size != 6 {
+		t.Errorf("Finalised file = %+v, want 2 sessions and 6 bytes", files[0])
+	}
+
+	finals = &finalFiles{}
+	w, err = NewWriter(fileName, WriterOptions{MaxFileSize: 7, OnFinal: finals.add})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	writeLines(t, w, 2)
+
+	for name, want := range map[string]int{fileName + ".2": 2, fileName + ".3": 1} {
+		if got := countLines(t, name); got != want {
+			t.Errorf("Lines in %s = %d, want %d", name, got, want)
+		}
+	}
+
+	// Sessions written before the restart are counted.
+	files = finals.get()
+	if len(files) != 1 || files[0].Path != fileName+".2" || files[0].Sessions != 2 {
+		t.Errorf("Finalised files = %+v, want %s.2 with 2 sessions", files, fileName)
+	}
+}
+
+func TestRotWriterNextFileNameHybrid(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(filepath.Join(dir, "%Y%m%d%H%M.jsonl"), WriterOptions{
+		Schedule:    NewIntervalSchedule(60, 0),
+		MaxFileSize: 6,
+		Location:    time.UTC,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	defer w.Close()
+
+	f := &outFile{key: w.FileNameFmt}
+	ts := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC).Unix()
+	base := filepath.Join(dir, "202401010000.jsonl")
+
+	if got := w.nextFileName(f, ts); got != base {
+		t.Errorf("nextFileName() = %s, want %s", got, base)
+	}
+
+	// Full files are skipped, and a file which is not full is reused.
+	os.WriteFile(base, []byte("{}\n{}\n"), 0644)
+	os.WriteFile(base+".1", []byte("{}\n"), 0644)
+	if got := w.nextFileName(f, ts); got != base+".1" {
+		t.Errorf("nextFileName() = %s, want %s.1", got, base)
+	}
+
+	// The suffix starts over when the file is rotated by time.
+	if got, want := w.nextFileName(f, ts+60), filepath.Join(dir, "202401010001.jsonl"); got != want {
+		t.Errorf("nextFileName() = %s, want %s", got, want)
+	}
+}
+
+func TestRotWriterUpdateWithFrequentSyncs(t *testing.T) {
+	w, err := NewWriter(t.TempDir()+"/{dport}.jsonl", WriterOptions{
+		IdleTimeout: 200 * time.Millisecond,
+		// Syncs come more often than updates.
+		Queue: &WriterQueue{Size: 16, OnFull: QueueBlock, Sync: SyncInterval, SyncPeriod: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	defer w.Close()
+
+	if _, err := w.WriteFlow(newTestFlow(23), []byte("{}")); err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+	waitFor(t, time.Second, "the file is not opened", func() bool { return w.Stats().OpenFiles == 1 })
+
+	start := time.Now()
+	waitFor(t, 2*time.Second, "the idle file is not closed", func() bool { return w.Stats().OpenFiles == 0 })
+
+	w.mutex.RLock()
+	lstUpdate := w.lstUpdate
+	w.mutex.RUnlock()
+	if lstUpdate.Before(start) {
+		t.Errorf("Last update = %s, want after %s", lstUpdate, start)
+	}
+	if !w.Healthy() {
+		t.Error("Writer is not healthy.")
+	}
+}
+
+func writeFlows(t *testing.T, w *RotWriter, dports ...int) {
+	t.Helper()
+
+	for _, dport := range dports {
+		if _, err := w.WriteFlow(newTestFlow(dport), []byte("{}")); err != nil {
+			t.Fatalf("Failed to write: %s", err)
+		}
+	}
+}
+
+func TestRotWriterReopenEvictedFile(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(filepath.Join(dir, "{dport}.jsonl"), WriterOptions{MaxOpenFiles: 1})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+
+	written := func(n uint) func() bool {
+		return func() bool { return w.Stats().Written == n }
+	}
+
+	// The file of port 23 is closed to open that of port 80.
+	writeFlows(t, w, 23, 23, 80)
+	waitFor(t, time.Second, "sessions are not written", written(3))
+
+	// The file is not read to count sessions when it is opened again: it
+	// has no line of the same size here.
+	file23 := filepath.Join(dir, "23.jsonl")
+	if err := os.WriteFile(file23, bytes.Repeat([]byte("x"), 6), 0644); err != nil {
+		t.Fatalf("Failed to overwrite the file: %s", err)
+	}
+	writeFlows(t, w, 23)
+	waitFor(t, time.Second, "sessions are not written", written(4))
+
+	// The file is read to count sessions if it is changed meanwhile.
+	file80 := filepath.Join(dir, "80.jsonl")
+	f, err := os.OpenFile(file80, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open the file: %s", err)
+	}
+	f.Write([]byte("{}\n"))
+	f.Close()
+	writeFlows(t, w, 80)
+	waitFor(t, time.Second, "sessions are not written", written(5))
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %s", err)
+	}
+
+	for name, want := range map[string]uint{file23: 3, file80: 3} {
+		if got := w.fileCounts[name].sessions; got != want {
+			t.Errorf("Sessions in %s = %d, want %d", name, got, want)
+		}
+	}
+}
+
+// newBlockedWriter returns a writer whose goroutine is blocked on the mutex
+// (held by the caller) after it writes a session and takes another from the
+// queue.
+func newBlockedWriter(t *testing.T, queue *WriterQueue) *RotWriter {
+	t.Helper()
+
+	w, err := NewWriter(filepath.Join(t.TempDir(), "tcppc.jsonl"), WriterOptions{Queue: queue})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+
+	// The goroutine takes the mutex before it starts to wait for sessions.
+	writeFlows(t, w, 23)
+	waitFor(t, time.Second, "the session is not written", func() bool { return w.Stats().Written == 1 })
+
+	w.mutex.Lock()
+	writeFlows(t, w, 23)
+	waitFor(t, time.Second, "the session is not taken", func() bool { return len(w.queue) == 0 })
+
+	return w
+}
+
+func TestRotWriterQueueDrop(t *testing.T) {
+	w := newBlockedWriter(t, &WriterQueue{Size: 2, OnFull: QueueDrop, Sync: SyncNever})
+
+	for i, want := range []error{nil, nil, ErrQueueFull, ErrQueueFull} {
+		if _, err := w.Write([]byte("{}")); err != want {
+			t.Errorf("Write #%d = %v, want %v", i, err, want)
+		}
+	}
+
+	w.mutex.Unlock()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %s", err)
+	}
+
+	stats := w.Stats()
+	if stats.Written != 4 || stats.Dropped != 2 || stats.Queued != 0 {
+		t.Errorf("Stats = %+v, want 4 written and 2 dropped", stats)
+	}
+
+	if _, err := w.Write([]byte("{}")); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestRotWriterQueueBlock(t *testing.T) {
+	w := newBlockedWriter(t, &WriterQueue{Size: 1, OnFull: QueueBlock, Sync: SyncNever})
+
+	writeFlows(t, w, 23)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := w.Write([]byte("{}")); err != nil {
+			t.Errorf("Failed to write: %s", err)
+		}
+	}()
+
+	select {
+	case <-done:
+		t.Error("Write returned while the queue is full.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.mutex.Unlock()
+	<-done
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %s", err)
+	}
+
+	if stats := w.Stats(); stats.Written != 4 || stats.Dropped != 0 {
+		t.Errorf("Stats = %+v, want 4 written and none dropped", stats)
+	}
+}
+
+func TestRotWriterSync(t *testing.T) {
+	tests := []struct {
+		queue *WriterQueue
+		// True if the file is left unsynced after the session is written.
+		dirty bool
+	}{
+		{&WriterQueue{Size: 16, OnFull: QueueBlock, Sync: SyncNever}, true},
+		{&WriterQueue{Size: 16, OnFull: QueueBlock, Sync: SyncAlways}, false},
+		{&WriterQueue{Size: 16, OnFull: QueueBlock, Sync: SyncInterval, SyncPeriod: time.Hour}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.queue.Sync, func(t *testing.T) {
+			w, err := NewWriter(filepath.Join(t.TempDir(), "tcppc.jsonl"), WriterOptions{Queue: tt.queue})
+			if err != nil {
+				t.Fatalf("Failed to create the writer: %s", err)
+			}
+			defer w.Close()
+
+			writeFlows(t, w, 23)
+			waitFor(t, time.Second, "the session is not written", func() bool { return w.Stats().Written == 1 })
+
+			w.mutex.Lock()
+			dirty := w.files[w.FileNameFmt].dirty
+			w.mutex.Unlock()
+			if dirty != tt.dirty {
+				t.Errorf("Dirty = %t, want %t", dirty, tt.dirty)
+			}
+
+			// Files are synced by the ticker of SyncInterval.
+			if tt.queue.Sync == SyncInterval {
+				w.sync()
+				w.mutex.Lock()
+				dirty = w.files[w.FileNameFmt].dirty
+				w.mutex.Unlock()
+				if dirty {
+					t.Error("File is not synced.")
+				}
+			}
+		})
+	}
+}
+
+// newFailingWriter returns a writer whose file of port 23 can not be created
+// because a regular file is in the way of its directory.
+func newFailingWriter(t *testing.T, spoolDir string) (*RotWriter, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "23"), nil, 0644); err != nil {
+		t.Fatalf("Failed to create the file: %s", err)
+	}
+
+	w, err := NewWriter(filepath.Join(dir, "{dport}", "tcppc.jsonl"), WriterOptions{SpoolDir: spoolDir})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+
+	return w, dir
+}
+
+func TestRotWriterSpool(t *testing.T) {
+	spoolDir := t.TempDir()
+	w, dir := newFailingWriter(t, spoolDir)
+	defer w.Close()
+
+	writeFlows(t, w, 23, 23)
+	waitFor(t, time.Second, "sessions are not spooled", func() bool { return w.Stats().Spooled == 2 })
+
+	if stats := w.Stats(); stats.Written != 0 || stats.Lost != 0 || stats.Errors == 0 {
+		t.Errorf("Stats = %+v, want errors and neither written nor lost", stats)
+	}
+	if !w.Healthy() {
+		t.Error("Writer is not healthy while spooling.")
+	}
+
+	fileName := filepath.Join(dir, "23", "tcppc.jsonl")
+	spoolName := strings.ReplaceAll(strings.TrimLeft(fileName, "/"), "/", "_")
+	if got := countLines(t, filepath.Join(spoolDir, spoolName)); got != 2 {
+		t.Errorf("Lines in the spool file = %d, want 2", got)
+	}
+
+	// The file is written again once it can be opened (without waiting for
+	// openRetryInterval).
+	if err := os.Remove(filepath.Join(dir, "23")); err != nil {
+		t.Fatalf("Failed to remove the file: %s", err)
+	}
+	w.mutex.Lock()
+	w.files[fileName].retryAt = time.Now()
+	w.mutex.Unlock()
+
+	writeFlows(t, w, 23)
+	waitFor(t, time.Second, "the session is not written", func() bool { return w.Stats().Written == 1 })
+
+	if got := countLines(t, fileName); got != 1 {
+		t.Errorf("Lines in the session file = %d, want 1", got)
+	}
+	w.mutex.Lock()
+	spooling := w.files[fileName].spool != nil
+	w.mutex.Unlock()
+	if spooling {
+		t.Error("Spool file is not closed.")
+	}
+}
+
+func TestRotWriterLost(t *testing.T) {
+	blocked := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatalf("Failed to create the file: %s", err)
+	}
+
+	for name, spoolDir := range map[string]string{
+		"no spool":           "",
+		"spool not writable": filepath.Join(blocked, "spool"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w, _ := newFailingWriter(t, spoolDir)
+			defer w.Close()
+
+			writeFlows(t, w, 23)
+			waitFor(t, time.Second, "the session is not lost", func() bool { return w.Stats().Lost == 1 })
+
+			if w.Healthy() {
+				t.Error("Writer is healthy while sessions are lost.")
+			}
+		})
+	}
+}
+
+func TestRotWriterPartial(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "tcppc.jsonl")
+
+	// A partial file left by the previous process is appended to, and files
+	// already finalised are skipped.
+	os.WriteFile(fileName, []byte("{}\n{}\n"), 0644)
+	os.WriteFile(fileName+".1.partial", []byte("{}\n"), 0644)
+
+	finals := &finalFiles{}
+	w, err := NewWriter(fileName, WriterOptions{Partial: true, MaxFileSize: 7, OnFinal: finals.add})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	writeLines(t, w, 2)
+
+	for name, want := range map[string]int{
+		fileName:                2,
+		fileName + ".1":         2,
+		fileName + ".1.partial": -1,
+		fileName + ".2":         1,
+		fileName + ".2.partial": -1,
+	} {
+		if got := countLines(t, name); got != want {
+			t.Errorf("Lines in %s = %d, want %d", name, got, want)
+		}
+	}
+
+	// Partial files are finalised on Close as well.
+	files := finals.get()
+	if len(files) != 2 || files[0].Path != fileName+".1" || files[1].Path != fileName+".2" {
+		t.Fatalf("Finalised files = %+v, want %s.1 and %s.2", files, fileName, fileName)
+	}
+	if files[0].Sessions != 2 || files[0].Size != 6 {
+		t.Errorf("Finalised file = %+v, want 2 sessions and 6 bytes", files[0])
+	}
+}
+
+func TestRotWriterHook(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "tcppc.jsonl")
+	output := filepath.Join(dir, "hook.log")
+
+	script := filepath.Join(dir, "hook.sh")
+	os.WriteFile(script, []byte(`echo "$@ $TCPPC_FILE" >> `+output+"\n"), 0644)
+
+	// The hook is invoked once for each finalised file.
+	w, err := NewWriter(fileName, WriterOptions{MaxFileSize: 4, HookCmd: "sh " + script})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	writeLines(t, w, 2)
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read the output of the hook: %s", err)
+	}
+	if got, want := string(data), fileName+" 1 3 "+fileName+"\n"; got != want {
+		t.Errorf("Output of the hook = %q, want %q", got, want)
+	}
+
+	// Files appended to are not finalised.
+	os.Remove(output)
+	w, err = NewWriter(fileName+".1", WriterOptions{HookCmd: "sh " + script})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+	writeLines(t, w, 1)
+
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Hook is invoked for a file to be appended to: %v", err)
+	}
+}
+
+func TestRotWriterExpandTokens(t *testing.T) {
+	flow6 := NewUDPFlow(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53})
+
+	tests := []struct {
+		name   string
+		format string
+		sensor string
+		flow   *Flow
+		want   string
+	}{
+		{"no tokens", "data/tcppc-%Y.jsonl", "", newTestFlow(23), "data/tcppc-%Y.jsonl"},
+		{"tokens", "data/{proto}/{dport}/{dst}-{sensor}.jsonl", "s1", newTestFlow(23), "data/tcp/23/198.51.100.1-s1.jsonl"},
+		{"ipv6", "data/{dst}-{dport}.jsonl", "", flow6, "data/2001:db8::2-53.jsonl"},
+		{"no flow", "data/{proto}-{dport}.jsonl", "", nil, "data/unknown-unknown.jsonl"},
+		// Values do not escape the directory nor add time indicators.
+		{"sanitized", "data/{sensor}/x.jsonl", "../a/%Y", nil, "data/.._a__Y/x.jsonl"},
+		{"dot", "data/{sensor}/x.jsonl", "..", nil, "data/unknown/x.jsonl"},
+		{"empty", "data/{sensor}/x.jsonl", "", nil, "data/unknown/x.jsonl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &RotWriter{FileNameFmt: tt.format, Sensor: tt.sensor, hasTokens: hasTokens(tt.format)}
+			if got := w.expandTokens(tt.flow); got != tt.want {
+				t.Errorf("expandTokens() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotWriterMaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(filepath.Join(dir, "{dport}.jsonl"), WriterOptions{MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatalf("Failed to create the writer: %s", err)
+	}
+
+	// The file of port 80 is the least recently written one when that of
+	// port 443 is opened.
+	for i, dport := range []int{23, 80, 23, 443} {
+		writeFlows(t, w, dport)
+		waitFor(t, time.Second, "the session is not written", func() bool { return w.Stats().Written == uint(i+1) })
+	}
+
+	w.mutex.RLock()
+	_, open23 := w.files[filepath.Join(dir, "23.jsonl")]
+	_, open80 := w.files[filepath.Join(dir, "80.jsonl")]
+	w.mutex.RUnlock()
+	if !open23 || open80 {
+		t.Errorf("Files of port 23 and 80 open = %t and %t, want true and false", open23, open80)
+	}
+	if got := w.Stats().OpenFiles; got != 2 {
+		t.Errorf("Open files = %d, want 2", got)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %s", err)
+	}
+	for dport, want := range map[string]int{"23": 2, "80": 1, "443": 1} {
+		if got := countLines(t, filepath.Join(dir, dport+".jsonl")); got != want {
+			t.Errorf("Lines in the file of port %s = %d, want %d", dport, got, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package tcppc
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Token in the filename format of ZeekSink replaced with the name of the
+	// log ("conn" or "tcppc_payload").
+	TokenLog = "{log}"
+
+	zeekConnLog    = "conn"
+	zeekPayloadLog = "tcppc_payload"
+
+	// Format of the time of "#open" lines.
+	zeekOpenTimeFmt = "2006-01-02-15-04-05"
+
+	// Values of unset and empty fields.
+	zeekUnset = "-"
+	zeekEmpty = "(empty)"
+)
+
+// Fields and types of conn.log (the same as Zeek with the Community ID
+// plugin).
+var (
+	zeekConnFields = []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "proto", "service", "duration", "orig_bytes", "resp_bytes", "conn_state", "local_orig", "local_resp", "missed_bytes", "history", "orig_pkts", "orig_ip_bytes", "resp_pkts", "resp_ip_bytes", "tunnel_parents", "community_id"}
+	zeekConnTypes  = []string{"time", "string", "addr", "port", "addr", "port", "enum", "string", "interval", "count", "count", "string", "bool", "bool", "count", "string", "count", "count", "count", "count", "set[string]", "string"}
+
+	zeekPayloadFields = []string{"ts", "uid", "id.orig_h", "id.orig_p", "id.resp_h", "id.resp_p", "index", "data"}
+	zeekPayloadTypes  = []string{"time", "string", "addr", "port", "addr", "port", "count", "string"}
+)
+
+// ZeekSink writes sessions as Zeek-style TSV logs: conn.log which has a line
+// for each session, and tcppc_payload.log which has a line for each payload.
+// Lines of both logs share the uid derived from the session ID. Since tcppc
+// does not see packets, orig_pkts is the number of payloads, and fields
+// which tcppc does not know (e.g. history) are unset.
+type ZeekSink struct {
+	conn    *RotWriter
+	payload *RotWriter
+}
+
+// NewZeekSink opens writers of the logs. The filename format must contain
+// TokenLog (e.g. "zeek/%Y-%m-%d/{log}.%H.log"). Options are given to both
+// writers.
+func NewZeekSink(fileNameFmt string, opts WriterOptions) (*ZeekSink, error) {
+	if !strings.Contains(fileNameFmt, TokenLog) {
+		return nil, fmt.Errorf("Filename format of Zeek logs must contain %s: %s", TokenLog, fileNameFmt)
+	}
+
+	connOpts := opts
+	connOpts.Header = zeekHeader(zeekConnLog, zeekConnFields, zeekConnTypes)
+	conn, err := NewWriter(strings.Replace(fileNameFmt, TokenLog, zeekConnLog, -1), connOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadOpts := opts
+	payloadOpts.Header = zeekHeader(zeekPayloadLog, zeekPayloadFields, zeekPayloadTypes)
+	payload, err := NewWriter(strings.Replace(fileNameFmt, TokenLog, zeekPayloadLog, -1), payloadOpts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &ZeekSink{conn: conn, payload: payload}, nil
+}
+
+// zeekHeader returns the function which returns the header of a log.
+func zeekHeader(path string, fields, types []string) func(t time.Time) []byte {
+	return func(t time.Time) []byte {
+		var b strings.Builder
+		b.WriteString("#separator \\x09\n")
+		b.WriteString("#set_separator\t,\n")
+		b.WriteString("#empty_field\t" + zeekEmpty + "\n")
+		b.WriteString("#unset_field\t" + zeekUnset + "\n")
+		b.WriteString("#path\t" + path + "\n")
+		b.WriteString("#open\t" + t.Format(zeekOpenTimeFmt) + "\n")
+		b.WriteString("#fields\t" + strings.Join(fields, "\t") + "\n")
+		b.WriteString("#types\t" + strings.Join(types, "\t") + "\n")
+		return []byte(b.String())
+	}
+}
+
+func (s *ZeekSink) Name() string {
+	return fmt.Sprintf("zeek (%s)", s.conn.FileNameFmt)
+}
+
+// SetOwner changes the owner of the logs.
+func (s *ZeekSink) SetOwner(uid, gid int) error {
+	if err := s.conn.SetOwner(uid, gid); err != nil {
+		return err
+	}
+	return s.payload.SetOwner(uid, gid)
+}
+
+// Healthy returns false if any log can not be written.
+func (s *ZeekSink) Healthy() bool {
+	return s.conn.Healthy() && s.payload.Healthy()
+}
+
+func (s *ZeekSink) WriteSession(session *Session) error {
+	uid := zeekUID(session.ID)
+
+	for _, payload := range session.Payloads {
+		if _, err := s.payload.WriteFlow(session.Flow, zeekPayloadLine(uid, session.Flow, payload)); err != nil {
+			return err
+		}
+	}
+
+	end := session.Timestamp
+	if session.EndTimestamp != nil {
+		end = *session.EndTimestamp
+	}
+
+	line := zeekConnLine(uid, session.Timestamp, end, session.Flow, session.CommunityID, session.TLS, session.Rejected, len(session.Payloads), session.NumBytes())
+	_, err := s.conn.WriteFlow(session.Flow, line)
+	return err
+}
+
+func (s *ZeekSink) WriteEvent(event *Event) error {
+	uid := zeekUID(event.SessionID)
+
+	switch event.Type {
+	case EventPayload:
+		_, err := s.payload.WriteFlow(event.Flow, zeekPayloadLine(uid, event.Flow, event.Payload))
+		return err
+
+	case EventSessionEnd:
+		start := event.Timestamp
+		if event.Start != nil {
+			start = *event.Start
+		}
+
+		line := zeekConnLine(uid, start, event.Timestamp, event.Flow, event.CommunityID, event.TLS, event.Rejected, event.NumPayloads, event.NumBytes)
+		_, err := s.conn.WriteFlow(event.Flow, line)
+		return err
+	}
+
+	return nil
+}
+
+func (s *ZeekSink) Close() error {
+	return errors.Join(s.conn.Close(), s.payload.Close())
+}
+
+// zeekUID returns the uid of a session: "C" and 96 bits of the hash of the
+// session ID in base62 like Zeek.
+func zeekUID(sessionID string) string {
+	sum := sha1.Sum([]byte(sessionID))
+	return "C" + new(big.Int).SetBytes(sum[:12]).Text(62)
+}
+
+func zeekTime(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+func zeekConnLine(uid string, start, end time.Time, flow *Flow, communityID string, tlsInfo *TLSInfo, rejected string, numPayloads, numBytes int) []byte {
+	proto, service, state := "tcp", zeekUnset, "SF"
+	switch {
+	case rejected != "":
+		state = "REJ"
+	case flow.Proto == "udp":
+		proto, state = "udp", "S0"
+	}
+	if tlsInfo != nil && tlsInfo.Version != "" {
+		service = "ssl"
+	}
+	if communityID == "" {
+		communityID = zeekUnset
+	}
+
+	fields := []string{
+		zeekTime(start),
+		uid,
+		flow.Src.String(),
+		strconv.Itoa(flow.Sport),
+		flow.Dst.String(),
+		strconv.Itoa(flow.Dport),
+		proto,
+		service,
+		strconv.FormatFloat(end.Sub(start).Seconds(), 'f', 6, 64),
+		strconv.Itoa(numBytes),
+		"0",
+		state,
+		zeekUnset,
+		zeekUnset,
+		"0",
+		zeekUnset,
+		strconv.Itoa(numPayloads),
+		zeekUnset,
+		"0",
+		zeekUnset,
+		zeekUnset,
+		communityID,
+	}
+
+	return []byte(strings.Join(fields, "\t"))
+}
+
+func zeekPayloadLine(uid string, flow *Flow, payload *Payload) []byte {
+	fields := []string{
+		zeekTime(payload.Timestamp),
+		uid,
+		flow.Src.String(),
+		strconv.Itoa(flow.Sport),
+		flow.Dst.String(),
+		strconv.Itoa(flow.Dport),
+		strconv.FormatUint(uint64(payload.Index), 10),
+		zeekEscape(payload.Data),
+	}
+
+	return []byte(strings.Join(fields, "\t"))
+}
+
+// zeekEscape escapes data as Zeek does: non-printable bytes (including the
+// separator) and backslashes are written as \xNN.
+func zeekEscape(data []byte) string {
+	if len(data) == 0 {
+		return zeekEmpty
+	}
+	if string(data) == zeekUnset || string(data) == zeekEmpty {
+		return fmt.Sprintf("\\x%02x", data[0]) + string(data[1:])
+	}
+
+	var b strings.Builder
+	for _, c := range data {
+		if c < 0x20 || c > 0x7e || c == '\\' {
+			fmt.Fprintf(&b, "\\x%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}